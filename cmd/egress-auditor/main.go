@@ -7,14 +7,18 @@ import (
 	"os/signal"
 	"reflect"
 	"strings"
+	"sync"
 	"syscall"
 	"unsafe"
 
+	"github.com/devops-works/egress-auditor/internal/enrichers"
+	_ "github.com/devops-works/egress-auditor/internal/enrichers/all"
 	"github.com/devops-works/egress-auditor/internal/entry"
 	"github.com/devops-works/egress-auditor/internal/inputs"
 	_ "github.com/devops-works/egress-auditor/internal/inputs/all"
 	"github.com/devops-works/egress-auditor/internal/outputs"
 	_ "github.com/devops-works/egress-auditor/internal/outputs/all"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
 
 	flags "github.com/jessevdk/go-flags"
 )
@@ -31,18 +35,23 @@ func main() {
 		opts struct {
 			Inputs        []string     `short:"i" long:"input" description:"Input to use" required:"true"`
 			Outputs       []string     `short:"o" long:"output" description:"Output to use"`
+			Enrichers     []string     `short:"e" long:"enricher" description:"Enricher to use"`
 			HookOptsFn    func(string) `short:"I" long:"inopt" description:"Input option in the form <inputname>:<key>:<value>"`
 			HandlerOptsFn func(string) `short:"O" long:"outopt" description:"Output option in the form <outputname>:<key>:<value>"`
-			ListFn        func()       `short:"l" long:"list" description:"list available inputs and outputs"`
+			EnrichOptsFn  func(string) `short:"E" long:"enrichopt" description:"Enricher option in the form <enrichername>:<key>:<value>"`
+			ListFn        func()       `short:"l" long:"list" description:"list available inputs, outputs and enrichers"`
 			RenameProc    string       `short:"R" long:"rename" description:"rename egress-auditor process to this name and wipe arguments in ps output"`
+			AncestryDepth int          `long:"ancestry-depth" default:"2" description:"number of ancestors resolved for each process (0: up to init)"`
 			Version       func()       `short:"V" long:"version" description:"displays versions"`
 		}
 		in  []inputs.Input
 		out []outputs.Output
+		enr []enrichers.Enricher
 	)
 
 	ino := map[string]map[string][]string{}
 	outo := map[string]map[string][]string{}
+	enro := map[string]map[string][]string{}
 
 	opts.HookOptsFn = func(o string) {
 		err := parseSubOption(ino, o)
@@ -56,6 +65,12 @@ func main() {
 			fmt.Fprintf(os.Stderr, "error parsing output options: %v", err)
 		}
 	}
+	opts.EnrichOptsFn = func(o string) {
+		err := parseSubOption(enro, o)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing enricher options: %v", err)
+		}
+	}
 
 	opts.ListFn = func() {
 		fmt.Fprintf(os.Stderr, "\nAvailable inputs:\n\n")
@@ -67,6 +82,11 @@ func main() {
 		for k, h := range outputs.Outputs {
 			fmt.Fprintf(os.Stderr, "* %s\n%s\n", k, h.Description())
 		}
+		fmt.Fprintf(os.Stderr, "\nAvailable enrichers:\n\n")
+
+		for k, h := range enrichers.Enrichers {
+			fmt.Fprintf(os.Stderr, "* %s\n%s\n", k, h.Description())
+		}
 		os.Exit(1)
 	}
 
@@ -77,6 +97,12 @@ func main() {
 
 	flags.Parse(&opts)
 
+	if opts.AncestryDepth < 0 {
+		fmt.Fprintf(os.Stderr, "invalid ancestry depth %d: must be 0 (up to init) or more\n", opts.AncestryDepth)
+		os.Exit(1)
+	}
+	procdetail.SetAncestryDepth(opts.AncestryDepth)
+
 	for _, h := range opts.Inputs {
 		if s, ok := inputs.Inputs[h]; ok {
 			// Set configured options for input. SetOption is called once
@@ -126,6 +152,24 @@ func main() {
 		os.Exit(1)
 	}
 
+	for _, h := range opts.Enrichers {
+		if s, ok := enrichers.Enrichers[h]; ok {
+			for k, vs := range enro[h] {
+				for _, v := range vs {
+					err := s.SetOption(k, v)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "error configuring enricher %s: %v\n", h, err)
+						os.Exit(1)
+					}
+				}
+			}
+			enr = append(enr, s)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "enricher %s not implemented\n", h)
+		os.Exit(1)
+	}
+
 	if opts.RenameProc != "" {
 		if len(opts.RenameProc) > len(os.Args[0]) {
 			fmt.Fprintf(os.Stderr, "unable to rename process to %q: new name must be shorter or have the same size as %q\n", opts.RenameProc, os.Args[0])
@@ -140,23 +184,66 @@ func main() {
 	entriesChan := make(chan entry.Connection, 20)
 
 	// Register inputs
+	var inWG sync.WaitGroup
 	for i := range in {
-		// err :=
-		go in[i].Process(ctx, entriesChan)
-		defer in[i].Cleanup()
+		inWG.Add(1)
+		go func(h inputs.Input) {
+			defer inWG.Done()
+			h.Process(ctx, entriesChan)
+		}(in[i])
+	}
+	inDone := make(chan struct{})
+	go func() {
+		inWG.Wait()
+		close(inDone)
+	}()
+
+	// Register enrichers, between inputs and outputs
+	outChan := entriesChan
+	if len(enr) > 0 {
+		outChan = make(chan entry.Connection, 20)
+		for e := range enr {
+			go enr[e].Process(ctx)
+			defer enr[e].Cleanup()
+		}
+		go enrichers.Run(ctx, enr, entriesChan, outChan)
 	}
 
 	// Register outputs
+	var outWG sync.WaitGroup
 	for o := range out {
-		go out[o].Process(ctx, entriesChan)
+		outWG.Add(1)
+		go func(h outputs.Output) {
+			defer outWG.Done()
+			h.Process(ctx, outChan)
+		}(out[o])
 		defer out[o].Cleanup()
 	}
 
-	// Wait for ctrl-c
+	// Wait for ctrl-c, or for inputs reading files to be done
 	fmt.Println("egress-auditor is running... press ctrl-c to stop")
 	c := make(chan os.Signal, 10)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	select {
+	case <-c:
+		cancel()
+		go func() {
+			<-c
+			fmt.Fprintf(os.Stderr, "inputs still running, exiting anyway\n")
+			os.Exit(1)
+		}()
+		<-inDone
+	case <-inDone:
+		fmt.Fprintf(os.Stderr, "all inputs are done\n")
+	}
+
+	// Inputs are cleaned up once they no longer run. Closing their channel
+	// then lets outputs handle what is left and return.
+	for i := range in {
+		in[i].Cleanup()
+	}
+	close(entriesChan)
+	outWG.Wait()
 	cancel()
 }
 
@@ -0,0 +1,239 @@
+// Package afpacket opens AF_PACKET sockets with a classic BPF filter, for
+// inputs that need to look at packets without iptables rules or eBPF
+// programs.
+//
+// Sockets are SOCK_DGRAM ("cooked"): the link-layer header is stripped and
+// packets start at the network header, whatever the interface type.
+// Filters therefore use network-layer offsets and the protocol extension
+// to tell IPv4 from IPv6.
+package afpacket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Ethertypes as seen by the protocol extension.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+)
+
+// ErrTimeout is returned by Read when no packet arrived within the read
+// timeout, so callers can check for cancellation.
+var ErrTimeout = errors.New("read timeout")
+
+// Socket is an AF_PACKET socket bound to one interface (or all of them).
+type Socket struct {
+	fd int
+}
+
+// Config holds the options used by Open.
+type Config struct {
+	// Interface to bind to; empty means all interfaces.
+	Interface string
+	// Filter is attached to the socket before binding, so no unfiltered
+	// packet is ever queued.
+	Filter []bpf.Instruction
+	// Snaplen truncates packets; 0 means 65535.
+	Snaplen int
+	// Promiscuous puts Interface in promiscuous mode. Ignored when
+	// Interface is empty.
+	Promiscuous bool
+	// ReadTimeout bounds Read calls; 0 means 500ms.
+	ReadTimeout time.Duration
+}
+
+// Open returns a socket capturing packets matching cfg.
+func Open(cfg Config) (*Socket, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open AF_PACKET socket: %w", err)
+	}
+	s := &Socket{fd: fd}
+
+	if cfg.Snaplen == 0 {
+		cfg.Snaplen = 65535
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = 500 * time.Millisecond
+	}
+
+	if len(cfg.Filter) > 0 {
+		if err := s.setFilter(cfg.Filter, cfg.Snaplen); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	tv := unix.NsecToTimeval(cfg.ReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("unable to set read timeout: %w", err)
+	}
+
+	ifindex := 0
+	if cfg.Interface != "" {
+		ifi, err := net.InterfaceByName(cfg.Interface)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		ifindex = ifi.Index
+	}
+
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}
+	if err := unix.Bind(fd, sa); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("unable to bind AF_PACKET socket: %w", err)
+	}
+
+	if cfg.Promiscuous && ifindex != 0 {
+		mreq := &unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("unable to set promiscuous mode on %s: %w", cfg.Interface, err)
+		}
+	}
+
+	return s, nil
+}
+
+// setFilter assembles and attaches filter. Accepted packets are truncated
+// to snaplen by rewriting "ret #N" with N > snaplen.
+func (s *Socket) setFilter(filter []bpf.Instruction, snaplen int) error {
+	prog := make([]bpf.Instruction, len(filter))
+	for i, ins := range filter {
+		if r, ok := ins.(bpf.RetConstant); ok && r.Val > uint32(snaplen) {
+			ins = bpf.RetConstant{Val: uint32(snaplen)}
+		}
+		prog[i] = ins
+	}
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	sf := make([]unix.SockFilter, len(raw))
+	for i, r := range raw {
+		sf[i] = unix.SockFilter{Code: r.Op, Jt: r.Jt, Jf: r.Jf, K: r.K}
+	}
+	fprog := &unix.SockFprog{Len: uint16(len(sf)), Filter: &sf[0]}
+	if err := unix.SetsockoptSockFprog(s.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, fprog); err != nil {
+		return fmt.Errorf("unable to attach filter: %w", err)
+	}
+	return nil
+}
+
+// Packet is a packet read from a Socket.
+type Packet struct {
+	// Data starts at the network header.
+	Data []byte
+	// EtherType of Data (0x0800 for IPv4, 0x86DD for IPv6).
+	EtherType uint16
+	// Outgoing is true for packets sent by this host.
+	Outgoing bool
+	// Ifindex is the interface the packet was seen on.
+	Ifindex int
+}
+
+// Read reads the next packet into buf. It returns ErrTimeout when the read
+// timeout expires.
+func (s *Socket) Read(buf []byte) (Packet, error) {
+	n, from, err := unix.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return Packet{}, ErrTimeout
+		}
+		return Packet{}, err
+	}
+	p := Packet{Data: buf[:n]}
+	if ll, ok := from.(*unix.SockaddrLinklayer); ok {
+		p.EtherType = htons(ll.Protocol)
+		p.Outgoing = ll.Pkttype == unix.PACKET_OUTGOING
+		p.Ifindex = ll.Ifindex
+	}
+	return p, nil
+}
+
+// Close closes the socket.
+func (s *Socket) Close() error {
+	return unix.Close(s.fd)
+}
+
+// htons converts between host and network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
+
+// PortFilter accepts IPv4 and IPv6 TCP and UDP packets with port as source
+// or destination port. IPv4 fragments other than the first are rejected.
+func PortFilter(port uint16) []bpf.Instruction {
+	p := uint32(port)
+	return []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv4, SkipFalse: 10},
+		// IPv4
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_TCP, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 16},
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 14},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 0, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: 10},
+		bpf.LoadIndirect{Off: 2, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: 8, SkipFalse: 9},
+		// IPv6 (no extension headers)
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv6, SkipFalse: 8},
+		bpf.LoadAbsolute{Off: 6, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_TCP, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 5},
+		bpf.LoadAbsolute{Off: 40, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipTrue: 2},
+		bpf.LoadAbsolute{Off: 42, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: p, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// ConnFilter accepts packets that may start a connection: IPv4 and IPv6 TCP
+// packets with SYN set and ACK unset, and all UDP packets (UDP flows are
+// told apart in user space). IPv4 TCP fragments other than the first are
+// rejected.
+func ConnFilter() []bpf.Instruction {
+	const synAck = 0x12 // TCP flags SYN|ACK
+	const syn = 0x02
+	return []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtProto},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv4, SkipFalse: 9},
+		// IPv4
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipTrue: 14},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_TCP, SkipFalse: 14},
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 12},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 13, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: synAck},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: syn, SkipTrue: 7, SkipFalse: 8},
+		// IPv6 (no extension headers)
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: etherTypeIPv6, SkipFalse: 7},
+		bpf.LoadAbsolute{Off: 6, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipTrue: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_TCP, SkipFalse: 4},
+		bpf.LoadAbsolute{Off: 53, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: synAck},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: syn, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	}
+}
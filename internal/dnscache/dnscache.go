@@ -0,0 +1,159 @@
+// Package dnscache keeps track of DNS answers seen on the wire, so
+// connections can be annotated with the name that was actually resolved to
+// reach the destination IP (which beats a PTR lookup: it is what the
+// process asked for).
+package dnscache
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// grace is added to record TTLs: clients commonly connect (or reconnect
+// from a pool) a bit after the answer expired.
+const grace = 5 * time.Minute
+
+// sweepEvery is the number of insertions between two sweeps of expired
+// records.
+const sweepEvery = 1024
+
+type record struct {
+	name    string
+	expires time.Time
+}
+
+// Cache maps IP addresses to the names they were resolved from, per client
+// (the host that received the answer) with a global fallback. It is safe
+// for concurrent use.
+type Cache struct {
+	mu       sync.RWMutex
+	byClient map[string]map[string]record
+	global   map[string]record
+	inserts  int
+}
+
+// New returns an empty cache.
+func New() *Cache {
+	return &Cache{
+		byClient: make(map[string]map[string]record),
+		global:   make(map[string]record),
+	}
+}
+
+// ObservePacket records the answers of p if it is a DNS response over UDP
+// or TCP. The destination address of p is used as the client.
+func (c *Cache) ObservePacket(p gopacket.Packet, now time.Time) {
+	var client string
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		client = ip.DstIP.String()
+	case *layers.IPv6:
+		client = ip.DstIP.String()
+	default:
+		return
+	}
+
+	var payload []byte
+	switch t := p.TransportLayer().(type) {
+	case *layers.UDP:
+		if t.SrcPort != 53 {
+			return
+		}
+		payload = t.Payload
+	case *layers.TCP:
+		// DNS over TCP prefixes messages with their length. Only answers
+		// that fit in the segment are handled.
+		if t.SrcPort != 53 || len(t.Payload) < 2 {
+			return
+		}
+		l := int(binary.BigEndian.Uint16(t.Payload))
+		if len(t.Payload) < 2+l {
+			return
+		}
+		payload = t.Payload[2 : 2+l]
+	default:
+		return
+	}
+
+	c.ObserveMessage(client, payload, now)
+}
+
+// ObserveMessage records the answers in the DNS message b received by
+// client.
+func (c *Cache) ObserveMessage(client string, b []byte, now time.Time) {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	if !msg.QR || msg.ResponseCode != layers.DNSResponseCodeNoErr || len(msg.Questions) == 0 {
+		return
+	}
+
+	// Answers may go through CNAMEs; the name worth reporting is the one
+	// that was asked.
+	name := strings.TrimSuffix(string(msg.Questions[0].Name), ".")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, a := range msg.Answers {
+		if a.Type != layers.DNSTypeA && a.Type != layers.DNSTypeAAAA || a.IP == nil {
+			continue
+		}
+		r := record{
+			name:    name,
+			expires: now.Add(time.Duration(a.TTL)*time.Second + grace),
+		}
+		ip := a.IP.String()
+		if c.byClient[client] == nil {
+			c.byClient[client] = make(map[string]record)
+		}
+		c.byClient[client][ip] = r
+		c.global[ip] = r
+		c.inserts++
+	}
+
+	if c.inserts >= sweepEvery {
+		c.sweep(now)
+		c.inserts = 0
+	}
+}
+
+// Lookup returns the name ip was resolved from by client, or by any client
+// if client never resolved it. It returns "" when the name is not known.
+func (c *Cache) Lookup(client, ip string, now time.Time) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if r, ok := c.byClient[client][ip]; ok && now.Before(r.expires) {
+		return r.name
+	}
+	if r, ok := c.global[ip]; ok && now.Before(r.expires) {
+		return r.name
+	}
+	return ""
+}
+
+// sweep drops expired records. Must be called with c.mu held.
+func (c *Cache) sweep(now time.Time) {
+	for client, m := range c.byClient {
+		for ip, r := range m {
+			if now.After(r.expires) {
+				delete(m, ip)
+			}
+		}
+		if len(m) == 0 {
+			delete(c.byClient, client)
+		}
+	}
+	for ip, r := range c.global {
+		if now.After(r.expires) {
+			delete(c.global, ip)
+		}
+	}
+}
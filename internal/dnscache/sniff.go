@@ -0,0 +1,48 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/afpacket"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Sniff feeds c with DNS traffic (port 53, UDP and TCP) captured on iface
+// (all interfaces if empty) through an AF_PACKET socket, until ctx is
+// cancelled. It requires CAP_NET_RAW.
+func (c *Cache) Sniff(ctx context.Context, iface string) error {
+	sock, err := afpacket.Open(afpacket.Config{
+		Interface: iface,
+		Filter:    afpacket.PortFilter(53),
+	})
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		pkt, err := sock.Read(buf)
+		if errors.Is(err, afpacket.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var first gopacket.LayerType
+		switch pkt.EtherType {
+		case 0x0800:
+			first = layers.LayerTypeIPv4
+		case 0x86DD:
+			first = layers.LayerTypeIPv6
+		default:
+			continue
+		}
+		c.ObservePacket(gopacket.NewPacket(pkt.Data, first, gopacket.Default), time.Now())
+	}
+	return nil
+}
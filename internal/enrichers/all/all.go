@@ -0,0 +1,8 @@
+package all
+
+import (
+	//Blank imports for enrichers to register themselves
+	_ "github.com/devops-works/egress-auditor/internal/enrichers/docker"
+	_ "github.com/devops-works/egress-auditor/internal/enrichers/hosts"
+	_ "github.com/devops-works/egress-auditor/internal/enrichers/kubernetes"
+)
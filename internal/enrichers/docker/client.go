@@ -0,0 +1,129 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// errNotFound is returned when the runtime does not know a container.
+var errNotFound = errors.New("not found")
+
+// client talks to the Docker Engine API on a unix socket.
+type client struct {
+	http *http.Client
+}
+
+// newClient returns a client for the API served on the unix socket at path.
+func newClient(path string) *client {
+	var d net.Dialer
+	return &client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", path)
+				},
+				MaxIdleConns: 1,
+			},
+		},
+	}
+}
+
+// containerJSON is the part of GET /containers/{id}/json we use.
+type containerJSON struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Image  string `json:"Image"` // image id
+	Config struct {
+		Image  string            `json:"Image"` // reference it was created from
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// imageJSON is the part of GET /images/{id}/json we use.
+type imageJSON struct {
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+// container returns the description of container id.
+func (c *client) container(ctx context.Context, id string) (*entry.Container, error) {
+	var cj containerJSON
+	if err := c.get(ctx, "/containers/"+url.PathEscape(id)+"/json", &cj); err != nil {
+		return nil, err
+	}
+	ctr := &entry.Container{
+		ID:      cj.ID,
+		Name:    strings.TrimPrefix(cj.Name, "/"),
+		Image:   cj.Config.Image,
+		ImageID: cj.Image,
+		Labels:  cj.Config.Labels,
+	}
+
+	if cj.Image != "" {
+		var ij imageJSON
+		switch err := c.get(ctx, "/images/"+url.PathEscape(cj.Image)+"/json", &ij); {
+		case err == nil:
+			ctr.ImageDigest = imageDigest(cj.Config.Image, ij.RepoDigests)
+		case !errors.Is(err, errNotFound):
+			// The image may have been removed since; the container is
+			// still worth reporting.
+			return ctr, err
+		}
+	}
+	return ctr, nil
+}
+
+// get decodes the JSON answer to GET path into v.
+func (c *client) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// imageDigest returns the digest of image among the repo digests of its
+// local copy ("repo@sha256:..."), or "" if it was not pulled from a
+// registry.
+func imageDigest(image string, repoDigests []string) string {
+	if _, digest, ok := strings.Cut(image, "@"); ok {
+		return digest
+	}
+	repo := image
+	// A tag follows the last colon, unless it is part of a registry
+	// host:port.
+	if i := strings.LastIndexByte(repo, ':'); i > strings.LastIndexByte(repo, '/') {
+		repo = repo[:i]
+	}
+	for _, rd := range repoDigests {
+		r, digest, ok := strings.Cut(rd, "@")
+		if ok && (r == repo || strings.HasSuffix(r, "/"+repo)) {
+			return digest
+		}
+	}
+	if len(repoDigests) > 0 {
+		if _, digest, ok := strings.Cut(repoDigests[0], "@"); ok {
+			return digest
+		}
+	}
+	return ""
+}
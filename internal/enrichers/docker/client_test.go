@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// newTestClient returns a client for an API stand-in on a unix socket,
+// answering GET requests from the JSON bodies in routes (404 for other
+// paths, 500 for an empty body).
+func newTestClient(t *testing.T, routes map[string]string) *client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.Path]
+		switch {
+		case r.Method != http.MethodGet:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		case !ok:
+			http.NotFound(w, r)
+		case body == "":
+			http.Error(w, "server error", http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return newClient(path)
+}
+
+func TestClientContainer(t *testing.T) {
+	c := newTestClient(t, map[string]string{
+		"/containers/3f4e/json": `{
+			"Id": "3f4e8a9b",
+			"Name": "/web-1",
+			"Image": "sha256:9b1c",
+			"Config": {"Image": "nginx:1.27", "Labels": {"com.docker.compose.service": "web"}}
+		}`,
+		"/images/sha256:9b1c/json": `{"RepoDigests": ["nginx@sha256:aaaa"]}`,
+		"/containers/local/json": `{
+			"Id": "5a6b",
+			"Name": "/builder",
+			"Image": "sha256:0d0d",
+			"Config": {"Image": "builder:dev"}
+		}`,
+		"/containers/broken/json":  ``,
+		"/containers/pruned/json":  `{"Id": "7c8d", "Name": "/old", "Image": "sha256:7777", "Config": {"Image": "old:1"}}`,
+		"/images/sha256:7777/json": ``,
+	})
+
+	for _, tc := range []struct {
+		name    string
+		id      string
+		want    *entry.Container
+		wantErr error // nil for any error when want is nil
+	}{
+		{
+			name: "with digest",
+			id:   "3f4e",
+			want: &entry.Container{
+				ID:          "3f4e8a9b",
+				Name:        "web-1",
+				Image:       "nginx:1.27",
+				ImageID:     "sha256:9b1c",
+				ImageDigest: "sha256:aaaa",
+				Labels:      map[string]string{"com.docker.compose.service": "web"},
+			},
+		},
+		{
+			// The image was removed: the container is still described.
+			name: "unknown image",
+			id:   "local",
+			want: &entry.Container{ID: "5a6b", Name: "builder", Image: "builder:dev", ImageID: "sha256:0d0d"},
+		},
+		{
+			name:    "unknown container",
+			id:      "gone",
+			wantErr: errNotFound,
+		},
+		{
+			name: "API error",
+			id:   "broken",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := c.container(context.Background(), tc.id)
+			if tc.want == nil {
+				if err == nil || (tc.wantErr != nil && !errors.Is(err, tc.wantErr)) {
+					t.Fatalf("got error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	// Image errors other than 404 are reported along with the container.
+	got, err := c.container(context.Background(), "pruned")
+	if err == nil || errors.Is(err, errNotFound) {
+		t.Errorf("got error %v for a failing image lookup", err)
+	}
+	if got == nil || got.Name != "old" {
+		t.Errorf("got %+v, want the container without digest", got)
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	for _, tc := range []struct {
+		image       string
+		repoDigests []string
+		want        string
+	}{
+		{"nginx@sha256:bbbb", []string{"nginx@sha256:aaaa"}, "sha256:bbbb"},
+		{"nginx:1.27", []string{"redis@sha256:cccc", "nginx@sha256:aaaa"}, "sha256:aaaa"},
+		{"nginx", []string{"docker.io/library/nginx@sha256:aaaa"}, "sha256:aaaa"},
+		{"registry:5000/team/app:v2", []string{"registry:5000/team/app@sha256:dddd"}, "sha256:dddd"},
+		{"app:v2", []string{"mirror.local/other@sha256:eeee"}, "sha256:eeee"},
+		{"builder:dev", nil, ""},
+	} {
+		if got := imageDigest(tc.image, tc.repoDigests); got != tc.want {
+			t.Errorf("imageDigest(%q, %q) = %q, want %q", tc.image, tc.repoDigests, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package docker implements an enricher describing the containers that
+// connections come from (name, image, labels), as told by the Docker
+// Engine API, also served by Podman.
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/enrichers"
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// Delays after which unknown containers are looked up again, and the API
+// is tried again after it failed.
+const (
+	missTTL    = 30 * time.Second
+	retryDelay = 30 * time.Second
+)
+
+// Docker describes containers using the Docker Engine API
+type Docker struct {
+	socket  string
+	ttl     time.Duration
+	timeout time.Duration
+	labels  bool
+
+	client *client
+
+	mu    sync.Mutex
+	cache map[string]cached
+	// downUntil is when the API is tried again after a failure; down tells
+	// the failure was reported.
+	downUntil time.Time
+	down      bool
+}
+
+// cached is a cache entry: ctr is nil for containers the runtime does not
+// know.
+type cached struct {
+	ctr     *entry.Container
+	expires time.Time
+}
+
+// Description returns a description for the module, including the available
+// options
+func (d *Docker) Description() string {
+	return `
+	container metadata from the Docker Engine API
+	Completes connections from containers (see the container_id field) with
+	the container name, image, image digest and labels, asked to the Docker
+	Engine API on its unix socket. Podman serves the same API
+	(/run/podman/podman.sock). Answers are cached by container id.
+
+	When the socket is absent or the API fails, connections go through
+	unchanged, and the API is tried again 30s later.
+
+	The CRI API of containerd and cri-o (gRPC) is not supported.
+
+	Options:
+		- "docker:socket:<path>": API socket (default /var/run/docker.sock)
+		- "docker:cache-ttl:<duration>": how long container descriptions
+		    are kept (default 10m)
+		- "docker:timeout:<duration>": API request timeout (default 2s)
+		- "docker:labels:<true|false>": add container labels (default true)
+
+	Example:
+		egress-auditor -i ebpf -e docker -o logfmt
+		egress-auditor -i ebpf -e docker -E docker:socket:/run/podman/podman.sock -o logfmt
+	`
+}
+
+// Process evicts expired cache entries until ctx is cancelled
+func (d *Docker) Process(ctx context.Context) {
+	d.init()
+
+	t := time.NewTicker(d.ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			d.mu.Lock()
+			for id, c := range d.cache {
+				if now.After(c.expires) {
+					delete(d.cache, id)
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// init sets defaults; it is called by Process and Enrich, whichever comes
+// first.
+func (d *Docker) init() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != nil {
+		return
+	}
+	if d.socket == "" {
+		d.socket = "/var/run/docker.sock"
+	}
+	if d.ttl == 0 {
+		d.ttl = 10 * time.Minute
+	}
+	if d.timeout == 0 {
+		d.timeout = 2 * time.Second
+	}
+	d.client = newClient(d.socket)
+	d.cache = make(map[string]cached)
+}
+
+// Enrich sets the container of connections from processes in containers
+func (d *Docker) Enrich(c *entry.Connection) {
+	if c.Proc == nil || c.Proc.Cgroup == nil || c.Proc.Cgroup.ContainerID == "" {
+		return
+	}
+	d.init()
+	if ctr := d.lookup(c.Proc.Cgroup.ContainerID); ctr != nil {
+		c.Container = ctr
+	}
+}
+
+// lookup returns the description of container id, from the cache or the
+// API, or nil.
+func (d *Docker) lookup(id string) *entry.Container {
+	now := time.Now()
+
+	d.mu.Lock()
+	if c, ok := d.cache[id]; ok && now.Before(c.expires) {
+		d.mu.Unlock()
+		return c.ctr
+	}
+	if now.Before(d.downUntil) {
+		d.mu.Unlock()
+		return nil
+	}
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	ctr, err := d.client.container(ctx, id)
+	if ctr != nil && !d.labels {
+		ctr.Labels = nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case errors.Is(err, errNotFound):
+		// Not a container of this runtime.
+		d.cache[id] = cached{expires: now.Add(missTTL)}
+		d.recovered()
+		return nil
+	case err != nil && ctr == nil:
+		d.downUntil = now.Add(retryDelay)
+		if !d.down {
+			fmt.Fprintf(os.Stderr, "[docker] unable to query %s, retrying in %s: %v\n", d.socket, retryDelay, err)
+			d.down = true
+		}
+		return nil
+	case err != nil:
+		// Partial answer (image lookup failed): use it, but not for long.
+		fmt.Fprintf(os.Stderr, "[docker] container %.12s: %v\n", id, err)
+		d.cache[id] = cached{ctr: ctr, expires: now.Add(missTTL)}
+	default:
+		d.cache[id] = cached{ctr: ctr, expires: now.Add(d.ttl)}
+		d.recovered()
+	}
+	return ctr
+}
+
+// recovered reports that the API answers again. Must be called with d.mu
+// held.
+func (d *Docker) recovered() {
+	if d.down {
+		fmt.Fprintf(os.Stderr, "[docker] %s is reachable again\n", d.socket)
+		d.down = false
+	}
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (d *Docker) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (d *Docker) SetOption(k, v string) error {
+	switch k {
+	case "socket":
+		d.socket = v
+	case "cache-ttl", "timeout":
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if dur <= 0 {
+			return fmt.Errorf("%s must be positive", k)
+		}
+		if k == "cache-ttl" {
+			d.ttl = dur
+		} else {
+			d.timeout = dur
+		}
+	case "labels":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		d.labels = b
+	default:
+		return fmt.Errorf("option %q unknown for docker enricher", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in enrichers
+	enrichers.Add("docker", &Docker{labels: true})
+}
@@ -0,0 +1,53 @@
+package enrichers
+
+import (
+	"context"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// Enricher interface must be implemented by plugins that add information to
+// connections between inputs and outputs
+type Enricher interface {
+	Description() string
+	// Process runs background work (e.g. reloading sources) until the
+	// context is cancelled
+	Process(context.Context)
+	// Enrich completes a connection; it is called for every connection
+	Enrich(*entry.Connection)
+	Cleanup()
+	SetOption(string, string) error
+}
+
+// Enrichers has a list of available enrichers
+var Enrichers = map[string]Enricher{}
+
+// Add let an enricher register itself
+func Add(name string, e Enricher) {
+	Enrichers[name] = e
+}
+
+// Run passes connections read from in to out, after going through
+// enrichers in order, until ctx is cancelled or in is closed; out is closed
+// in the latter case.
+func Run(ctx context.Context, es []Enricher, in <-chan entry.Connection, out chan<- entry.Connection) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ent, ok := <-in:
+			if !ok {
+				close(out)
+				return
+			}
+			for _, e := range es {
+				e.Enrich(&ent)
+			}
+			select {
+			case out <- ent:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
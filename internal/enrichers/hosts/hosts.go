@@ -0,0 +1,300 @@
+// Package hosts implements an enricher identifying the hosts that initiate
+// forwarded (gateway mode) and inbound connections: MAC address from the
+// kernel neighbor table, name from DHCP leases or a static inventory.
+package hosts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/enrichers"
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// neighborRefresh is the minimum delay between two dumps of the neighbor
+// table, which happen when a source address is not in it.
+const neighborRefresh = 5 * time.Second
+
+// Hosts names the source hosts of connections
+type Hosts struct {
+	neighbors bool
+	dnsmasq   []string
+	dhcpd     []string
+	inventory []string
+	reload    time.Duration
+
+	loadOnce sync.Once
+
+	mu sync.Mutex
+	// static (inventory) and dynamic (leases) map IP and MAC addresses to
+	// names; static ones win.
+	static, dynamic map[string]string
+	// files holds the names last read from each file, kept when a file
+	// can not be read (e.g. while it is rewritten).
+	files     map[string]map[string]string
+	neigh     map[netip.Addr]neighbor
+	neighTime time.Time
+}
+
+// Description returns a description for the module, including the available
+// options
+func (h *Hosts) Description() string {
+	return `
+	source host identification
+	Completes forwarded connections (gateway mode) and inbound connections
+	with the MAC address of their source, from the kernel neighbor table
+	(when the input did not see it), and with its name, looked up by IP
+	then MAC address in a static inventory, then in DHCP leases.
+
+	The inventory is a YAML file:
+
+		hosts:
+		  build-server-3:
+		    ips: [192.168.1.57]
+		    macs: ["52:54:00:12:34:56"]
+
+	Options:
+		- "hosts:neighbors:<true|false>": look up MAC addresses in the
+		    neighbor table (default true)
+		- "hosts:dnsmasq-leases:<path>": dnsmasq lease file (e.g.
+		    /var/lib/misc/dnsmasq.leases); may be specified multiple times
+		- "hosts:dhcpd-leases:<path>": ISC dhcpd lease file (e.g.
+		    /var/lib/dhcp/dhcpd.leases); may be specified multiple times
+		- "hosts:inventory:<path>": YAML inventory; may be specified
+		    multiple times
+		- "hosts:reload:<duration>": how often files are read again
+		    (default 30s)
+
+	Example:
+		egress-auditor -i nflog -I nflog:gateway:true -e hosts \
+		    -E hosts:dnsmasq-leases:/var/lib/misc/dnsmasq.leases -o logfmt
+	`
+}
+
+// Process reloads lease and inventory files until ctx is cancelled
+func (h *Hosts) Process(ctx context.Context) {
+	h.loadOnce.Do(h.load)
+
+	if h.reload == 0 {
+		h.reload = 30 * time.Second
+	}
+	t := time.NewTicker(h.reload)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.load()
+		}
+	}
+}
+
+// Enrich sets the source host of forwarded and inbound connections
+func (h *Hosts) Enrich(c *entry.Connection) {
+	if c.SrcHost == nil {
+		if !c.IsIngress() {
+			return
+		}
+		c.SrcHost = &entry.Host{IP: c.SrcIP}
+	}
+	h.loadOnce.Do(h.load)
+
+	host := c.SrcHost
+	ip, err := netip.ParseAddr(host.IP)
+	if err != nil {
+		return
+	}
+	ip = ip.Unmap()
+
+	if host.MAC == "" && h.neighbors {
+		if n, ok := h.neighbor(ip); ok {
+			host.MAC = n.MAC
+			if host.Interface == "" {
+				if ifc, err := net.InterfaceByIndex(n.IfIndex); err == nil {
+					host.Interface = ifc.Name
+				}
+			}
+		}
+	}
+	if host.Name == "" {
+		host.Name = h.name(ip.String(), host.MAC)
+	}
+}
+
+// name returns the name of the host with the given addresses, or "".
+func (h *Hosts) name(ip, mac string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, names := range []map[string]string{h.static, h.dynamic} {
+		if name, ok := names[ip]; ok {
+			return name
+		}
+		if name, ok := names[mac]; ok && mac != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// neighbor returns the neighbor table entry for ip. The table is dumped
+// again when ip is not found, at most every neighborRefresh.
+func (h *Hosts) neighbor(ip netip.Addr) (neighbor, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n, ok := h.neigh[ip]; ok {
+		return n, true
+	}
+	if time.Since(h.neighTime) < neighborRefresh {
+		return neighbor{}, false
+	}
+	h.neighTime = time.Now()
+
+	neigh, err := dumpNeighbors()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[hosts] unable to read neighbor table: %v\n", err)
+		return neighbor{}, false
+	}
+	h.neigh = neigh
+	n, ok := neigh[ip]
+	return n, ok
+}
+
+// load reads the inventory and lease files.
+func (h *Hosts) load() {
+	static := make(map[string]string)
+	for _, path := range h.inventory {
+		for k, v := range h.read(path, func(r io.Reader) (map[string]string, error) {
+			byIP, byMAC, err := parseInventory(r)
+			if err != nil {
+				return nil, err
+			}
+			for mac, name := range byMAC {
+				byIP[mac] = name
+			}
+			return byIP, nil
+		}) {
+			static[k] = v
+		}
+	}
+
+	dynamic := make(map[string]string)
+	now := time.Now()
+	leaseFiles := []struct {
+		paths []string
+		parse func(io.Reader) ([]lease, error)
+	}{
+		{h.dnsmasq, parseDnsmasqLeases},
+		{h.dhcpd, parseDhcpdLeases},
+	}
+	for _, lf := range leaseFiles {
+		for _, path := range lf.paths {
+			for k, v := range h.read(path, func(r io.Reader) (map[string]string, error) {
+				leases, err := lf.parse(r)
+				if err != nil {
+					return nil, err
+				}
+				return leaseNames(leases, now), nil
+			}) {
+				dynamic[k] = v
+			}
+		}
+	}
+
+	h.mu.Lock()
+	h.static, h.dynamic = static, dynamic
+	h.mu.Unlock()
+}
+
+// read returns the names parse reads from the file at path, or the ones it
+// read last time if the file can not be read.
+func (h *Hosts) read(path string, parse func(io.Reader) (map[string]string, error)) map[string]string {
+	h.mu.Lock()
+	if h.files == nil {
+		h.files = make(map[string]map[string]string)
+	}
+	last := h.files[path]
+	h.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[hosts] %v\n", err)
+		return last
+	}
+	defer f.Close()
+
+	names, err := parse(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[hosts] error reading %s: %v\n", path, err)
+		return last
+	}
+
+	h.mu.Lock()
+	h.files[path] = names
+	h.mu.Unlock()
+	return names
+}
+
+// leaseNames returns the host names of leases that did not expire at now,
+// by IP and MAC address. Later leases replace earlier ones.
+func leaseNames(leases []lease, now time.Time) map[string]string {
+	names := make(map[string]string)
+	for _, l := range leases {
+		if l.Name == "" || (!l.Expires.IsZero() && l.Expires.Before(now)) {
+			continue
+		}
+		names[l.IP] = l.Name
+		if l.MAC != "" {
+			names[l.MAC] = l.Name
+		}
+	}
+	return names
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (h *Hosts) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (h *Hosts) SetOption(k, v string) error {
+	switch k {
+	case "neighbors":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		h.neighbors = b
+	case "dnsmasq-leases":
+		h.dnsmasq = append(h.dnsmasq, v)
+	case "dhcpd-leases":
+		h.dhcpd = append(h.dhcpd, v)
+	case "inventory":
+		h.inventory = append(h.inventory, v)
+	case "reload":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("reload must be positive")
+		}
+		h.reload = d
+	default:
+		return fmt.Errorf("option %q unknown for hosts enricher", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in enrichers
+	enrichers.Add("hosts", &Hosts{neighbors: true})
+}
@@ -0,0 +1,51 @@
+package hosts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inventory is a static list of hosts, read from YAML:
+//
+//	hosts:
+//	  build-server-3:
+//	    ips: [192.168.1.57, "2001:db8::57"]
+//	    macs: ["52:54:00:12:34:56"]
+type inventory struct {
+	Hosts map[string]struct {
+		IPs  []string `yaml:"ips"`
+		MACs []string `yaml:"macs"`
+	} `yaml:"hosts"`
+}
+
+// parseInventory parses a YAML inventory and returns host names by IP and
+// by MAC address.
+func parseInventory(r io.Reader) (byIP, byMAC map[string]string, err error) {
+	var inv inventory
+	if err := yaml.NewDecoder(r).Decode(&inv); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	byIP, byMAC = make(map[string]string), make(map[string]string)
+	for name, h := range inv.Hosts {
+		for _, s := range h.IPs {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("host %s: invalid address %q", name, s)
+			}
+			byIP[ip.String()] = name
+		}
+		for _, s := range h.MACs {
+			mac, err := net.ParseMAC(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("host %s: invalid MAC address %q", name, s)
+			}
+			byMAC[mac.String()] = name
+		}
+	}
+	return byIP, byMAC, nil
+}
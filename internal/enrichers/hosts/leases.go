@@ -0,0 +1,194 @@
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lease is a DHCP lease: an address given to a host. Expires is zero for
+// leases that never expire.
+type lease struct {
+	IP      string
+	MAC     string
+	Name    string
+	Expires time.Time
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file (dhcp-leasefile), made of
+// lines like:
+//
+//	1792101600 52:54:00:12:34:56 192.168.1.57 build-server-3 01:52:54:00:12:34:56
+//
+// that is expiry time (0 for infinite leases), MAC address, IP address,
+// host name ("*" if unknown) and client id. DHCPv6 leases follow a "duid"
+// line and have an IAID in place of the MAC address.
+func parseDnsmasqLeases(r io.Reader) ([]lease, error) {
+	var leases []lease
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields, got %d", n, len(fields))
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry time %q", n, fields[0])
+		}
+		ip, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", n, fields[2])
+		}
+
+		l := lease{IP: ip.String()}
+		if expiry != 0 {
+			l.Expires = time.Unix(expiry, 0)
+		}
+		if mac, err := net.ParseMAC(fields[1]); err == nil {
+			l.MAC = mac.String()
+		}
+		if fields[3] != "*" {
+			l.Name = fields[3]
+		}
+		leases = append(leases, l)
+	}
+	return leases, s.Err()
+}
+
+// parseDhcpdLeases parses an ISC dhcpd lease file (dhcpd.leases), made of
+// blocks like:
+//
+//	lease 192.168.1.57 {
+//	  starts 4 2026/10/15 10:00:00;
+//	  ends 4 2026/10/15 22:00:00;
+//	  binding state active;
+//	  hardware ethernet 52:54:00:12:34:56;
+//	  client-hostname "build-server-3";
+//	}
+//
+// dhcpd appends to the file, so the last block of an address is its
+// current lease: addresses are returned once, in order of first appearance,
+// and only if that lease is active (not free, expired, abandoned...). Only
+// IPv4 leases are read.
+func parseDhcpdLeases(r io.Reader) ([]lease, error) {
+	var (
+		addrs  []string
+		last   = make(map[string]*lease) // nil when no longer active
+		cur    *lease
+		active bool
+		depth  int // nested blocks in the current lease
+	)
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 && !strings.Contains(line[:i], `"`) {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if cur == nil {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "lease" && fields[2] == "{" {
+				ip, err := netip.ParseAddr(fields[1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid address %q", n, fields[1])
+				}
+				cur, active, depth = &lease{IP: ip.String()}, true, 0
+			}
+			continue
+		}
+
+		switch {
+		case line == "}" && depth == 0:
+			if _, ok := last[cur.IP]; !ok {
+				addrs = append(addrs, cur.IP)
+			}
+			last[cur.IP] = nil
+			if active {
+				last[cur.IP] = cur
+			}
+			cur = nil
+			continue
+		case strings.HasSuffix(line, "{"):
+			depth++
+			continue
+		case line == "}":
+			depth--
+			continue
+		case depth > 0:
+			continue
+		}
+
+		stmt := strings.TrimSuffix(line, ";")
+		fields := strings.Fields(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "binding state "):
+			active = len(fields) == 3 && fields[2] == "active"
+		case strings.HasPrefix(stmt, "hardware ethernet "):
+			if len(fields) == 3 {
+				if mac, err := net.ParseMAC(fields[2]); err == nil {
+					cur.MAC = mac.String()
+				}
+			}
+		case strings.HasPrefix(stmt, "client-hostname "):
+			name, err := strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(stmt, "client-hostname")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid client-hostname", n)
+			}
+			cur.Name = name
+		case len(fields) > 1 && fields[0] == "ends":
+			t, err := parseDhcpdTime(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			cur.Expires = t
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	var leases []lease
+	for _, ip := range addrs {
+		if l := last[ip]; l != nil {
+			leases = append(leases, *l)
+		}
+	}
+	return leases, nil
+}
+
+// parseDhcpdTime parses the date of dhcpd lease statements: "never",
+// "epoch <seconds>" or "<weekday> <yyyy/mm/dd> <hh:mm:ss>" (UTC).
+func parseDhcpdTime(fields []string) (time.Time, error) {
+	switch {
+	case fields[0] == "never":
+		return time.Time{}, nil
+	case fields[0] == "epoch" && len(fields) >= 2:
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch %q", fields[1])
+		}
+		return time.Unix(secs, 0), nil
+	case len(fields) >= 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q", strings.Join(fields, " "))
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", strings.Join(fields, " "))
+}
@@ -0,0 +1,133 @@
+package hosts
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLeases(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		parse   func(io.Reader) ([]lease, error)
+		file    string // in testdata, or in when empty
+		in      string
+		want    []lease
+		wantErr bool
+	}{
+		{
+			name:  "dnsmasq",
+			parse: parseDnsmasqLeases,
+			file:  "dnsmasq.leases",
+			want: []lease{
+				{IP: "192.168.1.57", MAC: "52:54:00:12:34:56", Name: "build-server-3", Expires: time.Unix(1792101600, 0)},
+				{IP: "192.168.1.58", MAC: "52:54:00:ab:cd:ef"},
+				{IP: "192.168.1.59", MAC: "52:54:00:00:00:59", Name: "printer", Expires: time.Unix(1792105200, 0)},
+				{IP: "2001:db8::57", Name: "build-server-3", Expires: time.Unix(1792101600, 0)},
+			},
+		},
+		{
+			name:    "dnsmasq short line",
+			parse:   parseDnsmasqLeases,
+			in:      "1792101600 52:54:00:12:34:56 192.168.1.57\n",
+			wantErr: true,
+		},
+		{
+			name:    "dnsmasq bad expiry",
+			parse:   parseDnsmasqLeases,
+			in:      "soon 52:54:00:12:34:56 192.168.1.57 build-server-3 *\n",
+			wantErr: true,
+		},
+		{
+			name:    "dnsmasq bad address",
+			parse:   parseDnsmasqLeases,
+			in:      "1792101600 52:54:00:12:34:56 192.168.1 build-server-3 *\n",
+			wantErr: true,
+		},
+		{
+			// .57 is renewed under a new name, .60 released, .61 keeps a
+			// '#' in its name, .62 is abandoned.
+			name:  "dhcpd",
+			parse: parseDhcpdLeases,
+			file:  "dhcpd.leases",
+			want: []lease{
+				{IP: "192.168.1.57", MAC: "52:54:00:12:34:56", Name: "build-server-3", Expires: time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC)},
+				{IP: "192.168.1.61", MAC: "52:54:00:00:00:61", Name: "lab#2", Expires: time.Unix(1792062000, 0)},
+			},
+		},
+		{
+			name:  "dhcpd never expires",
+			parse: parseDhcpdLeases,
+			in:    "lease 192.168.1.60 {\n  ends never;\n  binding state active;\n  client-hostname \"nas\";\n}\n",
+			want:  []lease{{IP: "192.168.1.60", Name: "nas"}},
+		},
+		{
+			name:    "dhcpd bad address",
+			parse:   parseDhcpdLeases,
+			in:      "lease 192.168.1 {\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "dhcpd bad hostname",
+			parse:   parseDhcpdLeases,
+			in:      "lease 192.168.1.57 {\n  client-hostname build-server-3;\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "dhcpd bad date",
+			parse:   parseDhcpdLeases,
+			in:      "lease 192.168.1.57 {\n  ends 4 2026/10/15;\n}\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = strings.NewReader(tc.in)
+			if tc.file != "" {
+				f, err := os.Open("testdata/" + tc.file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				r = f
+			}
+			got, err := tc.parse(r)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLeaseNames(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	got := leaseNames([]lease{
+		{IP: "192.168.1.57", MAC: "52:54:00:12:34:56", Name: "old-name", Expires: now.Add(time.Hour)},
+		{IP: "192.168.1.58", MAC: "52:54:00:00:00:58", Name: "expired", Expires: now.Add(-time.Hour)},
+		{IP: "192.168.1.59", Name: "forever"},
+		{IP: "192.168.1.60", MAC: "52:54:00:00:00:60"},
+		// Later leases replace earlier ones, by address and by MAC.
+		{IP: "192.168.1.57", MAC: "52:54:00:12:34:56", Name: "build-server-3", Expires: now.Add(time.Hour)},
+		{IP: "192.168.1.61", MAC: "52:54:00:12:34:56", Name: "moved", Expires: now.Add(time.Hour)},
+	}, now)
+	want := map[string]string{
+		"192.168.1.57":      "build-server-3",
+		"192.168.1.59":      "forever",
+		"192.168.1.61":      "moved",
+		"52:54:00:12:34:56": "moved",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
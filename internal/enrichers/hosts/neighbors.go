@@ -0,0 +1,75 @@
+package hosts
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// neighbor is an entry of the kernel neighbor table (ARP for IPv4, NDP for
+// IPv6).
+type neighbor struct {
+	MAC     string
+	IfIndex int
+}
+
+// dumpNeighbors returns the neighbor table entries that have a hardware
+// address, by IP address.
+func dumpNeighbors() (map[netip.Addr]neighbor, error) {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// An all-zero ndmsg asks for all families and interfaces.
+	msgs, err := c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETNEIGH,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: make([]byte, unix.SizeofNdMsg),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors := make(map[netip.Addr]neighbor, len(msgs))
+	for _, m := range msgs {
+		if len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		// struct ndmsg: family, 3 bytes of padding, ifindex, state,
+		// flags, type.
+		ifindex := int32(binary.NativeEndian.Uint32(m.Data[4:8]))
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED|unix.NUD_NOARP) != 0 {
+			continue
+		}
+
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofNdMsg:])
+		if err != nil {
+			continue
+		}
+		var (
+			ip  netip.Addr
+			mac net.HardwareAddr
+		)
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NDA_DST:
+				ip, _ = netip.AddrFromSlice(ad.Bytes())
+			case unix.NDA_LLADDR:
+				mac = net.HardwareAddr(ad.Bytes())
+			}
+		}
+		if ad.Err() != nil || !ip.IsValid() || len(mac) == 0 {
+			continue
+		}
+		neighbors[ip.Unmap()] = neighbor{MAC: mac.String(), IfIndex: int(ifindex)}
+	}
+	return neighbors, nil
+}
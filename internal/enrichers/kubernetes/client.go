@@ -0,0 +1,242 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Delays of the list and watch loop.
+const (
+	requestTimeout = 30 * time.Second
+	watchTimeout   = 5 * time.Minute
+	minBackoff     = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// errGone is returned when a watch can not resume from its resource
+// version, which has been compacted away: objects must be listed again.
+var errGone = errors.New("resource version too old")
+
+// client talks to the Kubernetes API server.
+type client struct {
+	cfg  *config
+	http *http.Client
+}
+
+func newClient(cfg *config) *client {
+	return &client{
+		cfg: cfg,
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: cfg.tls,
+				Proxy:           http.ProxyFromEnvironment,
+			},
+		},
+	}
+}
+
+// objectMeta is the part of object metadata we use.
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	OwnerReferences []struct {
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Controller bool   `json:"controller"`
+	} `json:"ownerReferences"`
+}
+
+// controller returns the kind and name of the controller of the object,
+// if any.
+func (m objectMeta) controller() (string, string, bool) {
+	for _, o := range m.OwnerReferences {
+		if o.Controller {
+			return o.Kind, o.Name, true
+		}
+	}
+	return "", "", false
+}
+
+// event is a watch event.
+type event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// store receives the objects of a list and watch.
+type store interface {
+	// replace replaces all objects with the listed ones.
+	replace(items []json.RawMessage)
+	// apply applies a watch event: ADDED, MODIFIED or DELETED.
+	apply(typ string, obj json.RawMessage)
+}
+
+// do sends a GET request for path with query q, and returns the response
+// if its status is 200.
+func (c *client) do(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	u := c.cfg.server + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token := c.cfg.token
+	if c.cfg.tokenFile != "" {
+		b, err := os.ReadFile(c.cfg.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&status)
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// get decodes the object at path into v.
+func (c *client) get(ctx context.Context, path string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	resp, err := c.do(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// listWatch keeps s in sync with the collection at path until ctx is
+// cancelled: objects are listed, then watched from the version of the
+// list; they are listed again when the watch can not be resumed. Errors
+// are reported once until the next success.
+func (c *client) listWatch(ctx context.Context, path string, s store) {
+	backoff := minBackoff
+	failing := false
+	fail := func(err error) {
+		if ctx.Err() != nil {
+			// Requests fail once cancelled.
+			return
+		}
+		if !failing {
+			fmt.Fprintf(os.Stderr, "[kubernetes] %s: %v; retrying\n", path, err)
+			failing = true
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+
+	for ctx.Err() == nil {
+		var list struct {
+			Metadata objectMeta        `json:"metadata"`
+			Items    []json.RawMessage `json:"items"`
+		}
+		if err := c.get(ctx, path, &list); err != nil {
+			fail(err)
+			continue
+		}
+		s.replace(list.Items)
+		if failing {
+			fmt.Fprintf(os.Stderr, "[kubernetes] %s: synced again\n", path)
+			failing = false
+		}
+		backoff = minBackoff
+
+		rv := list.Metadata.ResourceVersion
+		for ctx.Err() == nil {
+			var err error
+			rv, err = c.watch(ctx, path, rv, s)
+			if errors.Is(err, errGone) {
+				break
+			}
+			if err != nil {
+				fail(err)
+				break
+			}
+		}
+	}
+}
+
+// watch applies the events of a watch of path from resource version rv to
+// s, until the server ends it. It returns the version to resume from.
+func (c *client) watch(ctx context.Context, path, rv string, s store) (string, error) {
+	q := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {rv},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	}
+	resp, err := c.do(ctx, path, q)
+	if err != nil {
+		return rv, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return rv, nil
+			}
+			return rv, err
+		}
+
+		switch ev.Type {
+		case "ERROR":
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return rv, errGone
+			}
+			return rv, fmt.Errorf("watch error: %s", status.Message)
+		case "ADDED", "MODIFIED", "DELETED":
+			s.apply(ev.Type, ev.Object)
+		}
+
+		var obj struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(ev.Object, &obj); err == nil && obj.Metadata.ResourceVersion != "" {
+			rv = obj.Metadata.ResourceVersion
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a store logging the lists and events it receives.
+type recorder struct {
+	mu      sync.Mutex
+	ops     []string
+	changed chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{changed: make(chan struct{}, 100)}
+}
+
+func (r *recorder) replace(items []json.RawMessage) {
+	var names []string
+	for _, raw := range items {
+		names = append(names, objectName(raw))
+	}
+	r.record("list " + strings.Join(names, ","))
+}
+
+func (r *recorder) apply(typ string, raw json.RawMessage) {
+	r.record(typ + " " + objectName(raw))
+}
+
+func (r *recorder) record(op string) {
+	r.mu.Lock()
+	r.ops = append(r.ops, op)
+	r.mu.Unlock()
+	r.changed <- struct{}{}
+}
+
+// wait returns the operations recorded once there are n of them.
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		r.mu.Lock()
+		ops := append([]string(nil), r.ops...)
+		r.mu.Unlock()
+		if len(ops) >= n {
+			return ops
+		}
+		select {
+		case <-r.changed:
+		case <-timeout:
+			t.Fatalf("timeout waiting for %d operations, got %q", n, ops)
+		}
+	}
+}
+
+func objectName(raw json.RawMessage) string {
+	var obj struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	json.Unmarshal(raw, &obj)
+	return obj.Metadata.Name
+}
+
+// object returns the JSON of an object with only metadata.
+func object(name, rv string) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"namespace":"default","resourceVersion":%q}}`, name, rv)
+}
+
+// TestListWatch runs listWatch against a fake API server: a list, a watch
+// ended by the server, a watch that can not be resumed, and a new list.
+func TestListWatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		lists    int
+		resumed  = make(chan struct{}) // the last watch was received
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"message":"Unauthorized"}`)
+			return
+		}
+		q := r.URL.Query()
+		rv := q.Get("resourceVersion")
+		mu.Lock()
+		if q.Get("watch") == "" {
+			lists++
+			requests = append(requests, "list")
+		} else {
+			requests = append(requests, "watch "+rv)
+		}
+		n := lists
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case q.Get("watch") == "" && n == 1:
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"100"},"items":[%s,%s]}`, object("a", "90"), object("b", "95"))
+		case q.Get("watch") == "":
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"200"},"items":[%s,%s]}`, object("a", "102"), object("d", "150"))
+		case rv == "100":
+			for _, ev := range []string{
+				`{"type":"ADDED","object":` + object("c", "101") + `}`,
+				`{"type":"MODIFIED","object":` + object("a", "102") + `}`,
+				`{"type":"DELETED","object":` + object("b", "103") + `}`,
+				`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"104"}}}`,
+			} {
+				io.WriteString(w, ev+"\n")
+				w.(http.Flusher).Flush()
+			}
+		case rv == "104":
+			io.WriteString(w, `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version: 104 (180)"}}`+"\n")
+		default:
+			close(resumed)
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	c := newClient(&config{server: srv.URL, token: "s3cr3t"})
+	s := newRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.listWatch(ctx, "/api/v1/pods", s)
+		close(done)
+	}()
+
+	wantOps := []string{"list a,b", "ADDED c", "MODIFIED a", "DELETED b", "list a,d"}
+	ops := s.wait(t, len(wantOps))
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the watch to resume")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listWatch did not return once cancelled")
+	}
+
+	if !reflect.DeepEqual(ops, wantOps) {
+		t.Errorf("store got %q, want %q", ops, wantOps)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	wantRequests := []string{"list", "watch 100", "watch 104", "list", "watch 200"}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("server got %q, want %q", requests, wantRequests)
+	}
+}
+
+func TestClientGetError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"kind":"Status","message":"pods is forbidden"}`)
+	}))
+	defer srv.Close()
+
+	c := newClient(&config{server: srv.URL})
+	var v struct{}
+	err := c.get(context.Background(), "/api/v1/pods", &v)
+	if err == nil || !strings.Contains(err.Error(), "pods is forbidden") {
+		t.Errorf("got error %v, want the status message", err)
+	}
+}
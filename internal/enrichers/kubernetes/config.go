@@ -0,0 +1,207 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// In-cluster service account files.
+const (
+	saTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	saCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// config tells how to reach the API server.
+type config struct {
+	server string
+	tls    *tls.Config
+	// token is a bearer token; tokenFile is read again for each request
+	// (projected service account tokens are rotated).
+	token     string
+	tokenFile string
+}
+
+// kubeconfig is the part of a kubeconfig file we use. Authentication
+// plugins (exec, auth-provider) are not supported.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			TLSServerName            string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// loadConfig returns the configuration from the kubeconfig at path, for
+// context ctx (the current one if empty). Without path, the in-cluster
+// configuration is used when running in a pod, else $KUBECONFIG or
+// ~/.kube/config.
+func loadConfig(path, ctx string) (*config, error) {
+	if path == "" {
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			return inClusterConfig()
+		}
+		path = os.Getenv("KUBECONFIG")
+		if i := strings.IndexByte(path, os.PathListSeparator); i >= 0 {
+			path = path[:i]
+		}
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	return loadKubeconfig(path, ctx)
+}
+
+// inClusterConfig returns the configuration of pods: the API server
+// address from the environment and the service account credentials.
+func inClusterConfig() (*config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster")
+	}
+	ca, err := os.ReadFile(saCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate in %s", saCAFile)
+	}
+	return &config{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tls:       &tls.Config{RootCAs: pool},
+		tokenFile: saTokenFile,
+	}, nil
+}
+
+// loadKubeconfig returns the configuration of context ctx (the current
+// one if empty) in the kubeconfig at path. Relative file names are
+// relative to the directory of the kubeconfig.
+func loadKubeconfig(path, ctx string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	file := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+
+	if ctx == "" {
+		ctx = kc.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == ctx {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: context %q not found", path, ctx)
+	}
+
+	cfg := &config{tls: &tls.Config{}}
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		cfg.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		cfg.tls.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		cfg.tls.ServerName = c.Cluster.TLSServerName
+		ca, err := data(c.Cluster.CertificateAuthorityData, file(c.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %w", clusterName, err)
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("cluster %q: invalid certificate authority", clusterName)
+			}
+			cfg.tls.RootCAs = pool
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: cluster %q not found", path, clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		cfg.token, cfg.tokenFile = u.User.Token, file(u.User.TokenFile)
+		cert, err := data(u.User.ClientCertificateData, file(u.User.ClientCertificate))
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", userName, err)
+		}
+		key, err := data(u.User.ClientKeyData, file(u.User.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", userName, err)
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: %w", userName, err)
+			}
+			cfg.tls.Certificates = []tls.Certificate{pair}
+		}
+	}
+	return cfg, nil
+}
+
+// data returns base64 encoded inline data if set, else the content of
+// file if set, else nil.
+func data(inline, file string) ([]byte, error) {
+	switch {
+	case inline != "":
+		return base64.StdEncoding.DecodeString(inline)
+	case file != "":
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
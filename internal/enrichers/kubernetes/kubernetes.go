@@ -0,0 +1,213 @@
+// Package kubernetes implements an enricher naming the Kubernetes pods
+// connections come from, and the services or pods they go to, from caches
+// kept in sync with the API server by watches.
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/devops-works/egress-auditor/internal/enrichers"
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// Kubernetes describes pods and services
+type Kubernetes struct {
+	kubeconfig string
+	context    string
+	labels     bool
+
+	setupOnce sync.Once
+	client    *client
+	pods      *pods
+	services  *services
+
+	// owners caches the controllers of pod owners (the Deployment of a
+	// ReplicaSet, the CronJob of a Job), by namespace/kind/name.
+	ownersMu  sync.Mutex
+	owners    map[string]string
+	ownersErr bool
+	ctx       context.Context
+}
+
+// Description returns a description for the module, including the available
+// options
+func (k *Kubernetes) Description() string {
+	return `
+	Kubernetes workloads and services
+	Completes connections with the pod they come from (namespace, name,
+	owning Deployment, StatefulSet, DaemonSet, Job or CronJob, service
+	account, labels), found from the cgroup of the process or from the
+	source address of forwarded connections, and with the service or pod
+	their destination address belongs to (e.g. dest_ip=10.96.0.10 is
+	kube-system/kube-dns).
+
+	Pods and services are listed then watched. The API server is reached
+	with the in-cluster configuration when running in a pod, else with a
+	kubeconfig (token or client certificate authentication). Reading pods
+	and services, and getting replicasets and jobs, must be allowed.
+
+	Options:
+		- "kubernetes:kubeconfig:<path>": kubeconfig to use instead of the
+		    in-cluster configuration, $KUBECONFIG or ~/.kube/config
+		- "kubernetes:context:<name>": kubeconfig context (default: current)
+		- "kubernetes:labels:<true|false>": add pod labels (default true)
+
+	Example:
+		egress-auditor -i ebpf -e kubernetes -o logfmt
+	`
+}
+
+// setup creates the caches; it is called by Process and Enrich, whichever
+// comes first.
+func (k *Kubernetes) setup() {
+	k.setupOnce.Do(func() {
+		k.pods = newPods(k.convertPod)
+		k.services = newServices()
+		k.owners = make(map[string]string)
+	})
+}
+
+// Process keeps pods and services in sync until ctx is cancelled
+func (k *Kubernetes) Process(ctx context.Context) {
+	k.setup()
+
+	cfg, err := loadConfig(k.kubeconfig, k.context)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[kubernetes] unable to load configuration: %v\n", err)
+		return
+	}
+	k.client = newClient(cfg)
+	k.ctx = ctx
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		k.client.listWatch(ctx, "/api/v1/pods", k.pods)
+	}()
+	go func() {
+		defer wg.Done()
+		k.client.listWatch(ctx, "/api/v1/services", k.services)
+	}()
+	wg.Wait()
+}
+
+// Enrich sets the pods and service of connections
+func (k *Kubernetes) Enrich(c *entry.Connection) {
+	k.setup()
+
+	switch {
+	case c.Proc != nil && c.Proc.Cgroup != nil && c.Proc.Cgroup.PodUID != "":
+		c.Pod = k.pods.uid(c.Proc.Cgroup.PodUID)
+	case !c.IsIngress():
+		// Pod traffic forwarded by the node, or seen by an input that
+		// does not know processes.
+		c.Pod = k.pods.ip(c.SrcIP)
+	}
+
+	if svc := k.services.ip(c.DestIP); svc != nil {
+		c.DestService = svc
+	} else {
+		c.DestPod = k.pods.ip(c.DestIP)
+	}
+}
+
+// convertPod returns the description of p, and the keys it is indexed on.
+// Host network pods and finished pods are not indexed by IP address: the
+// address is the node's, or may be given to another pod.
+func (k *Kubernetes) convertPod(p podJSON) *indexedPod {
+	pod := &entry.Pod{
+		Namespace:      p.Metadata.Namespace,
+		Name:           p.Metadata.Name,
+		ServiceAccount: p.Spec.ServiceAccountName,
+	}
+	if k.labels {
+		pod.Labels = p.Metadata.Labels
+	}
+	if kind, name, ok := p.Metadata.controller(); ok {
+		pod.Owner = k.owner(p.Metadata.Namespace, kind, name)
+	}
+
+	ip := &indexedPod{pod: pod, uid: p.Metadata.UID}
+	if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		return ip
+	}
+	for _, a := range p.Status.PodIPs {
+		ip.ips = append(ip.ips, a.IP)
+	}
+	if len(ip.ips) == 0 && p.Status.PodIP != "" {
+		ip.ips = []string{p.Status.PodIP}
+	}
+	return ip
+}
+
+// owner returns the workload owning kind/name as "Kind/name": the
+// Deployment of a ReplicaSet or the CronJob of a Job, when they have one,
+// else kind/name itself.
+func (k *Kubernetes) owner(namespace, kind, name string) string {
+	var path string
+	switch kind {
+	case "ReplicaSet":
+		path = "/apis/apps/v1/namespaces/" + namespace + "/replicasets/" + name
+	case "Job":
+		path = "/apis/batch/v1/namespaces/" + namespace + "/jobs/" + name
+	default:
+		return kind + "/" + name
+	}
+
+	key := namespace + "/" + kind + "/" + name
+	k.ownersMu.Lock()
+	defer k.ownersMu.Unlock()
+	if o, ok := k.owners[key]; ok {
+		return o
+	}
+
+	o := kind + "/" + name
+	var obj struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	if err := k.client.get(k.ctx, path, &obj); err != nil {
+		if !k.ownersErr {
+			fmt.Fprintf(os.Stderr, "[kubernetes] unable to find the owner of %s: %v\n", key, err)
+			k.ownersErr = true
+		}
+	} else if okind, oname, ok := obj.Metadata.controller(); ok {
+		o = okind + "/" + oname
+	}
+	// Owners do not change; errors are not retried either, they are
+	// usually missing permissions.
+	k.owners[key] = o
+	return o
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (k *Kubernetes) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (k *Kubernetes) SetOption(key, v string) error {
+	switch key {
+	case "kubeconfig":
+		k.kubeconfig = v
+	case "context":
+		k.context = v
+	case "labels":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		k.labels = b
+	default:
+		return fmt.Errorf("option %q unknown for kubernetes enricher", key)
+	}
+	return nil
+}
+
+func init() {
+	// register in enrichers
+	enrichers.Add("kubernetes", &Kubernetes{labels: true})
+}
@@ -0,0 +1,220 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// podJSON is the part of a pod we use.
+type podJSON struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ServiceAccountName string `json:"serviceAccountName"`
+		HostNetwork        bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+// indexedPod is a pod with the keys it is indexed on.
+type indexedPod struct {
+	pod *entry.Pod
+	uid string
+	ips []string
+}
+
+// pods indexes pods by UID and IP address.
+type pods struct {
+	// convert turns a pod into its description and index keys; it may
+	// ask the API server about the pod owners.
+	convert func(podJSON) *indexedPod
+
+	mu    sync.RWMutex
+	byKey map[string]*indexedPod // namespace/name
+	byUID map[string]*entry.Pod
+	byIP  map[string]*entry.Pod
+}
+
+func newPods(convert func(podJSON) *indexedPod) *pods {
+	return &pods{
+		convert: convert,
+		byKey:   make(map[string]*indexedPod),
+		byUID:   make(map[string]*entry.Pod),
+		byIP:    make(map[string]*entry.Pod),
+	}
+}
+
+func (s *pods) replace(items []json.RawMessage) {
+	converted := make([]*indexedPod, 0, len(items))
+	for _, raw := range items {
+		var p podJSON
+		if json.Unmarshal(raw, &p) == nil {
+			converted = append(converted, s.convert(p))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byKey = make(map[string]*indexedPod, len(converted))
+	s.byUID = make(map[string]*entry.Pod, len(converted))
+	s.byIP = make(map[string]*entry.Pod, len(converted))
+	for _, ip := range converted {
+		s.add(ip)
+	}
+}
+
+func (s *pods) apply(typ string, raw json.RawMessage) {
+	var p podJSON
+	if json.Unmarshal(raw, &p) != nil {
+		return
+	}
+	var ip *indexedPod
+	if typ != "DELETED" {
+		ip = s.convert(p)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.byKey[p.Metadata.Namespace+"/"+p.Metadata.Name]; ok {
+		s.remove(old)
+	}
+	if ip != nil {
+		s.add(ip)
+	}
+}
+
+// add indexes ip. Must be called with s.mu held.
+func (s *pods) add(ip *indexedPod) {
+	s.byKey[ip.pod.String()] = ip
+	s.byUID[ip.uid] = ip.pod
+	for _, addr := range ip.ips {
+		s.byIP[addr] = ip.pod
+	}
+}
+
+// remove removes ip from the indexes, unless another pod took its place
+// (an IP address reused before the deletion was seen). Must be called with
+// s.mu held.
+func (s *pods) remove(ip *indexedPod) {
+	delete(s.byKey, ip.pod.String())
+	if s.byUID[ip.uid] == ip.pod {
+		delete(s.byUID, ip.uid)
+	}
+	for _, addr := range ip.ips {
+		if s.byIP[addr] == ip.pod {
+			delete(s.byIP, addr)
+		}
+	}
+}
+
+// uid returns the pod with this UID, or nil.
+func (s *pods) uid(uid string) *entry.Pod {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byUID[uid]
+}
+
+// ip returns the pod with this IP address, or nil.
+func (s *pods) ip(addr string) *entry.Pod {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byIP[addr]
+}
+
+// serviceJSON is the part of a service we use.
+type serviceJSON struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP   string   `json:"clusterIP"`
+		ClusterIPs  []string `json:"clusterIPs"`
+		ExternalIPs []string `json:"externalIPs"`
+	} `json:"spec"`
+}
+
+// ips returns the addresses of the service: cluster IPs ("None" for
+// headless services; clusterIPs is not set before Kubernetes 1.20) and
+// external IPs.
+func (s serviceJSON) ips() []string {
+	clusterIPs := s.Spec.ClusterIPs
+	if len(clusterIPs) == 0 {
+		clusterIPs = []string{s.Spec.ClusterIP}
+	}
+	var ips []string
+	for _, ip := range clusterIPs {
+		if ip != "None" && ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return append(ips, s.Spec.ExternalIPs...)
+}
+
+// services indexes services by IP address.
+type services struct {
+	mu    sync.RWMutex
+	byKey map[string][]string // namespace/name to addresses
+	byIP  map[string]*entry.Service
+}
+
+func newServices() *services {
+	return &services{
+		byKey: make(map[string][]string),
+		byIP:  make(map[string]*entry.Service),
+	}
+}
+
+func (s *services) replace(items []json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byKey = make(map[string][]string, len(items))
+	s.byIP = make(map[string]*entry.Service, len(items))
+	for _, raw := range items {
+		var svc serviceJSON
+		if json.Unmarshal(raw, &svc) == nil {
+			s.add(svc)
+		}
+	}
+}
+
+func (s *services) apply(typ string, raw json.RawMessage) {
+	var svc serviceJSON
+	if json.Unmarshal(raw, &svc) != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := svc.Metadata.Namespace + "/" + svc.Metadata.Name
+	for _, ip := range s.byKey[key] {
+		if ref := s.byIP[ip]; ref != nil && ref.String() == key {
+			delete(s.byIP, ip)
+		}
+	}
+	delete(s.byKey, key)
+	if typ != "DELETED" {
+		s.add(svc)
+	}
+}
+
+// add indexes svc. Must be called with s.mu held.
+func (s *services) add(svc serviceJSON) {
+	ref := &entry.Service{Namespace: svc.Metadata.Namespace, Name: svc.Metadata.Name}
+	ips := svc.ips()
+	s.byKey[ref.String()] = ips
+	for _, ip := range ips {
+		s.byIP[ip] = ref
+	}
+}
+
+// ip returns the service with this IP address, or nil.
+func (s *services) ip(addr string) *entry.Service {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byIP[addr]
+}
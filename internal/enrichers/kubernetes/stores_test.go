@@ -0,0 +1,113 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// pod returns the JSON of pod name in namespace default, controlled by
+// owner ("Kind/name"), with status (see running).
+func pod(name, uid, owner string, hostNetwork bool, status string) json.RawMessage {
+	kind, oname, _ := strings.Cut(owner, "/")
+	return json.RawMessage(fmt.Sprintf(`{
+		"metadata": {"name":%q,"namespace":"default","uid":%q,"labels":{"app":%q},
+			"ownerReferences":[{"kind":%q,"name":%q,"controller":true}]},
+		"spec": {"serviceAccountName":"default","hostNetwork":%t},
+		"status": %s
+	}`, name, uid, name, kind, oname, hostNetwork, status))
+}
+
+// running returns the status of a running pod with address ip.
+func running(ip string) string {
+	return fmt.Sprintf(`{"phase":"Running","podIP":%q,"podIPs":[{"ip":%q}]}`, ip, ip)
+}
+
+// TestPods feeds pods to the store of the enricher, resolving their owners
+// on a fake API server.
+func TestPods(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		gets   = map[string]int{}
+		owners = map[string]string{
+			"/apis/apps/v1/namespaces/default/replicasets/web-5d9f": `{"metadata":{"ownerReferences":[{"kind":"Deployment","name":"web","controller":true}]}}`,
+			"/apis/batch/v1/namespaces/default/jobs/backup-2900":    `{"metadata":{"ownerReferences":[{"kind":"CronJob","name":"backup","controller":true}]}}`,
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gets[r.URL.Path]++
+		mu.Unlock()
+		body, ok := owners[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	k := &Kubernetes{labels: true}
+	k.setup()
+	k.client = newClient(&config{server: srv.URL})
+	k.ctx = context.Background()
+	s := k.pods
+
+	s.replace([]json.RawMessage{
+		pod("web-5d9f-a", "uid-a", "ReplicaSet/web-5d9f", false, running("10.0.0.1")),
+		pod("web-5d9f-b", "uid-b", "ReplicaSet/web-5d9f", false, running("10.0.0.2")),
+		pod("node-exporter-q2x", "uid-n", "DaemonSet/node-exporter", true, running("192.168.1.10")),
+	})
+	checkPod(t, "10.0.0.1", s.ip("10.0.0.1"), &entry.Pod{Namespace: "default", Name: "web-5d9f-a",
+		ServiceAccount: "default", Owner: "Deployment/web", Labels: map[string]string{"app": "web-5d9f-a"}})
+	// Host network pods are found by UID only: their address is the node's.
+	checkPod(t, "192.168.1.10", s.ip("192.168.1.10"), nil)
+	checkPod(t, "uid-n", s.uid("uid-n"), &entry.Pod{Namespace: "default", Name: "node-exporter-q2x",
+		ServiceAccount: "default", Owner: "DaemonSet/node-exporter", Labels: map[string]string{"app": "node-exporter-q2x"}})
+
+	// A new address replaces the old one.
+	s.apply("MODIFIED", pod("web-5d9f-a", "uid-a", "ReplicaSet/web-5d9f", false, running("10.0.0.11")))
+	checkPod(t, "10.0.0.1", s.ip("10.0.0.1"), nil)
+	if p := s.ip("10.0.0.11"); p == nil || p.Name != "web-5d9f-a" {
+		t.Errorf("10.0.0.11: got %+v, want web-5d9f-a", p)
+	}
+
+	// The address of web-5d9f-b is given to a new pod before its deletion
+	// is seen: the deletion must not remove the new pod.
+	s.apply("ADDED", pod("backup-2900-x", "uid-x", "Job/backup-2900", false, running("10.0.0.2")))
+	s.apply("DELETED", pod("web-5d9f-b", "uid-b", "ReplicaSet/web-5d9f", false, running("10.0.0.2")))
+	checkPod(t, "uid-b", s.uid("uid-b"), nil)
+	if p := s.ip("10.0.0.2"); p == nil || p.Name != "backup-2900-x" || p.Owner != "CronJob/backup" {
+		t.Errorf("10.0.0.2: got %+v, want backup-2900-x owned by CronJob/backup", p)
+	}
+
+	// Finished pods keep their UID but not their address.
+	s.apply("MODIFIED", pod("backup-2900-x", "uid-x", "Job/backup-2900", false,
+		`{"phase":"Succeeded","podIP":"10.0.0.2"}`))
+	checkPod(t, "10.0.0.2", s.ip("10.0.0.2"), nil)
+	if p := s.uid("uid-x"); p == nil || p.Name != "backup-2900-x" {
+		t.Errorf("uid-x: got %+v, want backup-2900-x", p)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := gets["/apis/apps/v1/namespaces/default/replicasets/web-5d9f"]; n != 1 {
+		t.Errorf("ReplicaSet fetched %d times, want once", n)
+	}
+}
+
+func checkPod(t *testing.T, key string, got, want *entry.Pod) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %+v, want %+v", key, got, want)
+	}
+}
@@ -1,13 +1,177 @@
 package entry
 
-import "github.com/devops-works/egress-auditor/pkg/procdetail"
+import (
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/flows"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+)
 
 // Connection info passed between inputs and outputs
+//
+// Protocol is one of "tcp", "udp", "icmp", "icmpv6", "sctp", "raw" (raw
+// socket whose protocol is not known), "ip" (transport protocol not known,
+// e.g. auditd records read after the fact), or an IP protocol number. DestPort
+// is 0 for protocols without ports. DestHost is the name DestIP was
+// resolved from, when the input saw the DNS answer.
+//
+// Src and Dest are the initiator and the target of the connection: for
+// Ingress connections, Dest is the local address and port that accepted
+// it, and Proc the process owning the listening socket. Direction is
+// Egress when empty.
+//
+// Forward connections are routed by the host (gateway mode) between two
+// other hosts: they are attributed to SrcHost, the host that initiated
+// them, and Proc is unknown.
+//
+// Verdict is set by inputs that decide the fate of packets (nfqueue): one of
+// VerdictAccept, VerdictDrop or VerdictWouldDrop (dry-run). It is empty for
+// inputs that only observe.
+//
+// NAT is set by inputs that know the addresses a connection was translated
+// to (conntrack), when they differ from the original ones.
+//
+// Time is when the connection was seen, when the input knows it (kernel
+// timestamps, capture files, logs); it is zero otherwise. Use Timestamp.
+//
+// Rule tags the firewall rule that reported the connection (the nflog
+// prefix, or the nft rule handle for nftables traces), and Chain the chain
+// it was in (the built-in chain for nflog), when the input knows them.
+//
+// Flow holds the statistics of the pseudo-flow a connectionless
+// connection was grouped in (see internal/flows), as of when it was
+// reported, for inputs grouping packets in user space.
+//
+// Mark is the packet mark (fwmark) when the input sees packets and the
+// mark is set, e.g. to tell which firewall path a packet took.
+//
+// Container describes the container of Proc, when an enricher asked the
+// container runtime about it. Pod is the Kubernetes pod of Proc, or the
+// one with SrcIP when Proc is not known to be in a pod (e.g. pod traffic
+// forwarded by the node); DestService and DestPod are the Kubernetes
+// service or pod DestIP belongs to.
 type Connection struct {
-	Hook     string                    `json:"-"`
-	Protocol string                    `json:"protocol"`
-	DestIP   string                    `json:"dest_ip"`
-	DestPort uint16                    `json:"dest_port"`
-	Proc     *procdetail.ProcessDetail `json:"process"`
-	IPv      uint8                     `json:"ip_version"`
+	Hook        string                    `json:"-"`
+	Direction   string                    `json:"direction"`
+	Protocol    string                    `json:"protocol"`
+	SrcIP       string                    `json:"src_ip"`
+	SrcPort     uint16                    `json:"src_port"`
+	DestIP      string                    `json:"dest_ip"`
+	DestHost    string                    `json:"dest_host"`
+	DestPort    uint16                    `json:"dest_port"`
+	Proc        *procdetail.ProcessDetail `json:"process"`
+	IPv         uint8                     `json:"ip_version"`
+	Verdict     string                    `json:"verdict"`
+	NAT         *NAT                      `json:"nat,omitempty"`
+	Time        time.Time                 `json:"-"`
+	Flow        *flows.Flow               `json:"flow,omitempty"`
+	Mark        uint32                    `json:"mark,omitempty"`
+	Rule        string                    `json:"rule,omitempty"`
+	Chain       string                    `json:"chain,omitempty"`
+	SrcHost     *Host                     `json:"src_host,omitempty"`
+	Container   *Container                `json:"container,omitempty"`
+	Pod         *Pod                      `json:"pod,omitempty"`
+	DestService *Service                  `json:"dest_service,omitempty"`
+	DestPod     *Pod                      `json:"dest_pod,omitempty"`
+}
+
+// Pod describes a Kubernetes pod. Owner is the workload controlling it,
+// as "Kind/name" (e.g. "Deployment/web", "CronJob/backup"), when it has
+// one.
+type Pod struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name"`
+	Owner          string            `json:"owner,omitempty"`
+	ServiceAccount string            `json:"service_account,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// String returns "namespace/name".
+func (p *Pod) String() string {
+	return p.Namespace + "/" + p.Name
+}
+
+// Service is a Kubernetes service.
+type Service struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// String returns "namespace/name".
+func (s *Service) String() string {
+	return s.Namespace + "/" + s.Name
+}
+
+// Container describes a container, as its runtime knows it. ImageID is the
+// id of the local image, and ImageDigest the registry digest of Image, when
+// it was pulled from one.
+type Container struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	ImageID     string            `json:"image_id,omitempty"`
+	ImageDigest string            `json:"image_digest,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// Host describes a host on the network, as far as the input knows it: MAC
+// is its hardware address and Interface the local interface it was seen
+// on, when known. Name is set by enrichers (DHCP leases, inventories).
+type Host struct {
+	IP        string `json:"ip"`
+	MAC       string `json:"mac,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// Label returns the name of h if known, or its IP address.
+func (h *Host) Label() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.IP
+}
+
+// NAT holds the addresses and ports of a connection after translation, as
+// seen on the wire: SrcIP and SrcPort after SNAT (or masquerading), DestIP
+// and DestPort after DNAT.
+type NAT struct {
+	SrcIP    string `json:"src_ip"`
+	SrcPort  uint16 `json:"src_port"`
+	DestIP   string `json:"dest_ip"`
+	DestPort uint16 `json:"dest_port"`
+}
+
+// Connection directions.
+const (
+	Egress  = "egress"
+	Ingress = "ingress"
+	Forward = "forward"
+)
+
+// Verdicts.
+const (
+	VerdictAccept    = "accept"
+	VerdictDrop      = "drop"
+	VerdictWouldDrop = "would-drop"
+)
+
+// IsIngress returns true if c was accepted by the host rather than
+// initiated by it.
+func (c Connection) IsIngress() bool {
+	return c.Direction == Ingress
+}
+
+// IsForward returns true if c was routed by the host between two other
+// hosts.
+func (c Connection) IsForward() bool {
+	return c.Direction == Forward
+}
+
+// Timestamp returns c.Time, or the current time if it is not set.
+func (c Connection) Timestamp() time.Time {
+	if c.Time.IsZero() {
+		return time.Now()
+	}
+	return c.Time
 }
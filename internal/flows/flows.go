@@ -0,0 +1,162 @@
+// Package flows tracks pseudo-flows for connectionless protocols (UDP,
+// ICMP, raw sockets), so inputs report a "new connection" once per flow
+// instead of once per packet.
+//
+// A flow ends when no packet was seen for the idle timeout; the next packet
+// starts a new flow. The ebpf input does the same thing in a BPF LRU map
+// (see bpf/egress.c); both use DefaultIdleTimeout unless configured.
+package flows
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is the idle time after which a flow is considered
+// finished. It matches the conntrack timeout for unreplied UDP.
+const DefaultIdleTimeout = 30 * time.Second
+
+// DefaultMaxFlows bounds the number of flows kept in memory; the least
+// recently seen flows are dropped first.
+const DefaultMaxFlows = 16384
+
+// Key identifies a flow: its protocol, sender and destination. Build keys
+// with ProcKey or HostKey.
+//
+// Inputs that see the process key flows on it, leaving the source port
+// out so that a client sending from a new port each time (DNS resolvers
+// do) makes a single flow; struct flow_key in bpf/egress.c mirrors
+// ProcKey. Other inputs key flows on the source address and port, so that
+// two local processes sending to the same destination make two flows.
+type Key struct {
+	Protocol string
+	Pid      int32
+	SrcIP    string
+	SrcPort  uint16
+	DestIP   string
+	DestPort uint16
+}
+
+// ProcKey returns the key of a flow sent by process pid.
+func ProcKey(protocol string, pid int32, dst net.IP, dport uint16) Key {
+	return Key{Protocol: protocol, Pid: pid, DestIP: dst.String(), DestPort: dport}
+}
+
+// HostKey returns the key of a flow sent from src:sport, for inputs that
+// do not know the process.
+func HostKey(protocol string, src net.IP, sport uint16, dst net.IP, dport uint16) Key {
+	return Key{Protocol: protocol, SrcIP: src.String(), SrcPort: sport, DestIP: dst.String(), DestPort: dport}
+}
+
+// Reverse returns the key of the flow in the opposite direction, the one
+// a packet with key k answers. It is only meaningful for keys built with
+// HostKey.
+func (k Key) Reverse() Key {
+	return Key{Protocol: k.Protocol, SrcIP: k.DestIP, SrcPort: k.DestPort, DestIP: k.SrcIP, DestPort: k.SrcPort}
+}
+
+// Flow holds per-flow statistics. struct flow in bpf/egress.c holds the
+// same ones for the ebpf input.
+type Flow struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Packets   uint64    `json:"packets"`
+}
+
+type item struct {
+	key  Key
+	flow Flow
+}
+
+// Table is an LRU of flows. It is safe for concurrent use.
+type Table struct {
+	mu    sync.Mutex
+	idle  time.Duration
+	max   int
+	lru   *list.List // front is most recently seen
+	flows map[Key]*list.Element
+}
+
+// New returns a Table expiring flows after idle and holding at most max
+// flows. Zero values select DefaultIdleTimeout and DefaultMaxFlows.
+func New(idle time.Duration, max int) *Table {
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	if max <= 0 {
+		max = DefaultMaxFlows
+	}
+	return &Table{
+		idle:  idle,
+		max:   max,
+		lru:   list.New(),
+		flows: make(map[Key]*list.Element),
+	}
+}
+
+// Seen records a packet for k at now. It returns the flow statistics and
+// whether this packet started a new flow.
+func (t *Table) Seen(k Key, now time.Time) (Flow, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+
+	if el, ok := t.flows[k]; ok {
+		return t.touch(el, now), false
+	}
+
+	it := &item{
+		key:  k,
+		flow: Flow{FirstSeen: now, LastSeen: now, Packets: 1},
+	}
+	t.flows[k] = t.lru.PushFront(it)
+	for t.lru.Len() > t.max {
+		t.remove(t.lru.Back())
+	}
+	return it.flow, true
+}
+
+// Update records a packet for k at now if k is a flow in progress, and
+// reports whether it was. It never starts a flow: inputs seeing both
+// directions use it to count replies in the flow they answer.
+func (t *Table) Update(k Key, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+
+	el, ok := t.flows[k]
+	if ok {
+		t.touch(el, now)
+	}
+	return ok
+}
+
+// touch records a packet for the flow in el. Must be called with t.mu
+// held.
+func (t *Table) touch(el *list.Element, now time.Time) Flow {
+	it := el.Value.(*item)
+	it.flow.LastSeen = now
+	it.flow.Packets++
+	t.lru.MoveToFront(el)
+	return it.flow
+}
+
+// expire drops idle flows. Since the list is ordered by last packet, only
+// the tail needs to be looked at. Must be called with t.mu held.
+func (t *Table) expire(now time.Time) {
+	for el := t.lru.Back(); el != nil; el = t.lru.Back() {
+		if now.Sub(el.Value.(*item).flow.LastSeen) < t.idle {
+			return
+		}
+		t.remove(el)
+	}
+}
+
+func (t *Table) remove(el *list.Element) {
+	t.lru.Remove(el)
+	delete(t.flows, el.Value.(*item).key)
+}
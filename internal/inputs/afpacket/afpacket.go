@@ -0,0 +1,224 @@
+// Package afpacket implements an input capturing new connections on
+// AF_PACKET sockets, for hosts where neither the NFLOG target nor eBPF are
+// available.
+package afpacket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	afp "github.com/devops-works/egress-auditor/internal/afpacket"
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+)
+
+// Input captures new connections with AF_PACKET sockets
+type Input struct {
+	interfaces    []string
+	snaplen       int
+	promisc       bool
+	ingress       bool
+	allowLoopback bool
+	quiet         bool
+	dns           bool
+	flowIdle      time.Duration
+	parser        *packets.Parser
+}
+
+// Description returns a description for the module, including the available
+// options
+func (in *Input) Description() string {
+	return `
+	AF_PACKET capture
+	Captures TCP SYNs and new UDP flows sent by this host on AF_PACKET
+	sockets, filtered in the kernel with a classic BPF program, and finds the
+	owning process like the nflog input does. Needs neither iptables rules
+	nor eBPF support, only CAP_NET_RAW.
+
+	Options:
+		- "afpacket:interface:<name>": capture on this interface; may be
+		    specified multiple times (default: all interfaces)
+		- "afpacket:snaplen:<bytes>": bytes captured per packet (default
+		    65535; 128 is enough unless dns is set)
+		- "afpacket:promisc:<false|true>": put interfaces in promiscuous mode
+		    (only with explicit interfaces)
+		- "afpacket:ingress:<false|true>": also report inbound TCP
+		    connections, attributed to the process owning the listening
+		    socket. UDP is egress only: replies can not be told from new
+		    inbound flows without conntrack
+		- "afpacket:dns:<false|true>": annotate connections with the name their
+		    destination was resolved from, using captured DNS answers
+		- "afpacket:allow-loopback:<false|true>": include loopback traffic
+		- "afpacket:quiet:<false|true>": suppress per-connection messages on stderr
+		- "afpacket:udp-idle-timeout:<duration>": idle time after which a UDP
+		    flow ends (default 30s), see "UDP flows" in the README
+
+	Example:
+		sudo egress-auditor -i afpacket -I afpacket:interface:eth0 -I afpacket:snaplen:128 -o logfmt
+	`
+}
+
+// Process starts capturing on the configured interfaces
+func (in *Input) Process(ctx context.Context, c chan<- entry.Connection) {
+	in.parser = packets.NewParser(in.flowIdle, in.dns)
+
+	ifaces := in.interfaces
+	if len(ifaces) == 0 {
+		ifaces = []string{""}
+	}
+
+	var wg sync.WaitGroup
+	for _, iface := range ifaces {
+		s, err := afp.Open(afp.Config{
+			Interface:   iface,
+			Filter:      afp.ConnFilter(),
+			Snaplen:     in.snaplen,
+			Promiscuous: in.promisc,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[afpacket] unable to capture on %q: %v\n", iface, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			in.capture(ctx, s, c)
+		}()
+	}
+	wg.Wait()
+}
+
+// capture reads packets from s until ctx is cancelled.
+func (in *Input) capture(ctx context.Context, s *afp.Socket, c chan<- entry.Connection) {
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		pkt, err := s.Read(buf)
+		if errors.Is(err, afp.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[afpacket] read error: %v\n", err)
+			return
+		}
+
+		p, _, ok := packets.Decode(pkt.EtherType, pkt.Data)
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		conn, ok := in.parser.Parse(p, now)
+		if !ok {
+			continue
+		}
+		if conn.DstIP.IsLoopback() && !in.allowLoopback {
+			continue
+		}
+		if !pkt.Outgoing && !(in.ingress && conn.Protocol == "tcp") {
+			continue
+		}
+
+		var (
+			ent  entry.Connection
+			proc *procdetail.ProcessDetail
+		)
+		if pkt.Outgoing {
+			ent = conn.Entry("afpacket", entry.Egress)
+			ent.DestHost = in.parser.Host(conn, now)
+			proc, err = procdetail.GetOwnerOfConnection(conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, now)
+		} else {
+			ent = conn.Entry("afpacket", entry.Ingress)
+			proc, err = procdetail.GetOwnerOfListener(conn.Protocol, conn.DstIP, conn.DstPort, now)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[afpacket] unable to get process: %v\n", err)
+		}
+		ent.Proc = proc
+
+		if !in.quiet {
+			fmt.Fprintf(os.Stderr, "[afpacket] new %s %s connection %s:%d -> %s:%d by %s\n",
+				ent.Direction, conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, proc.Name)
+		}
+
+		select {
+		case c <- ent:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (in *Input) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (in *Input) SetOption(k, v string) error {
+	switch k {
+	case "interface":
+		in.interfaces = append(in.interfaces, v)
+	case "snaplen":
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if n < 64 || n > 65535 {
+			return fmt.Errorf("snaplen must be between 64 and 65535")
+		}
+		in.snaplen = n
+	case "promisc":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.promisc = b
+	case "ingress":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.ingress = b
+	case "dns":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.dns = b
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.quiet = b
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		in.flowIdle = d
+	default:
+		return fmt.Errorf("option %q unknown for afpacket input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("afpacket", &Input{})
+}
@@ -2,7 +2,14 @@ package all
 
 import (
 	//Blank imports for handlers to register themselves
+	_ "github.com/devops-works/egress-auditor/internal/inputs/afpacket"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/auditd"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/conntrack"
 	_ "github.com/devops-works/egress-auditor/internal/inputs/ebpf"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/kernlog"
 	_ "github.com/devops-works/egress-auditor/internal/inputs/nflog"
-	// _ "github.com/devops-works/egress-auditor/internal/hooks/nfqueue"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/nfqueue"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/nftrace"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/pcap"
+	_ "github.com/devops-works/egress-auditor/internal/inputs/procnet"
 )
@@ -0,0 +1,425 @@
+// Package auditd implements an input reading connect(2) and sendto(2)
+// syscalls recorded by the Linux audit subsystem, from audit.log or from
+// the audit netlink socket.
+package auditd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/tail"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// flushDelay is how long records of an event are waited for when the
+	// end of the event can not be seen.
+	flushDelay = time.Second
+	// liveDelay is how old an event can be for its process to be looked
+	// up in /proc.
+	liveDelay = 5 * time.Second
+	// auditNlgrpReadlog is AUDIT_NLGRP_READLOG, the multicast group
+	// receiving a copy of audit records.
+	auditNlgrpReadlog = 1
+	// unsetID is the auid of processes that did not go through a login.
+	unsetID = "4294967295"
+	// einprogress is the exit value of non blocking TCP connects.
+	einprogress = "-115"
+)
+
+// syscalls maps audit arch values to the numbers of connect and sendto.
+var syscalls = map[string]map[string]string{
+	"c000003e": {"42": "connect", "44": "sendto"},   // x86_64
+	"c00000b7": {"203": "connect", "206": "sendto"}, // aarch64
+	"40000003": {"362": "connect", "369": "sendto"}, // i386
+	"40000028": {"283": "connect", "290": "sendto"}, // arm
+}
+
+// Auditd reads connections from audit records
+type Auditd struct {
+	files         []string
+	follow        bool
+	netlink       bool
+	key           string
+	allowLoopback bool
+	quiet         bool
+
+	c   chan<- entry.Connection
+	ctx context.Context
+	// live is true while events are read as they happen.
+	live bool
+}
+
+// Description returns a description for the module, including the available
+// options
+func (a *Auditd) Description() string {
+	return `
+	auditd reader
+	Reads connect(2) and sendto(2) syscalls recorded by the audit subsystem,
+	with full process information (pid, parent, uids, login uid, executable,
+	command line). Needs audit rules like:
+
+		auditctl -a always,exit -F arch=b64 -S connect,sendto -F a2!=110 -k egress
+
+	Records are read from audit.log, or from the audit netlink socket
+	(needs CAP_AUDIT_READ; auditd can keep running). Audit records do not
+	tell whether a socket is TCP or UDP: when reading live, it is found in
+	/proc; otherwise connects in progress are TCP, sendto destinations UDP,
+	and other connections are reported with protocol "ip". The source
+	address is only known when reading live.
+
+	Options:
+		- "auditd:file:<path>": audit log to read, "-" for stdin; may be
+		    specified multiple times
+		- "auditd:follow:<false|true>": read records appended to files
+		    (starting at their end) and follow rotations, like "tail -F"
+		- "auditd:netlink:<false|true>": read records from the audit netlink
+		    socket instead of files
+		- "auditd:key:<key>": only use records of audit rules with this key
+		- "auditd:allow-loopback:<false|true>": include loopback traffic
+		- "auditd:quiet:<false|true>": suppress per-connection messages on stderr
+
+	Example:
+		egress-auditor -i auditd -I auditd:file:/var/log/audit/audit.log -I auditd:key:egress -o iptables
+		sudo egress-auditor -i auditd -I auditd:netlink:true -I auditd:key:egress -o logfmt
+	`
+}
+
+// Process reads audit records and sends connections found to c
+func (a *Auditd) Process(ctx context.Context, c chan<- entry.Connection) {
+	a.ctx, a.c = ctx, c
+
+	switch {
+	case a.netlink:
+		a.live = true
+		asm := newAssembler(a.handle)
+		defer startFlusher(ctx, asm)()
+		if err := a.receive(ctx, asm); err != nil {
+			fmt.Fprintf(os.Stderr, "[auditd] netlink error: %v\n", err)
+		}
+
+	case a.follow:
+		var wg sync.WaitGroup
+		for _, name := range a.files {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				// Each file needs its own assembler since events are only
+				// contiguous within a file.
+				asm := newAssembler(a.handle)
+				defer startFlusher(ctx, asm)()
+				line := func(l string) {
+					if r, ok := parseLine(l); ok {
+						asm.add(r, true)
+					}
+				}
+				var err error
+				if name == "-" {
+					err = tail.Lines(ctx, os.Stdin, line)
+				} else {
+					err = tail.Follow(ctx, name, false, line)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "[auditd] error reading %s: %v\n", name, err)
+				}
+			}(name)
+		}
+		wg.Wait()
+
+	default:
+		asm := newAssembler(a.handle)
+		for _, name := range a.files {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := a.read(ctx, name, asm); err != nil {
+				fmt.Fprintf(os.Stderr, "[auditd] error reading %s: %v\n", name, err)
+			}
+			asm.flushOlder(0)
+		}
+	}
+}
+
+// read reads audit log name ("-" for stdin) up to its end.
+func (a *Auditd) read(ctx context.Context, name string, asm *assembler) error {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	return tail.Lines(ctx, f, func(l string) {
+		if r, ok := parseLine(l); ok {
+			asm.add(r, true)
+		}
+	})
+}
+
+// receive reads records from the audit netlink multicast group until ctx
+// is cancelled.
+func (a *Auditd) receive(ctx context.Context, asm *assembler) error {
+	conn, err := netlink.Dial(unix.NETLINK_AUDIT, &netlink.Config{Groups: 1 << (auditNlgrpReadlog - 1)})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		msgs, err := conn.Receive()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			// Records lost when we can not keep up are not fatal.
+			if errors.Is(err, unix.ENOBUFS) {
+				fmt.Fprintf(os.Stderr, "[auditd] records lost: %v\n", err)
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			typ, ok := recordTypes[uint16(m.Header.Type)]
+			if !ok {
+				typ = strconv.Itoa(int(m.Header.Type))
+			}
+			if r, ok := parseBody(typ, string(m.Data)); ok {
+				asm.add(r, false)
+			}
+		}
+	}
+}
+
+// startFlusher runs flusher for asm in the background. The function it
+// returns stops it and waits for it to return: flushed events are sent to
+// the channel, which must not happen once Process returned.
+func startFlusher(ctx context.Context, asm *assembler) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flusher(ctx, asm)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// flusher completes events whose end was not seen until ctx is cancelled.
+func flusher(ctx context.Context, asm *assembler) {
+	t := time.NewTicker(flushDelay)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			asm.flushOlder(flushDelay)
+		}
+	}
+}
+
+// handle sends the connection described by ev, if any.
+func (a *Auditd) handle(ev *event) {
+	ent, ok := a.entry(ev)
+	if !ok {
+		return
+	}
+	select {
+	case a.c <- ent:
+	case <-a.ctx.Done():
+	}
+}
+
+// entry returns the connection started by the syscall in ev, or false if
+// ev is not a connect or sendto to an IP address, or is filtered out.
+func (a *Auditd) entry(ev *event) (entry.Connection, bool) {
+	sc, ok := ev.records["SYSCALL"]
+	if !ok {
+		return entry.Connection{}, false
+	}
+	sa, ok := ev.records["SOCKADDR"]
+	if !ok {
+		return entry.Connection{}, false
+	}
+	f := sc.fields
+
+	if a.key != "" && decode(f["key"]) != a.key {
+		return entry.Connection{}, false
+	}
+	call := syscalls[f["arch"]][f["syscall"]]
+	if call == "" {
+		return entry.Connection{}, false
+	}
+	dst, dport, ok := parseSockaddr(sa.fields["saddr"])
+	if !ok {
+		return entry.Connection{}, false
+	}
+	if dst.IsLoopback() && !a.allowLoopback {
+		return entry.Connection{}, false
+	}
+
+	pid := parseID(f["pid"])
+	live := a.live || time.Since(ev.time) < liveDelay
+
+	ent := entry.Connection{
+		Hook:      "auditd",
+		Direction: entry.Egress,
+		DestIP:    dst.String(),
+		DestPort:  dport,
+		IPv:       6,
+		Time:      ev.time,
+	}
+	if dst.To4() != nil {
+		ent.IPv = 4
+	}
+
+	var (
+		src    net.IP
+		sport  uint16
+		inProc bool
+	)
+	if fd, err := strconv.ParseInt(f["a0"], 16, 32); live && err == nil {
+		ent.Protocol, src, sport, inProc = socketInfo(int32(pid), int(fd))
+	}
+	if inProc {
+		ent.SrcIP, ent.SrcPort = src.String(), sport
+	} else {
+		switch {
+		case call == "sendto":
+			ent.Protocol = "udp"
+		case f["exit"] == einprogress:
+			ent.Protocol = "tcp"
+		default:
+			ent.Protocol = "ip"
+		}
+	}
+
+	ent.Proc = process(ev, live)
+
+	if !a.quiet {
+		fmt.Fprintf(os.Stderr, "[auditd] %s %s %s connection to %s:%d by %s (pid %d, %s)\n",
+			ev.time.Format(time.RFC3339), call, ent.Protocol, ent.DestIP, ent.DestPort, ent.Proc.Name, ent.Proc.Pid, ent.Proc.User)
+	}
+	return ent, true
+}
+
+// process returns the process that made the syscall in ev. When live is
+// true, what the records do not tell (parents, command line without
+// EXECVE or PROCTITLE) is looked up in /proc, if the process there is
+// still the one that made the syscall.
+func process(ev *event, live bool) *procdetail.ProcessDetail {
+	f := ev.records["SYSCALL"].fields
+
+	p := procdetail.ForUser(uint32(parseID(f["uid"])))
+	p.Pid = int32(parseID(f["pid"]))
+	p.GID = uint32(parseID(f["gid"]))
+	p.EUID = uint32(parseID(f["euid"]))
+	p.Name = decode(f["comm"])
+	p.Exe = decode(f["exe"])
+	p.CmdLine = ""
+	if auid := f["auid"]; auid != "" && auid != unsetID {
+		p.LoginUser = procdetail.ForUser(uint32(parseID(auid))).User
+	}
+
+	// Prefer the arguments of an execve in the same event, then the
+	// process title.
+	if ex, ok := ev.records["EXECVE"]; ok {
+		var args []string
+		for i := 0; ; i++ {
+			v, ok := ex.fields["a"+strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			args = append(args, decode(v))
+		}
+		p.CmdLine = strings.Join(args, " ")
+	}
+	if pt, ok := ev.records["PROCTITLE"]; ok && p.CmdLine == "" {
+		p.CmdLine = decode(pt.fields["proctitle"])
+	}
+
+	ppid := int32(parseID(f["ppid"]))
+	if live {
+		p.Parent = &procdetail.ProcessDetail{Pid: ppid}
+		// The comm and exe of the record are kept: /proc may hold another
+		// process by now. Errors leave the rest unknown, which is all we
+		// can do.
+		_ = p.CompleteAt(ev.time)
+		return p
+	}
+	if p.CmdLine == "" {
+		p.CmdLine = p.Name
+	}
+	p.Parent.Pid = ppid
+	return p
+}
+
+// parseID parses a decimal id field, returning 0 on error.
+func parseID(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (a *Auditd) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (a *Auditd) SetOption(k, v string) error {
+	switch k {
+	case "file":
+		a.files = append(a.files, v)
+	case "follow":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		a.follow = b
+	case "netlink":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		a.netlink = b
+	case "key":
+		a.key = v
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		a.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		a.quiet = b
+	default:
+		return fmt.Errorf("option %q unknown for auditd input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("auditd", &Auditd{})
+}
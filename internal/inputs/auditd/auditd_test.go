@@ -0,0 +1,115 @@
+package auditd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// testdata/audit.log holds, with key "egress": a TCP connect by curl (in
+// the enriched format), a sendto to an IPv6 address by a process whose
+// comm, exe and arguments are hex encoded, connects to a loopback and a
+// unix address, and a connect to an IPv4 mapped address without
+// PROCTITLE; then a connect with another key and an unrelated record.
+func TestRead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts [][2]string
+		want []string
+	}{
+		{
+			name: "all keys",
+			want: []string{
+				"tcp 203.0.113.80:443 ipv4 at 1767614398.120: pid 4242 ppid 4200 uid 1000 login root: curl (/usr/bin/curl) \"curl https://example.com\"",
+				"udp 2001:db8::35:53 ipv6 at 1767614398.500: pid 5000 ppid 1 uid 101 login : my app (/opt/my app/bin/app) \"app --name=x y -v\"",
+				"ip 198.51.100.7:80 ipv4 at 1767614399.200: pid 6000 ppid 5999 uid 0 login root: wget (/usr/bin/wget) \"wget\"",
+				"tcp 203.0.113.22:22 ipv4 at 1767614399.300: pid 7000 ppid 1 uid 1000 login : ssh (/usr/bin/ssh) \"ssh\"",
+			},
+		},
+		{
+			name: "key",
+			opts: [][2]string{{"key", "egress"}},
+			want: []string{
+				"tcp 203.0.113.80:443 ipv4 at 1767614398.120: pid 4242 ppid 4200 uid 1000 login root: curl (/usr/bin/curl) \"curl https://example.com\"",
+				"udp 2001:db8::35:53 ipv6 at 1767614398.500: pid 5000 ppid 1 uid 101 login : my app (/opt/my app/bin/app) \"app --name=x y -v\"",
+				"ip 198.51.100.7:80 ipv4 at 1767614399.200: pid 6000 ppid 5999 uid 0 login root: wget (/usr/bin/wget) \"wget\"",
+			},
+		},
+		{
+			name: "loopback",
+			opts: [][2]string{{"key", "egress"}, {"allow-loopback", "true"}},
+			want: []string{
+				"tcp 203.0.113.80:443 ipv4 at 1767614398.120: pid 4242 ppid 4200 uid 1000 login root: curl (/usr/bin/curl) \"curl https://example.com\"",
+				"udp 2001:db8::35:53 ipv6 at 1767614398.500: pid 5000 ppid 1 uid 101 login : my app (/opt/my app/bin/app) \"app --name=x y -v\"",
+				"ip 127.0.0.1:8080 ipv4 at 1767614399.000: pid 4242 ppid 4200 uid 1000 login root: curl (/usr/bin/curl) \"curl\"",
+				"ip 198.51.100.7:80 ipv4 at 1767614399.200: pid 6000 ppid 5999 uid 0 login root: wget (/usr/bin/wget) \"wget\"",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Auditd{}
+			opts := append([][2]string{{"file", "testdata/audit.log"}, {"quiet", "true"}}, tc.opts...)
+			for _, o := range opts {
+				if err := a.SetOption(o[0], o[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := make(chan entry.Connection, 10)
+			a.Process(context.Background(), c)
+			close(c)
+
+			var got []string
+			for ent := range c {
+				p := ent.Proc
+				got = append(got, fmt.Sprintf("%s %s:%d ipv%d at %d.%03d: pid %d ppid %d uid %d login %s: %s (%s) %q",
+					ent.Protocol, ent.DestIP, ent.DestPort, ent.IPv, ent.Time.Unix(), ent.Time.Nanosecond()/1e6,
+					p.Pid, p.Parent.Pid, p.UID, p.LoginUser, p.Name, p.Exe, p.CmdLine))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tc.want)
+			}
+		})
+	}
+}
+
+// On the netlink socket, records of events interleave and events end with
+// an EOE record. Long argument lists are split across EXECVE records.
+func TestAssembler(t *testing.T) {
+	var got []string
+	asm := newAssembler(func(ev *event) {
+		s := fmt.Sprintf("%d:", ev.serial)
+		for _, typ := range []string{"SYSCALL", "SOCKADDR", "EXECVE", "PROCTITLE"} {
+			if r, ok := ev.records[typ]; ok {
+				s += fmt.Sprintf(" %s(%d)", typ, len(r.fields))
+			}
+		}
+		got = append(got, s)
+	})
+	for _, l := range []string{
+		`type=SYSCALL msg=audit(1767614398.120:101): arch=c000003e syscall=42 pid=4242`,
+		`type=SYSCALL msg=audit(1767614398.500:102): arch=c000003e syscall=59 pid=5000`,
+		`type=EXECVE msg=audit(1767614398.500:102): argc=3 a0="app"`,
+		`type=SOCKADDR msg=audit(1767614398.120:101): saddr=020001BBCB0071500000000000000000`,
+		`type=EXECVE msg=audit(1767614398.500:102): a1="--name" a2="-v"`,
+		`type=EOE msg=audit(1767614398.120:101): `,
+		`type=PROCTITLE msg=audit(1767614398.500:102): proctitle=617070`,
+	} {
+		r, ok := parseLine(l)
+		if !ok {
+			t.Fatalf("unable to parse %q", l)
+		}
+		asm.add(r, false)
+	}
+	if want := []string{"101: SYSCALL(3) SOCKADDR(1)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("before flush: got %q, want %q", got, want)
+	}
+
+	asm.flushOlder(0)
+	if want := []string{"101: SYSCALL(3) SOCKADDR(1)", "102: SYSCALL(3) EXECVE(4) PROCTITLE(1)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after flush: got %q, want %q", got, want)
+	}
+}
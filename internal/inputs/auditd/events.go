@@ -0,0 +1,87 @@
+package auditd
+
+import (
+	"sync"
+	"time"
+)
+
+// event groups the records sharing an audit event serial.
+type event struct {
+	serial  uint64
+	time    time.Time
+	records map[string]record
+	// received is when the first record was read, to flush events whose
+	// end can not be known.
+	received time.Time
+}
+
+// assembler reassembles events from their records. Events end with an EOE
+// record on the netlink socket; auditd does not write those to audit.log,
+// where records of an event are contiguous instead, so events end when a
+// record of another event is read. Events whose end is never seen are
+// flushed by flushOlder.
+type assembler struct {
+	mu      sync.Mutex
+	pending map[uint64]*event
+	done    func(*event)
+}
+
+func newAssembler(done func(*event)) *assembler {
+	return &assembler{pending: make(map[uint64]*event), done: done}
+}
+
+// add adds r to its event. If contiguous is true, pending events of other
+// serials are complete.
+func (a *assembler) add(r record, contiguous bool) {
+	var complete []*event
+
+	a.mu.Lock()
+	if contiguous {
+		for serial, ev := range a.pending {
+			if serial != r.serial {
+				complete = append(complete, ev)
+				delete(a.pending, serial)
+			}
+		}
+	}
+	ev, ok := a.pending[r.serial]
+	if !ok {
+		ev = &event{serial: r.serial, time: r.time, records: make(map[string]record), received: time.Now()}
+		a.pending[r.serial] = ev
+	}
+	if r.typ == "EOE" {
+		complete = append(complete, ev)
+		delete(a.pending, r.serial)
+	} else if prev, ok := ev.records[r.typ]; ok {
+		// Long execve argument lists are split across records.
+		for k, v := range r.fields {
+			prev.fields[k] = v
+		}
+	} else {
+		ev.records[r.typ] = r
+	}
+	a.mu.Unlock()
+
+	for _, ev := range complete {
+		a.done(ev)
+	}
+}
+
+// flushOlder completes events whose first record was read more than d ago.
+// A zero d completes all pending events.
+func (a *assembler) flushOlder(d time.Duration) {
+	var complete []*event
+
+	a.mu.Lock()
+	for serial, ev := range a.pending {
+		if time.Since(ev.received) >= d {
+			complete = append(complete, ev)
+			delete(a.pending, serial)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, ev := range complete {
+		a.done(ev)
+	}
+}
@@ -0,0 +1,160 @@
+package auditd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record types, as numbered on the audit netlink socket.
+var recordTypes = map[uint16]string{
+	1300: "SYSCALL",
+	1306: "SOCKADDR",
+	1309: "EXECVE",
+	1320: "EOE",
+	1327: "PROCTITLE",
+}
+
+// record is an audit record: one line of audit.log, or one netlink message.
+type record struct {
+	typ    string
+	serial uint64
+	time   time.Time
+	fields map[string]string
+}
+
+// parseLine parses an audit.log line:
+//
+//	type=SYSCALL msg=audit(1700000000.123:456): arch=c000003e syscall=42 ...
+//
+// Lines in the "enriched" log format carry interpreted fields after a GS
+// character; they are ignored since raw fields are always present.
+func parseLine(line string) (record, bool) {
+	if !strings.HasPrefix(line, "type=") {
+		return record{}, false
+	}
+	typ, rest, ok := strings.Cut(line[len("type="):], " msg=")
+	if !ok {
+		return record{}, false
+	}
+	return parseBody(typ, rest)
+}
+
+// parseBody parses a record starting at "audit(...)", as sent on the audit
+// netlink socket.
+func parseBody(typ, body string) (record, bool) {
+	r := record{typ: typ}
+
+	if !strings.HasPrefix(body, "audit(") {
+		return r, false
+	}
+	stamp, rest, ok := strings.Cut(body[len("audit("):], "):")
+	if !ok {
+		return r, false
+	}
+	secs, serial, ok := strings.Cut(stamp, ":")
+	if !ok {
+		return r, false
+	}
+	var err error
+	if r.serial, err = strconv.ParseUint(serial, 10, 64); err != nil {
+		return r, false
+	}
+	if f, err := strconv.ParseFloat(secs, 64); err == nil {
+		r.time = time.UnixMilli(int64(f * 1000))
+	}
+
+	rest, _, _ = strings.Cut(rest, "\x1d")
+	r.fields = parseFields(strings.TrimRight(rest, "\x00\n"))
+	return r, true
+}
+
+// parseFields splits key=value pairs; values may be double quoted.
+func parseFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return fields
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return fields
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			// Quoted values are kept quoted so that decode can tell
+			// them from hex encoded ones.
+			value, s = s[:end+2], s[min(end+2, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		fields[key] = value
+	}
+}
+
+// decode returns the value of an untrusted string field (comm, exe,
+// proctitle, execve arguments): auditd quotes them, or hex encodes them
+// when they contain spaces, quotes or control characters. NUL separators
+// (in proctitle) become spaces.
+func decode(v string) string {
+	if strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) && len(v) >= 2 {
+		return v[1 : len(v)-1]
+	}
+	if v == "(null)" {
+		return ""
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return v
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(b), "\x00", " "))
+}
+
+// Address families in SOCKADDR records.
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// parseSockaddr decodes the saddr field of a SOCKADDR record, a hex dump of
+// the struct sockaddr passed to the syscall. It returns false for non IP
+// families.
+func parseSockaddr(saddr string) (net.IP, uint16, bool) {
+	b, err := hex.DecodeString(saddr)
+	if err != nil || len(b) < 4 {
+		return nil, 0, false
+	}
+	port := binary.BigEndian.Uint16(b[2:4])
+	switch binary.LittleEndian.Uint16(b[0:2]) {
+	case afInet:
+		if len(b) < 8 {
+			return nil, 0, false
+		}
+		return net.IP(append([]byte(nil), b[4:8]...)), port, true
+	case afInet6:
+		if len(b) < 24 {
+			return nil, 0, false
+		}
+		ip := net.IP(append([]byte(nil), b[8:24]...))
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip, port, true
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,77 @@
+package auditd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketInfo returns the protocol and local address of the socket open as
+// fd in process pid, from /proc. It only works while the process is alive
+// and keeps the socket open.
+func socketInfo(pid int32, fd int) (string, net.IP, uint16, bool) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil || !strings.HasPrefix(link, "socket:[") {
+		return "", nil, 0, false
+	}
+	inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		ip, port, ok := findInode(fmt.Sprintf("/proc/%d/net/%s", pid, table), inode)
+		if ok {
+			return strings.TrimSuffix(table, "6"), ip, port, true
+		}
+	}
+	return "", nil, 0, false
+}
+
+// findInode looks for the socket with the given inode in a /proc/net/tcp
+// style table and returns its local address.
+func findInode(path, inode string) (net.IP, uint16, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[9] != inode {
+			continue
+		}
+		return parseProcAddr(fields[1])
+	}
+	return nil, 0, false
+}
+
+// parseProcAddr parses "0100007F:0050": an address, as 32 bit words in
+// host (little endian) order, and a port.
+func parseProcAddr(s string) (net.IP, uint16, bool) {
+	addr, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, false
+	}
+	b, err := hex.DecodeString(addr)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0, false
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(b[i:]))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ip, uint16(p), true
+}
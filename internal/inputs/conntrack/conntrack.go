@@ -0,0 +1,332 @@
+// Package conntrack implements an input that turns conntrack NEW events,
+// received over netfilter netlink, into connections. It needs neither
+// iptables rules nor eBPF.
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+	"github.com/mdlayher/netlink"
+	ct "github.com/ti-mo/conntrack"
+	"github.com/ti-mo/netfilter"
+)
+
+// localRefresh is the minimum delay between two reloads of the local
+// addresses, which happen when an event comes from an unknown address.
+const localRefresh = 10 * time.Second
+
+// Conntrack receives new conntrack entries
+type Conntrack struct {
+	zones         []uint16
+	mark          uint32
+	markMask      uint32
+	allowLoopback bool
+	quiet         bool
+	gateway       bool
+
+	mu        sync.Mutex
+	local     map[netip.Addr]bool
+	localTime time.Time
+}
+
+// Description returns a description for the module, including the available
+// options
+func (t *Conntrack) Description() string {
+	return `
+	conntrack events
+	Subscribes to conntrack NEW events and reports every new conntrack entry
+	whose original source is a local address: TCP, UDP, ICMP and other
+	protocols, whatever the iptables rules. Connections are attributed to
+	processes with their original tuple (TCP and UDP only), and carry the
+	addresses they were translated to when NAT applies.
+
+	Needs the nf_conntrack module to be loaded (any stateful rule, or
+	"modprobe nf_conntrack") and net.netfilter.nf_conntrack_events not set
+	to 0.
+
+	In gateway mode, entries between two other hosts (routed by this one)
+	are reported too, with direction=forward and attributed to their source
+	address instead of a process.
+
+	Options:
+		- "conntrack:zone:<ID>": only report entries in this conntrack zone;
+		    may be specified multiple times
+		- "conntrack:mark:<value>[/<mask>]": only report entries whose
+		    connmark, masked, equals value (e.g. "0x10/0xf0")
+		- "conntrack:gateway:<false|true>": also report forwarded connections
+		- "conntrack:allow-loopback:<false|true>": include loopback traffic
+		- "conntrack:quiet:<false|true>": suppress per-connection messages on stderr
+
+	Example:
+		sudo egress-auditor -i conntrack -I conntrack:mark:0x1 -o logfmt
+	`
+}
+
+// Process subscribes to conntrack events and sends connections to c
+func (t *Conntrack) Process(ctx context.Context, c chan<- entry.Connection) {
+	conn, err := ct.Dial(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[conntrack] unable to open netlink socket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// Events are lost rather than the socket being closed when we can not
+	// keep up.
+	if err := conn.SetOption(netlink.NoENOBUFS, true); err != nil {
+		fmt.Fprintf(os.Stderr, "[conntrack] unable to set NoENOBUFS: %v\n", err)
+	}
+
+	events := make(chan ct.Event, 1024)
+	errs, err := conn.Listen(events, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[conntrack] unable to subscribe to events: %v\n", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errs:
+			fmt.Fprintf(os.Stderr, "[conntrack] %v\n", err)
+			return
+		case ev := <-events:
+			if ev.Type != ct.EventNew || ev.Flow == nil {
+				continue
+			}
+			ent, ok := t.handle(ev.Flow)
+			if !ok {
+				continue
+			}
+			select {
+			case c <- ent:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// handle returns the connection for a new flow, or false if the flow is
+// filtered out or was not initiated by this host (or, in gateway mode,
+// routed by it).
+func (t *Conntrack) handle(f *ct.Flow) (entry.Connection, bool) {
+	var ent entry.Connection
+
+	if len(t.zones) > 0 && !t.inZones(f.Zone) {
+		return ent, false
+	}
+	if t.markMask != 0 && f.Mark&t.markMask != t.mark {
+		return ent, false
+	}
+
+	orig, reply := f.TupleOrig, f.TupleReply
+	src, dst := orig.IP.SourceAddress.Unmap(), orig.IP.DestinationAddress.Unmap()
+	if dst.IsLoopback() && !t.allowLoopback {
+		return ent, false
+	}
+	direction := entry.Egress
+	if !t.isLocal(src) {
+		// Connections to this host are not reported; forwarded ones are
+		// in gateway mode.
+		if !t.gateway || t.isLocal(dst) {
+			return ent, false
+		}
+		direction = entry.Forward
+	}
+
+	ent = entry.Connection{
+		Hook:      "conntrack",
+		Direction: direction,
+		Protocol:  protocolName(orig.Proto.Protocol),
+		SrcIP:     src.String(),
+		SrcPort:   orig.Proto.SourcePort,
+		DestIP:    dst.String(),
+		DestPort:  orig.Proto.DestinationPort,
+		IPv:       6,
+	}
+	if src.Is4() {
+		ent.IPv = 4
+	}
+
+	// The reply tuple is the original one reversed, with translations
+	// applied: its destination is the translated source, and its source
+	// the translated destination.
+	natSrc, natDst := reply.IP.DestinationAddress.Unmap(), reply.IP.SourceAddress.Unmap()
+	natSport, natDport := reply.Proto.DestinationPort, reply.Proto.SourcePort
+	if natSrc != src || natDst != dst || natSport != ent.SrcPort || natDport != ent.DestPort {
+		ent.NAT = &entry.NAT{
+			SrcIP:    natSrc.String(),
+			SrcPort:  natSport,
+			DestIP:   natDst.String(),
+			DestPort: natDport,
+		}
+	}
+
+	switch {
+	case direction == entry.Forward:
+		ent.Proc = procdetail.Unknown()
+		ent.SrcHost = &entry.Host{IP: ent.SrcIP}
+	case ent.Protocol == "tcp", ent.Protocol == "udp":
+		proc, err := procdetail.GetOwnerOfConnection(ent.Protocol, net.IP(src.AsSlice()), ent.SrcPort, net.IP(dst.AsSlice()), ent.DestPort, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[conntrack] unable to get process: %v\n", err)
+		}
+		ent.Proc = proc
+	default:
+		ent.Proc = procdetail.Unknown()
+	}
+
+	if !t.quiet {
+		nat := ""
+		if ent.NAT != nil {
+			nat = fmt.Sprintf(" (as %s:%d -> %s:%d)", ent.NAT.SrcIP, ent.NAT.SrcPort, ent.NAT.DestIP, ent.NAT.DestPort)
+		}
+		by := ent.Proc.Name
+		if ent.SrcHost != nil {
+			by = "host " + ent.SrcHost.IP
+		}
+		fmt.Fprintf(os.Stderr, "[conntrack] new %s %s connection %s:%d -> %s:%d%s by %s\n",
+			direction, ent.Protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort, nat, by)
+	}
+
+	return ent, true
+}
+
+func (t *Conntrack) inZones(zone uint16) bool {
+	for _, z := range t.zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal returns true if a is one of the host addresses. Addresses are
+// reloaded when a is not found, at most every localRefresh, so new
+// addresses are picked up without reloading them for every forwarded flow.
+func (t *Conntrack) isLocal(a netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.local[a] {
+		return true
+	}
+	if time.Since(t.localTime) < localRefresh {
+		return false
+	}
+	t.localTime = time.Now()
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[conntrack] unable to list local addresses: %v\n", err)
+		return false
+	}
+	t.local = make(map[netip.Addr]bool, len(addrs))
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(n.IP); ok {
+			t.local[ip.Unmap()] = true
+		}
+	}
+	return t.local[a]
+}
+
+// protocolName returns the entry.Connection protocol name for IP protocol
+// number p.
+func protocolName(p uint8) string {
+	switch p {
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 132:
+		return "sctp"
+	case 1:
+		return "icmp"
+	case 58:
+		return "icmpv6"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (t *Conntrack) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (t *Conntrack) SetOption(k, v string) error {
+	switch k {
+	case "zone":
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return err
+		}
+		t.zones = append(t.zones, uint16(n))
+	case "mark":
+		mark, mask, err := parseMark(v)
+		if err != nil {
+			return err
+		}
+		t.mark, t.markMask = mark, mask
+	case "gateway":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		t.gateway = b
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		t.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		t.quiet = b
+	default:
+		return fmt.Errorf("option %q unknown for conntrack input", k)
+	}
+	return nil
+}
+
+// parseMark parses "value[/mask]"; numbers can be decimal or 0x prefixed
+// hexadecimal. The mask defaults to 0xffffffff.
+func parseMark(s string) (uint32, uint32, error) {
+	value, mask := s, "0xffffffff"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		value, mask = s[:i], s[i+1:]
+	}
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mark %q: %w", s, err)
+	}
+	m, err := strconv.ParseUint(mask, 0, 32)
+	if err != nil || m == 0 {
+		return 0, 0, fmt.Errorf("invalid mark mask in %q", s)
+	}
+	return uint32(v) & uint32(m), uint32(m), nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("conntrack", &Conntrack{})
+}
@@ -7,11 +7,23 @@
 //   - kprobe/kretprobe tcp_v6_connect
 //   - kprobe udp_sendmsg
 //   - kprobe udpv6_sendmsg
+//   - kprobe ping_v4_sendmsg, ping_v6_sendmsg (ICMP "ping" sockets)
+//   - kprobe raw_sendmsg, rawv6_sendmsg (raw sockets)
+//   - kprobe sctp_connect (only if the sctp module is loaded)
+//   - kretprobe inet_csk_accept (ingress TCP, only attached when requested)
+//   - tracepoint sched/sched_process_exec, sched/sched_process_exit
+//     (process tracking, only attached when requested)
 //
 // Each successful connect emits an `event` to the perf event array. The
 // kretprobe pattern is needed for tcp_*_connect because the destination
 // port/address are populated on the sock struct *during* the call.
 //
+// Besides the 4-tuple, every event carries the credentials and identity of
+// the calling task as seen at event time (tgid/tid, parent tgid, start time,
+// uid/gid/euid, cgroup ID, mount and net namespace inodes, executable
+// inode), so user space only has to go to /proc for what the kernel can't
+// cheaply provide.
+//
 // Build: this file is compiled by `bpf2go` from the Go side; the toolchain
 // requires clang and libbpf headers.
 
@@ -31,6 +43,7 @@
 
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 #include <bpf/bpf_endian.h>
 
 char __license[] SEC("license") = "GPL";
@@ -38,11 +51,34 @@ char __license[] SEC("license") = "GPL";
 #define AF_INET  2
 #define AF_INET6 10
 
-#define IPPROTO_TCP 6
-#define IPPROTO_UDP 17
+#define IPPROTO_ICMP   1
+#define IPPROTO_TCP    6
+#define IPPROTO_UDP    17
+#define IPPROTO_ICMPV6 58
+#define IPPROTO_SCTP   132
+
+// event.flags
+#define EVT_F_RAW 0x1 // sent on a raw socket; protocol is the socket's
 
+// event.direction. saddr/sport are always the side that initiated the
+// connection: the local socket for egress, the remote peer for ingress.
+#define EVT_DIR_EGRESS  0
+#define EVT_DIR_INGRESS 1
+
+// Keep 64-bit members first so the layout has no implicit padding; the
+// size is a multiple of 8.
 struct event {
-    __u32 pid;
+    __u64 cgroup_id;
+    __u64 exe_ino;
+    __u64 start_ns; // thread-group leader start time, see task_start_ns
+    __u32 pid;      // tgid, i.e. the user-space PID
+    __u32 tid;
+    __u32 ppid;     // tgid of real_parent
+    __u32 uid;
+    __u32 gid;
+    __u32 euid;
+    __u32 mnt_ns;
+    __u32 net_ns;
     __u8  saddr[4];
     __u8  daddr[4];
     __u8  saddr6[16];
@@ -52,6 +88,24 @@ struct event {
     __u8  ip_version;
     __u8  protocol;
     char  comm[16];
+    __u8  flags;
+    __u8  direction;
+};
+
+#define TASK_EVENT_EXEC 1
+#define TASK_EVENT_EXIT 2
+
+// Emitted on exec and on thread-group exit, to maintain the process tree in
+// user space. start_ns is the thread-group leader start time (ns since
+// boot), which together with pid identifies a process across PID reuse.
+struct task_event {
+    __u64 start_ns;
+    __u32 pid;
+    __u32 ppid;
+    __u32 uid;
+    __u32 type;
+    char  comm[16];
+    char  filename[256];
 };
 
 // Force emit type into BTF so bpf2go generates a Go mirror.
@@ -63,6 +117,49 @@ struct {
     __uint(value_size, sizeof(__u32));
 } events SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, sizeof(__u32));
+} proc_events SEC(".maps");
+
+// struct task_event is too large for the BPF stack; build it in a per-CPU
+// scratch slot instead.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct task_event);
+} proc_scratch SEC(".maps");
+
+// Pseudo-flows for connectionless sends (UDP, ICMP, raw): an event is only
+// emitted for the first packet of a flow, i.e. when no packet with the same
+// key was sent for flow_idle_ns. The LRU map evicts stale flows by itself.
+// The key mirrors flows.ProcKey in Go, and the value flows.Flow.
+struct flow_key {
+    __u8  daddr[16]; // v4 addresses use the first 4 bytes
+    __u32 pid;
+    __u16 dport;
+    __u8  protocol;
+    __u8  ip_version;
+};
+
+struct flow {
+    __u64 first_seen; // bpf_ktime_get_ns()
+    __u64 last_seen;
+    __u64 packets;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct flow_key);
+    __type(value, struct flow);
+} flows SEC(".maps");
+
+// Set from user space before loading (ebpf:udp-idle-timeout).
+const volatile __u64 flow_idle_ns = 30000000000ULL;
+
 // Stash sock pointer between kprobe/kretprobe of tcp_*_connect, keyed by
 // pid_tgid so concurrent connects from different threads don't collide.
 struct {
@@ -72,12 +169,86 @@ struct {
     __type(value, struct sock *);
 } sock_store SEC(".maps");
 
-static __always_inline void fill_common(struct event *evt, struct sock *sk)
+// start_boottime was called real_start_time before 5.5.
+struct task_struct___pre55 {
+    __u64 real_start_time;
+} __attribute__((preserve_access_index));
+
+// task_start_ns returns the start time of the process (thread-group
+// leader) of task, which with the pid identifies it across PID reuse.
+// /proc/<pid>/stat reports the boot-time clock; use the same one so events
+// and /proc scans agree.
+static __always_inline __u64 task_start_ns(struct task_struct *task)
+{
+    struct task_struct *leader = BPF_CORE_READ(task, group_leader);
+    if (bpf_core_field_exists(leader->start_boottime))
+        return BPF_CORE_READ(leader, start_boottime);
+    struct task_struct___pre55 *old = (void *)leader;
+    if (bpf_core_field_exists(old->real_start_time))
+        return BPF_CORE_READ(old, real_start_time);
+    return BPF_CORE_READ(leader, start_time);
+}
+
+static __always_inline void fill_task(struct event *evt, struct sock *sk)
 {
     __u64 pid_tgid = bpf_get_current_pid_tgid();
     evt->pid = pid_tgid >> 32;
+    evt->tid = (__u32)pid_tgid;
+
+    __u64 uid_gid = bpf_get_current_uid_gid();
+    evt->uid = (__u32)uid_gid;
+    evt->gid = uid_gid >> 32;
+
+    evt->cgroup_id = bpf_get_current_cgroup_id();
     bpf_get_current_comm(&evt->comm, sizeof(evt->comm));
 
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    evt->ppid = BPF_CORE_READ(task, real_parent, tgid);
+    evt->start_ns = task_start_ns(task);
+    evt->euid = BPF_CORE_READ(task, cred, euid.val);
+    evt->mnt_ns = BPF_CORE_READ(task, nsproxy, mnt_ns, ns.inum);
+    // Kernel threads have no mm; the read then fails and exe_ino stays 0.
+    evt->exe_ino = BPF_CORE_READ(task, mm, exe_file, f_inode, i_ino);
+    // Use the socket's namespace rather than the task's: they differ when a
+    // socket was created before setns(2).
+    evt->net_ns = BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
+}
+
+// flow_is_new updates the flow evt belongs to and returns 1 if evt starts a
+// new flow.
+static __always_inline int flow_is_new(struct event *evt)
+{
+    struct flow_key key = {};
+    key.pid = evt->pid;
+    key.dport = evt->dport;
+    key.protocol = evt->protocol;
+    key.ip_version = evt->ip_version;
+    if (evt->ip_version == 4)
+        __builtin_memcpy(key.daddr, evt->daddr, sizeof(evt->daddr));
+    else
+        __builtin_memcpy(key.daddr, evt->daddr6, sizeof(evt->daddr6));
+
+    __u64 now = bpf_ktime_get_ns();
+    struct flow *f = bpf_map_lookup_elem(&flows, &key);
+    if (f && now - f->last_seen < flow_idle_ns) {
+        f->last_seen = now;
+        __sync_fetch_and_add(&f->packets, 1);
+        return 0;
+    }
+
+    struct flow nf = {
+        .first_seen = now,
+        .last_seen = now,
+        .packets = 1,
+    };
+    bpf_map_update_elem(&flows, &key, &nf, BPF_ANY);
+    return 1;
+}
+
+static __always_inline void fill_common(struct event *evt, struct sock *sk)
+{
+    fill_task(evt, sk);
+
     __u16 dport = 0;
     __u16 sport = 0;
     bpf_probe_read_kernel(&dport, sizeof(dport), &sk->__sk_common.skc_dport);
@@ -188,7 +359,7 @@ int BPF_KPROBE(kprobe_udp_sendmsg, struct sock *sk, struct msghdr *msg)
         }
     }
 
-    if (evt.dport == 0)
+    if (evt.dport == 0 || !flow_is_new(&evt))
         return 0;
 
     bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &evt, sizeof(evt));
@@ -222,9 +393,213 @@ int BPF_KPROBE(kprobe_udpv6_sendmsg, struct sock *sk, struct msghdr *msg)
         }
     }
 
-    if (evt.dport == 0)
+    if (evt.dport == 0 || !flow_is_new(&evt))
+        return 0;
+
+    bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &evt, sizeof(evt));
+    return 0;
+}
+
+// ---------- Process tracking ----------
+
+static __always_inline struct task_event *task_event_init(__u32 type)
+{
+    __u32 zero = 0;
+    struct task_event *pe = bpf_map_lookup_elem(&proc_scratch, &zero);
+    if (!pe)
+        return NULL;
+
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    pe->type = type;
+    pe->pid = bpf_get_current_pid_tgid() >> 32;
+    pe->ppid = BPF_CORE_READ(task, real_parent, tgid);
+    pe->uid = (__u32)bpf_get_current_uid_gid();
+    pe->start_ns = task_start_ns(task);
+    pe->filename[0] = 0;
+    bpf_get_current_comm(&pe->comm, sizeof(pe->comm));
+    return pe;
+}
+
+SEC("tracepoint/sched/sched_process_exec")
+int tracepoint_sched_process_exec(struct trace_event_raw_sched_process_exec *ctx)
+{
+    struct task_event *pe = task_event_init(TASK_EVENT_EXEC);
+    if (!pe)
         return 0;
 
+    unsigned int off = ctx->__data_loc_filename & 0xFFFF;
+    bpf_probe_read_kernel_str(&pe->filename, sizeof(pe->filename), (void *)ctx + off);
+
+    bpf_perf_event_output(ctx, &proc_events, BPF_F_CURRENT_CPU, pe, sizeof(*pe));
+    return 0;
+}
+
+SEC("tracepoint/sched/sched_process_exit")
+int tracepoint_sched_process_exit(struct trace_event_raw_sched_process_template *ctx)
+{
+    // Fires for every thread; only the thread-group leader exiting means
+    // the process is gone.
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    if ((__u32)pid_tgid != pid_tgid >> 32)
+        return 0;
+
+    struct task_event *pe = task_event_init(TASK_EVENT_EXIT);
+    if (!pe)
+        return 0;
+
+    bpf_perf_event_output(ctx, &proc_events, BPF_F_CURRENT_CPU, pe, sizeof(*pe));
+    return 0;
+}
+
+// ---------- ICMP, raw and SCTP ----------
+
+// fill_sockaddr sets the destination from a user-supplied sockaddr_in or
+// sockaddr_in6 (msg_name, connect address). Returns 0 if addr was usable.
+static __always_inline int fill_sockaddr(struct event *evt, struct sockaddr *addr)
+{
+    if (!addr)
+        return -1;
+
+    __u16 family = 0;
+    __u16 port = 0;
+    bpf_probe_read_kernel(&family, sizeof(family), &addr->sa_family);
+
+    if (family == AF_INET) {
+        struct sockaddr_in *sin = (struct sockaddr_in *)addr;
+        evt->ip_version = 4;
+        bpf_probe_read_kernel(&evt->daddr, sizeof(evt->daddr), &sin->sin_addr.s_addr);
+        bpf_probe_read_kernel(&port, sizeof(port), &sin->sin_port);
+    } else if (family == AF_INET6) {
+        struct sockaddr_in6 *sin6 = (struct sockaddr_in6 *)addr;
+        evt->ip_version = 6;
+        bpf_probe_read_kernel(&evt->daddr6, sizeof(evt->daddr6),
+                              &sin6->sin6_addr.in6_u.u6_addr8);
+        bpf_probe_read_kernel(&port, sizeof(port), &sin6->sin6_port);
+    } else {
+        return -1;
+    }
+    evt->dport = bpf_ntohs(port);
+    return 0;
+}
+
+// emit_msg handles the sendmsg-style probes: destination comes from
+// msg_name for unconnected sockets and from the sock otherwise.
+static __always_inline int emit_msg(struct pt_regs *ctx, struct sock *sk,
+                                    struct msghdr *msg, __u8 ipv,
+                                    __u8 proto, __u8 flags)
+{
+    struct event evt = {};
+    evt.ip_version = ipv;
+    evt.protocol = proto;
+    evt.flags = flags;
+    fill_task(&evt, sk);
+
+    struct sockaddr *addr = NULL;
+    bpf_probe_read_kernel(&addr, sizeof(addr), &msg->msg_name);
+    if (fill_sockaddr(&evt, addr) != 0) {
+        if (ipv == 4)
+            bpf_probe_read_kernel(&evt.daddr, sizeof(evt.daddr), &sk->__sk_common.skc_daddr);
+        else
+            bpf_probe_read_kernel(&evt.daddr6, sizeof(evt.daddr6),
+                                  &sk->__sk_common.skc_v6_daddr.in6_u.u6_addr8);
+    }
+    // Ports are meaningless for ICMP and raw sockets (sin_port and skc_num
+    // hold the protocol or the ICMP echo id).
+    evt.ip_version = ipv;
+    evt.dport = 0;
+
+    if (!flow_is_new(&evt))
+        return 0;
+
+    bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &evt, sizeof(evt));
+    return 0;
+}
+
+SEC("kprobe/ping_v4_sendmsg")
+int BPF_KPROBE(kprobe_ping_v4_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    return emit_msg(ctx, sk, msg, 4, IPPROTO_ICMP, 0);
+}
+
+SEC("kprobe/ping_v6_sendmsg")
+int BPF_KPROBE(kprobe_ping_v6_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    return emit_msg(ctx, sk, msg, 6, IPPROTO_ICMPV6, 0);
+}
+
+// For raw sockets, inet_num is the protocol passed to socket(2) (e.g.
+// IPPROTO_ICMP for classic ping, IPPROTO_RAW for header-including tools).
+SEC("kprobe/raw_sendmsg")
+int BPF_KPROBE(kprobe_raw_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    __u16 proto = BPF_CORE_READ(sk, __sk_common.skc_num);
+    return emit_msg(ctx, sk, msg, 4, (__u8)proto, EVT_F_RAW);
+}
+
+SEC("kprobe/rawv6_sendmsg")
+int BPF_KPROBE(kprobe_rawv6_sendmsg, struct sock *sk, struct msghdr *msg)
+{
+    __u16 proto = BPF_CORE_READ(sk, __sk_common.skc_num);
+    return emit_msg(ctx, sk, msg, 6, (__u8)proto, EVT_F_RAW);
+}
+
+SEC("kprobe/sctp_connect")
+int BPF_KPROBE(kprobe_sctp_connect, struct sock *sk, struct sockaddr *addr)
+{
+    struct event evt = {};
+    evt.protocol = IPPROTO_SCTP;
+    fill_common(&evt, sk);
+    if (fill_sockaddr(&evt, addr) != 0 || evt.dport == 0)
+        return 0;
+
+    bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &evt, sizeof(evt));
+    return 0;
+}
+
+// ---------- Ingress (accept) ----------
+
+// inet_csk_accept returns the child socket of an accepted TCP connection
+// (v4 and v6), in the context of the accepting process. Its signature
+// changed in 6.10 but the return value did not.
+SEC("kretprobe/inet_csk_accept")
+int BPF_KRETPROBE(kretprobe_inet_csk_accept, struct sock *sk)
+{
+    if (!sk)
+        return 0;
+
+    struct event evt = {};
+    evt.protocol = IPPROTO_TCP;
+    evt.direction = EVT_DIR_INGRESS;
+    fill_task(&evt, sk);
+
+    __u16 family = BPF_CORE_READ(sk, __sk_common.skc_family);
+    if (family == AF_INET) {
+        evt.ip_version = 4;
+        bpf_probe_read_kernel(&evt.saddr, sizeof(evt.saddr), &sk->__sk_common.skc_daddr);
+        bpf_probe_read_kernel(&evt.daddr, sizeof(evt.daddr), &sk->__sk_common.skc_rcv_saddr);
+    } else if (family == AF_INET6) {
+        bpf_probe_read_kernel(&evt.saddr6, sizeof(evt.saddr6), &sk->__sk_common.skc_v6_daddr);
+        bpf_probe_read_kernel(&evt.daddr6, sizeof(evt.daddr6), &sk->__sk_common.skc_v6_rcv_saddr);
+        evt.ip_version = 6;
+        // IPv4 clients of dual-stack listeners show up as ::ffff:a.b.c.d;
+        // report them as IPv4 so rules end up in iptables, not ip6tables.
+        __u32 *w = (__u32 *)evt.saddr6;
+        if (w[0] == 0 && w[1] == 0 && w[2] == bpf_htonl(0xffff)) {
+            evt.ip_version = 4;
+            __builtin_memcpy(evt.saddr, &evt.saddr6[12], 4);
+            __builtin_memcpy(evt.daddr, &evt.daddr6[12], 4);
+        }
+    } else {
+        return 0;
+    }
+
+    __u16 dport = 0;
+    __u16 sport = 0;
+    bpf_probe_read_kernel(&dport, sizeof(dport), &sk->__sk_common.skc_dport);
+    bpf_probe_read_kernel(&sport, sizeof(sport), &sk->__sk_common.skc_num);
+    evt.sport = bpf_ntohs(dport); // remote port
+    evt.dport = sport;            // local (listening) port
+
     bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &evt, sizeof(evt));
     return 0;
 }
@@ -8,10 +8,38 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"structs"
 
 	"github.com/cilium/ebpf"
 )
 
+type bpfFlow struct {
+	_         structs.HostLayout
+	FirstSeen uint64
+	LastSeen  uint64
+	Packets   uint64
+}
+
+type bpfFlowKey struct {
+	_         structs.HostLayout
+	Daddr     [16]uint8
+	Pid       uint32
+	Dport     uint16
+	Protocol  uint8
+	IpVersion uint8
+}
+
+type bpfTaskEvent struct {
+	_        structs.HostLayout
+	StartNs  uint64
+	Pid      uint32
+	Ppid     uint32
+	Uid      uint32
+	Type     uint32
+	Comm     [16]int8
+	Filename [256]int8
+}
+
 // loadBpf returns the embedded CollectionSpec for bpf.
 func loadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -54,27 +82,39 @@ type bpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfProgramSpecs struct {
-	KprobeTcpV4Connect    *ebpf.ProgramSpec `ebpf:"kprobe_tcp_v4_connect"`
-	KprobeTcpV6Connect    *ebpf.ProgramSpec `ebpf:"kprobe_tcp_v6_connect"`
-	KprobeUdpSendmsg      *ebpf.ProgramSpec `ebpf:"kprobe_udp_sendmsg"`
-	KprobeUdpv6Sendmsg    *ebpf.ProgramSpec `ebpf:"kprobe_udpv6_sendmsg"`
-	KretprobeTcpV4Connect *ebpf.ProgramSpec `ebpf:"kretprobe_tcp_v4_connect"`
-	KretprobeTcpV6Connect *ebpf.ProgramSpec `ebpf:"kretprobe_tcp_v6_connect"`
+	KprobePingV4Sendmsg        *ebpf.ProgramSpec `ebpf:"kprobe_ping_v4_sendmsg"`
+	KprobePingV6Sendmsg        *ebpf.ProgramSpec `ebpf:"kprobe_ping_v6_sendmsg"`
+	KprobeRawSendmsg           *ebpf.ProgramSpec `ebpf:"kprobe_raw_sendmsg"`
+	KprobeRawv6Sendmsg         *ebpf.ProgramSpec `ebpf:"kprobe_rawv6_sendmsg"`
+	KprobeSctpConnect          *ebpf.ProgramSpec `ebpf:"kprobe_sctp_connect"`
+	KprobeTcpV4Connect         *ebpf.ProgramSpec `ebpf:"kprobe_tcp_v4_connect"`
+	KprobeTcpV6Connect         *ebpf.ProgramSpec `ebpf:"kprobe_tcp_v6_connect"`
+	KprobeUdpSendmsg           *ebpf.ProgramSpec `ebpf:"kprobe_udp_sendmsg"`
+	KprobeUdpv6Sendmsg         *ebpf.ProgramSpec `ebpf:"kprobe_udpv6_sendmsg"`
+	KretprobeInetCskAccept     *ebpf.ProgramSpec `ebpf:"kretprobe_inet_csk_accept"`
+	KretprobeTcpV4Connect      *ebpf.ProgramSpec `ebpf:"kretprobe_tcp_v4_connect"`
+	KretprobeTcpV6Connect      *ebpf.ProgramSpec `ebpf:"kretprobe_tcp_v6_connect"`
+	TracepointSchedProcessExec *ebpf.ProgramSpec `ebpf:"tracepoint_sched_process_exec"`
+	TracepointSchedProcessExit *ebpf.ProgramSpec `ebpf:"tracepoint_sched_process_exit"`
 }
 
 // bpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	Events    *ebpf.MapSpec `ebpf:"events"`
-	SockStore *ebpf.MapSpec `ebpf:"sock_store"`
+	Events      *ebpf.MapSpec `ebpf:"events"`
+	Flows       *ebpf.MapSpec `ebpf:"flows"`
+	ProcEvents  *ebpf.MapSpec `ebpf:"proc_events"`
+	ProcScratch *ebpf.MapSpec `ebpf:"proc_scratch"`
+	SockStore   *ebpf.MapSpec `ebpf:"sock_store"`
 }
 
 // bpfVariableSpecs contains global variables before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfVariableSpecs struct {
-	Unused *ebpf.VariableSpec `ebpf:"unused"`
+	FlowIdleNs *ebpf.VariableSpec `ebpf:"flow_idle_ns"`
+	Unused     *ebpf.VariableSpec `ebpf:"unused"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -97,13 +137,19 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	Events    *ebpf.Map `ebpf:"events"`
-	SockStore *ebpf.Map `ebpf:"sock_store"`
+	Events      *ebpf.Map `ebpf:"events"`
+	Flows       *ebpf.Map `ebpf:"flows"`
+	ProcEvents  *ebpf.Map `ebpf:"proc_events"`
+	ProcScratch *ebpf.Map `ebpf:"proc_scratch"`
+	SockStore   *ebpf.Map `ebpf:"sock_store"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.Events,
+		m.Flows,
+		m.ProcEvents,
+		m.ProcScratch,
 		m.SockStore,
 	)
 }
@@ -112,29 +158,46 @@ func (m *bpfMaps) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfVariables struct {
-	Unused *ebpf.Variable `ebpf:"unused"`
+	FlowIdleNs *ebpf.Variable `ebpf:"flow_idle_ns"`
+	Unused     *ebpf.Variable `ebpf:"unused"`
 }
 
 // bpfPrograms contains all programs after they have been loaded into the kernel.
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfPrograms struct {
-	KprobeTcpV4Connect    *ebpf.Program `ebpf:"kprobe_tcp_v4_connect"`
-	KprobeTcpV6Connect    *ebpf.Program `ebpf:"kprobe_tcp_v6_connect"`
-	KprobeUdpSendmsg      *ebpf.Program `ebpf:"kprobe_udp_sendmsg"`
-	KprobeUdpv6Sendmsg    *ebpf.Program `ebpf:"kprobe_udpv6_sendmsg"`
-	KretprobeTcpV4Connect *ebpf.Program `ebpf:"kretprobe_tcp_v4_connect"`
-	KretprobeTcpV6Connect *ebpf.Program `ebpf:"kretprobe_tcp_v6_connect"`
+	KprobePingV4Sendmsg        *ebpf.Program `ebpf:"kprobe_ping_v4_sendmsg"`
+	KprobePingV6Sendmsg        *ebpf.Program `ebpf:"kprobe_ping_v6_sendmsg"`
+	KprobeRawSendmsg           *ebpf.Program `ebpf:"kprobe_raw_sendmsg"`
+	KprobeRawv6Sendmsg         *ebpf.Program `ebpf:"kprobe_rawv6_sendmsg"`
+	KprobeSctpConnect          *ebpf.Program `ebpf:"kprobe_sctp_connect"`
+	KprobeTcpV4Connect         *ebpf.Program `ebpf:"kprobe_tcp_v4_connect"`
+	KprobeTcpV6Connect         *ebpf.Program `ebpf:"kprobe_tcp_v6_connect"`
+	KprobeUdpSendmsg           *ebpf.Program `ebpf:"kprobe_udp_sendmsg"`
+	KprobeUdpv6Sendmsg         *ebpf.Program `ebpf:"kprobe_udpv6_sendmsg"`
+	KretprobeInetCskAccept     *ebpf.Program `ebpf:"kretprobe_inet_csk_accept"`
+	KretprobeTcpV4Connect      *ebpf.Program `ebpf:"kretprobe_tcp_v4_connect"`
+	KretprobeTcpV6Connect      *ebpf.Program `ebpf:"kretprobe_tcp_v6_connect"`
+	TracepointSchedProcessExec *ebpf.Program `ebpf:"tracepoint_sched_process_exec"`
+	TracepointSchedProcessExit *ebpf.Program `ebpf:"tracepoint_sched_process_exit"`
 }
 
 func (p *bpfPrograms) Close() error {
 	return _BpfClose(
+		p.KprobePingV4Sendmsg,
+		p.KprobePingV6Sendmsg,
+		p.KprobeRawSendmsg,
+		p.KprobeRawv6Sendmsg,
+		p.KprobeSctpConnect,
 		p.KprobeTcpV4Connect,
 		p.KprobeTcpV6Connect,
 		p.KprobeUdpSendmsg,
 		p.KprobeUdpv6Sendmsg,
+		p.KretprobeInetCskAccept,
 		p.KretprobeTcpV4Connect,
 		p.KretprobeTcpV6Connect,
+		p.TracepointSchedProcessExec,
+		p.TracepointSchedProcessExit,
 	)
 }
 
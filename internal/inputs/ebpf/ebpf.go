@@ -12,13 +12,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -26,16 +26,28 @@ import (
 	"github.com/cilium/ebpf/perf"
 	"github.com/cilium/ebpf/rlimit"
 
+	"github.com/devops-works/egress-auditor/internal/dnscache"
 	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/flows"
 	"github.com/devops-works/egress-auditor/internal/inputs"
 	"github.com/devops-works/egress-auditor/pkg/procdetail"
 )
 
 // bpfEvent mirrors `struct event` in bpf/egress.c. The byte layout must
-// stay in sync with the C struct (no padding because all fields are
-// naturally aligned).
+// stay in sync with the C struct (no implicit padding because all fields
+// are naturally aligned).
 type bpfEvent struct {
+	CgroupID  uint64
+	ExeIno    uint64
+	StartNs   uint64
 	Pid       uint32
+	Tid       uint32
+	Ppid      uint32
+	UID       uint32
+	GID       uint32
+	EUID      uint32
+	MntNS     uint32
+	NetNS     uint32
 	Saddr     [4]byte
 	Daddr     [4]byte
 	Saddr6    [16]byte
@@ -45,12 +57,42 @@ type bpfEvent struct {
 	IPVersion uint8
 	Protocol  uint8
 	Comm      [16]byte
+	Flags     uint8
+	Direction uint8
 }
 
+// evtFlagRaw is set in bpfEvent.Flags when the packet was sent on a raw
+// socket (EVT_F_RAW in bpf/egress.c).
+const evtFlagRaw = 0x1
+
+// Values of bpfEvent.Direction, see EVT_DIR_* in bpf/egress.c. For ingress
+// events, the source is the remote peer and the destination the local
+// listening address.
+const (
+	evtDirEgress  = 0
+	evtDirIngress = 1
+)
+
+// Values of bpfTaskEvent.Type, see TASK_EVENT_* in bpf/egress.c.
+const (
+	taskEventExec = 1
+	taskEventExit = 2
+)
+
 // Input captures egress connections using eBPF kprobes.
 type Input struct {
 	quiet         bool
 	allowLoopback bool
+	ingress       bool
+	trackProcs    bool
+	trackRetain   time.Duration
+	flowIdle      time.Duration
+	dns           bool
+	dnsIface      string
+	dnsCache      *dnscache.Cache
+	dumpRaw       string
+	replayFile    string
+	order         binary.ByteOrder // of raw events: the host's, or the dump's
 
 	ignoreNets      []*net.IPNet
 	ignorePorts     map[uint16]struct{}
@@ -66,29 +108,60 @@ type Input struct {
 	ignoreGrandparents     map[string]struct{} // exact grandparent name matches
 	ignoreGrandparentGlobs []string            // glob patterns for grandparent name
 
+	ignoreAncestors     map[string]struct{} // exact matches on any ancestor name
+	ignoreAncestorGlobs []string            // glob patterns for any ancestor name
+
+	ignoreCgroups []*regexp.Regexp // compiled glob-to-regex patterns for cgroup paths
+
 	objs  bpfObjects
 	links []link.Link
-
-	dedupMu sync.Mutex
-	dedup   map[string]time.Time
 }
 
-const dedupWindow = time.Second
-
 // Description returns documentation shown by `egress-auditor -l`.
 func (e *Input) Description() string {
 	return `
 	ebpf kprobe hook
 	Captures egress connections by attaching eBPF kprobes to:
-	  tcp_v4_connect, tcp_v6_connect, udp_sendmsg, udpv6_sendmsg.
+	  tcp_v4_connect, tcp_v6_connect, udp_sendmsg, udpv6_sendmsg,
+	  ping_v4_sendmsg, ping_v6_sendmsg (ICMP), raw_sendmsg, rawv6_sendmsg
+	  (raw sockets) and sctp_connect (when the sctp module is loaded).
 
-	Process owner (pid) is read directly from kernel context — no race with
-	/proc, and no iptables/nftables rules are needed. Requires CAP_BPF (or
-	root) and CAP_PERFMON on modern kernels.
+	Protocols reported are tcp, udp, icmp, icmpv6, sctp, and raw for
+	sockets opened with IPPROTO_RAW (raw sockets for other protocols are
+	reported with that protocol, without port).
+
+	Process owner (pid, tid, ppid, uid/gid/euid, cgroup ID, mount and net
+	namespaces, executable inode) is read directly from kernel context — no
+	race with /proc, and no iptables/nftables rules are needed. /proc is only
+	used for what the kernel can't provide (command line, executable path,
+	ancestors). Requires CAP_BPF (or root) and CAP_PERFMON on modern kernels.
 
 	Options:
 		- "ebpf:quiet:<false|true>": suppress per-connection messages on stderr
 		- "ebpf:allow-loopback:<false|true>": include loopback traffic
+		- "ebpf:ingress:<false|true>": also report inbound TCP connections
+		    accepted by local processes (kretprobe on inet_csk_accept),
+		    tagged direction=ingress. ignore-cidr then applies to the remote
+		    peer and ignore-port to the local port
+		- "ebpf:track-procs:<false|true>": maintain a process tree from
+		    sched_process_exec/exit tracepoints (or the netlink proc connector
+		    if they can't be attached), so ancestry of short-lived processes
+		    and recycled pids is resolved correctly
+		- "ebpf:track-retention:<duration>": how long exited processes are
+		    kept in the process tree (default 1m)
+		- "ebpf:udp-idle-timeout:<duration>": idle time after which a UDP,
+		    ICMP or raw socket flow ends (default 30s), see "UDP flows" in
+		    the README
+		- "ebpf:dns:<false|true>": capture DNS answers (UDP/TCP port 53) on an
+		    AF_PACKET socket and annotate connections with the name the
+		    destination IP was resolved from (dest_host)
+		- "ebpf:dns-interface:<name>": only capture DNS on this interface
+		    (default: all interfaces)
+		- "ebpf:dump-raw:<file>": record raw kernel events to file, for bug
+		    reports and tests
+		- "ebpf:replay:<file>": do not load anything in the kernel; replay
+		    events from a file written with dump-raw instead (filters apply
+		    as in live capture; processes are only what the kernel captured)
 		- "ebpf:ignore-cidr:<CIDR>": drop events whose dest IP is in this network
 		    (may be specified multiple times, IPv4 or IPv6)
 		- "ebpf:ignore-port:<port>": drop events with this dest port
@@ -103,6 +176,12 @@ func (e *Input) Description() string {
 		    matches (same syntax as ignore-comm: exact or glob)
 		- "ebpf:ignore-grandparent:<name>": drop events whose grandparent
 		    process name matches (same syntax as ignore-comm: exact or glob)
+		- "ebpf:ignore-ancestor:<name>": drop events when any ancestor of the
+		    process, up to --ancestry-depth, matches (same syntax as
+		    ignore-comm: exact or glob)
+		- "ebpf:ignore-cgroup:<pattern>": drop events from processes whose
+		    cgroup path matches this glob, where * crosses / (e.g.
+		    "/system.slice/chronyd.service", "/kubepods*/*<pod-uid>*")
 
 	Example:
 		sudo egress-auditor -i ebpf -o logfmt \
@@ -129,6 +208,48 @@ func (e *Input) SetOption(k, v string) error {
 			return err
 		}
 		e.allowLoopback = a
+	case "ingress":
+		i, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		e.ingress = i
+	case "track-procs":
+		t, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		e.trackProcs = t
+	case "track-retention":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("track-retention must be positive")
+		}
+		e.trackRetain = d
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		e.flowIdle = d
+	case "dns":
+		d, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		e.dns = d
+	case "dns-interface":
+		e.dnsIface = v
+	case "dump-raw":
+		e.dumpRaw = v
+	case "replay":
+		e.replayFile = v
 	case "ignore-cidr":
 		_, n, err := net.ParseCIDR(v)
 		if err != nil {
@@ -203,6 +324,30 @@ func (e *Input) SetOption(k, v string) error {
 			}
 			e.ignoreGrandparents[v] = struct{}{}
 		}
+	case "ignore-cgroup":
+		if v == "" {
+			return fmt.Errorf("ignore-cgroup requires a non-empty value")
+		}
+		re, err := regexp.Compile("^" + globToRegex(v) + "$")
+		if err != nil {
+			return fmt.Errorf("invalid ignore-cgroup pattern %q: %w", v, err)
+		}
+		e.ignoreCgroups = append(e.ignoreCgroups, re)
+	case "ignore-ancestor":
+		if v == "" {
+			return fmt.Errorf("ignore-ancestor requires a non-empty value")
+		}
+		if strings.ContainsAny(v, "*?[") {
+			if _, err := path.Match(v, ""); err != nil {
+				return fmt.Errorf("invalid ignore-ancestor pattern %q: %w", v, err)
+			}
+			e.ignoreAncestorGlobs = append(e.ignoreAncestorGlobs, v)
+		} else {
+			if e.ignoreAncestors == nil {
+				e.ignoreAncestors = make(map[string]struct{})
+			}
+			e.ignoreAncestors[v] = struct{}{}
+		}
 	default:
 		return fmt.Errorf("option %q unknown for ebpf input", k)
 	}
@@ -253,41 +398,53 @@ func (e *Input) isNetFiltered(destIP net.IP, dport uint16) bool {
 }
 
 // isProcFiltered returns true if the resolved process name or command line
-// matches an ignore-comm or ignore-cmdline rule. We match against proc.Name
-// and proc.CmdLine (from /proc) rather than the eBPF-captured thread comm,
-// because multi-threaded daemons set per-thread names via prctl(PR_SET_NAME).
-func (e *Input) isProcFiltered(procName, cmdLine, parentName, grandparentName string) bool {
-	if _, skip := e.ignoreComms[procName]; skip {
+// matches an ignore-comm or ignore-cmdline rule, its cgroup an ignore-cgroup
+// rule, or one of its ancestors an ignore-parent, ignore-grandparent or
+// ignore-ancestor rule. We match
+// against proc.Name and proc.CmdLine (from /proc) rather than the
+// eBPF-captured thread comm, because multi-threaded daemons set per-thread
+// names via prctl(PR_SET_NAME).
+func (e *Input) isProcFiltered(proc *procdetail.ProcessDetail) bool {
+	if nameMatches(proc.Name, e.ignoreComms, e.ignoreCommGlobs) {
 		return true
 	}
-	for _, pat := range e.ignoreCommGlobs {
-		if ok, _ := path.Match(pat, procName); ok {
-			return true
-		}
-	}
 	for _, sub := range e.ignoreCmdlines {
-		if strings.Contains(cmdLine, sub) {
+		if strings.Contains(proc.CmdLine, sub) {
 			return true
 		}
 	}
 	for _, re := range e.ignoreCmdlineGlobs {
-		if re.MatchString(cmdLine) {
+		if re.MatchString(proc.CmdLine) {
 			return true
 		}
 	}
-	if _, skip := e.ignoreParents[parentName]; skip {
-		return true
+	if proc.Cgroup != nil {
+		for _, re := range e.ignoreCgroups {
+			if re.MatchString(proc.Cgroup.Path) {
+				return true
+			}
+		}
 	}
-	for _, pat := range e.ignoreParentGlobs {
-		if ok, _ := path.Match(pat, parentName); ok {
+	for i, a := range proc.Ancestry() {
+		switch {
+		case i == 0 && nameMatches(a.Name, e.ignoreParents, e.ignoreParentGlobs):
+			return true
+		case i == 1 && nameMatches(a.Name, e.ignoreGrandparents, e.ignoreGrandparentGlobs):
+			return true
+		case nameMatches(a.Name, e.ignoreAncestors, e.ignoreAncestorGlobs):
 			return true
 		}
 	}
-	if _, skip := e.ignoreGrandparents[grandparentName]; skip {
+	return false
+}
+
+// nameMatches returns true if name is in exact or matches one of globs.
+func nameMatches(name string, exact map[string]struct{}, globs []string) bool {
+	if _, ok := exact[name]; ok {
 		return true
 	}
-	for _, pat := range e.ignoreGrandparentGlobs {
-		if ok, _ := path.Match(pat, grandparentName); ok {
+	for _, pat := range globs {
+		if ok, _ := path.Match(pat, name); ok {
 			return true
 		}
 	}
@@ -297,28 +454,61 @@ func (e *Input) isProcFiltered(procName, cmdLine, parentName, grandparentName st
 // Process loads the eBPF objects, attaches the kprobes, and forwards
 // events on c until ctx is cancelled.
 func (e *Input) Process(ctx context.Context, c chan<- entry.Connection) {
+	if e.replayFile != "" {
+		e.replay(ctx, c)
+		return
+	}
+	e.order = binary.NativeEndian
+
 	if err := rlimit.RemoveMemlock(); err != nil {
 		fmt.Fprintf(os.Stderr, "[ebpf] failed to remove memlock: %v\n", err)
 		return
 	}
 
-	if err := loadBpfObjects(&e.objs, nil); err != nil {
+	spec, err := loadBpf()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ebpf] failed to load eBPF spec: %v\n", err)
+		return
+	}
+	idle := e.flowIdle
+	if idle == 0 {
+		idle = flows.DefaultIdleTimeout
+	}
+	v, ok := spec.Variables["flow_idle_ns"]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ebpf] flow_idle_ns not found in eBPF object, regenerate it with go generate\n")
+		return
+	}
+	if err := v.Set(uint64(idle.Nanoseconds())); err != nil {
+		fmt.Fprintf(os.Stderr, "[ebpf] failed to set flow idle timeout: %v\n", err)
+		return
+	}
+	if err := spec.LoadAndAssign(&e.objs, nil); err != nil {
 		fmt.Fprintf(os.Stderr, "[ebpf] failed to load eBPF objects: %v\n", err)
 		return
 	}
 
 	type probeSpec struct {
-		symbol string
-		prog   *ebpf.Program
-		ret    bool
+		symbol   string
+		prog     *ebpf.Program
+		ret      bool
+		optional bool // symbol lives in a module that may not be loaded
 	}
 	probes := []probeSpec{
-		{"tcp_v4_connect", e.objs.KprobeTcpV4Connect, false},
-		{"tcp_v4_connect", e.objs.KretprobeTcpV4Connect, true},
-		{"tcp_v6_connect", e.objs.KprobeTcpV6Connect, false},
-		{"tcp_v6_connect", e.objs.KretprobeTcpV6Connect, true},
-		{"udp_sendmsg", e.objs.KprobeUdpSendmsg, false},
-		{"udpv6_sendmsg", e.objs.KprobeUdpv6Sendmsg, false},
+		{"tcp_v4_connect", e.objs.KprobeTcpV4Connect, false, false},
+		{"tcp_v4_connect", e.objs.KretprobeTcpV4Connect, true, false},
+		{"tcp_v6_connect", e.objs.KprobeTcpV6Connect, false, false},
+		{"tcp_v6_connect", e.objs.KretprobeTcpV6Connect, true, false},
+		{"udp_sendmsg", e.objs.KprobeUdpSendmsg, false, false},
+		{"udpv6_sendmsg", e.objs.KprobeUdpv6Sendmsg, false, false},
+		{"ping_v4_sendmsg", e.objs.KprobePingV4Sendmsg, false, false},
+		{"ping_v6_sendmsg", e.objs.KprobePingV6Sendmsg, false, true},
+		{"raw_sendmsg", e.objs.KprobeRawSendmsg, false, false},
+		{"rawv6_sendmsg", e.objs.KprobeRawv6Sendmsg, false, true},
+		{"sctp_connect", e.objs.KprobeSctpConnect, false, true},
+	}
+	if e.ingress {
+		probes = append(probes, probeSpec{"inet_csk_accept", e.objs.KretprobeInetCskAccept, true, false})
 	}
 	for _, p := range probes {
 		var (
@@ -330,6 +520,10 @@ func (e *Input) Process(ctx context.Context, c chan<- entry.Connection) {
 		} else {
 			l, err = link.Kprobe(p.symbol, p.prog, nil)
 		}
+		if err != nil && p.optional {
+			fmt.Fprintf(os.Stderr, "[ebpf] not attaching %s: %v\n", p.symbol, err)
+			continue
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "[ebpf] failed to attach %s (ret=%v): %v\n", p.symbol, p.ret, err)
 			return
@@ -337,114 +531,265 @@ func (e *Input) Process(ctx context.Context, c chan<- entry.Connection) {
 		e.links = append(e.links, l)
 	}
 
-	rd, err := perf.NewReader(e.objs.Events, os.Getpagesize()*64)
+	if e.trackProcs {
+		if err := e.startTracker(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "[ebpf] process tracking disabled: %v\n", err)
+		}
+	}
+
+	if e.dns {
+		e.dnsCache = dnscache.New()
+		go func() {
+			if err := e.dnsCache.Sniff(ctx, e.dnsIface); err != nil {
+				fmt.Fprintf(os.Stderr, "[ebpf] DNS capture stopped: %v\n", err)
+			}
+		}()
+	}
+
+	var rd recordReader
+	rd, err = perf.NewReader(e.objs.Events, os.Getpagesize()*64)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[ebpf] failed to create perf reader: %v\n", err)
 		return
 	}
+	if e.dumpRaw != "" {
+		tee, err := newTeeReader(rd, e.dumpRaw)
+		if err != nil {
+			rd.Close()
+			fmt.Fprintf(os.Stderr, "[ebpf] failed to create raw dump: %v\n", err)
+			return
+		}
+		rd = tee
+	}
+
+	e.readEvents(ctx, rd, c)
+}
+
+// replay feeds the events recorded in a raw dump to the usual event
+// handling, without loading anything in the kernel.
+func (e *Input) replay(ctx context.Context, c chan<- entry.Connection) {
+	rd, err := openDump(e.replayFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ebpf] failed to open raw dump: %v\n", err)
+		return
+	}
+	e.order = rd.order
+	e.readEvents(ctx, rd, c)
+	fmt.Fprintf(os.Stderr, "[ebpf] replay of %s done\n", e.replayFile)
+}
 
+// readEvents reads raw records from rd until it is exhausted or ctx is
+// cancelled, and sends the resulting connections to c.
+func (e *Input) readEvents(ctx context.Context, rd recordReader, c chan<- entry.Connection) {
+	done := make(chan struct{})
+	defer close(done)
 	// Closing the reader unblocks rd.Read() so the loop below exits cleanly.
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
 		rd.Close()
 	}()
 
-	e.dedup = make(map[string]time.Time)
-
-	var evt bpfEvent
 	for {
 		record, err := rd.Read()
 		if err != nil {
-			if errors.Is(err, perf.ErrClosed) {
+			if errors.Is(err, perf.ErrClosed) || errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "[ebpf] read error: %v\n", err)
+			if _, ok := rd.(*dumpFile); ok {
 				return
 			}
-			fmt.Fprintf(os.Stderr, "[ebpf] perf read error: %v\n", err)
 			continue
 		}
 		if record.LostSamples != 0 {
 			fmt.Fprintf(os.Stderr, "[ebpf] lost %d samples\n", record.LostSamples)
 			continue
 		}
-		if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &evt); err != nil {
-			fmt.Fprintf(os.Stderr, "[ebpf] failed to decode event: %v\n", err)
-			continue
-		}
-
-		destIP := destToIP(&evt)
-		if destIP == nil {
-			continue
-		}
-		if destIP.IsLoopback() && !e.allowLoopback {
+		conn, ok := e.handle(record.RawSample)
+		if !ok {
 			continue
 		}
-		if e.isNetFiltered(destIP, evt.Dport) {
-			continue
+		select {
+		case c <- conn:
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		// UDP can fire many times per "flow"; dedup on (pid, daddr, dport).
-		if evt.Protocol == 17 {
-			key := fmt.Sprintf("%d|%s|%d", evt.Pid, destIP.String(), evt.Dport)
-			if e.shouldSkipDup(key) {
-				continue
-			}
-		}
+// handle decodes a raw `struct event` sample, applies filters and resolves
+// the process. It returns false when the event must not be reported.
+func (e *Input) handle(raw []byte) (entry.Connection, bool) {
+	var evt bpfEvent
+	if err := binary.Read(bytes.NewReader(raw), e.order, &evt); err != nil {
+		fmt.Fprintf(os.Stderr, "[ebpf] failed to decode event: %v\n", err)
+		return entry.Connection{}, false
+	}
 
-		proto := "tcp"
-		if evt.Protocol == 17 {
-			proto = "udp"
-		}
+	srcIP := srcToIP(&evt)
+	destIP := destToIP(&evt)
+	if destIP == nil {
+		return entry.Connection{}, false
+	}
+	if destIP.IsLoopback() && !e.allowLoopback {
+		return entry.Connection{}, false
+	}
+	// ignore-cidr is about the remote end, ignore-port about the service.
+	ingress := evt.Direction == evtDirIngress
+	peer := destIP
+	if ingress {
+		peer = srcIP
+	}
+	if e.isNetFiltered(peer, evt.Dport) {
+		return entry.Connection{}, false
+	}
 
-		proc, err := procdetail.New(int32(evt.Pid))
-		if err != nil || proc == nil {
-			proc = fallbackProc(int32(evt.Pid), evt.Comm[:])
-		}
+	// Connectionless sends are already reduced to one event per flow in
+	// the kernel (see flow_is_new in bpf/egress.c).
+	proto := protoName(&evt)
+
+	// Errors are not fatal: Complete leaves "unknown" in whatever it could
+	// not resolve, and the kernel-side fields are still valid. Replayed
+	// events may come from another host, whose pids are not ours.
+	proc := procFromEvent(&evt)
+	if e.replayFile != "" {
+		proc.CompleteOffline()
+	} else {
+		proc.Complete()
+	}
 
-		parentName := ""
-		grandparentName := ""
-		if proc.Parent != nil {
-			parentName = proc.Parent.Name
-			if proc.Parent.Parent != nil {
-				grandparentName = proc.Parent.Parent.Name
-			}
-		}
-		if e.isProcFiltered(proc.Name, proc.CmdLine, parentName, grandparentName) {
-			continue
-		}
+	if e.isProcFiltered(proc) {
+		return entry.Connection{}, false
+	}
 
-		if !e.quiet {
+	direction := entry.Egress
+	if ingress {
+		direction = entry.Ingress
+	}
+
+	if !e.quiet {
+		kind := proto
+		if evt.Flags&evtFlagRaw != 0 && proto != "raw" {
+			kind = "raw " + proto
+		}
+		if ingress {
+			fmt.Fprintf(os.Stderr, "new ingress %s connection %s:%d -> %s:%d accepted by %s\n",
+				kind, srcIP, evt.Sport, destIP, evt.Dport, proc.Name)
+		} else {
 			fmt.Fprintf(os.Stderr, "new %s connection -> %s:%d by %s\n",
-				proto, destIP, evt.Dport, proc.Name)
+				kind, destIP, evt.Dport, proc.Name)
 		}
+	}
 
-		c <- entry.Connection{
-			Hook:     "ebpf",
-			Protocol: proto,
-			DestIP:   destIP.String(),
-			DestPort: evt.Dport,
-			Proc:     proc,
-			IPv:      evt.IPVersion,
-		}
+	var host string
+	if e.dnsCache != nil && !ingress {
+		host = e.dnsCache.Lookup(srcIP.String(), destIP.String(), time.Now())
 	}
+
+	return entry.Connection{
+		Hook:      "ebpf",
+		Direction: direction,
+		Protocol:  proto,
+		SrcIP:     srcIP.String(),
+		SrcPort:   evt.Sport,
+		DestIP:    destIP.String(),
+		DestHost:  host,
+		DestPort:  evt.Dport,
+		Proc:      proc,
+		IPv:       evt.IPVersion,
+	}, true
 }
 
-func (e *Input) shouldSkipDup(key string) bool {
-	now := time.Now()
-	e.dedupMu.Lock()
-	defer e.dedupMu.Unlock()
-	if last, ok := e.dedup[key]; ok && now.Sub(last) < dedupWindow {
-		e.dedup[key] = now
-		return true
+// startTracker seeds a process tracker from /proc and keeps it up to date
+// from the exec/exit tracepoints, falling back to the proc connector when
+// they can't be attached.
+func (e *Input) startTracker(ctx context.Context) error {
+	retain := e.trackRetain
+	if retain == 0 {
+		retain = time.Minute
+	}
+	t := procdetail.NewTracker(retain)
+	if err := t.Scan(); err != nil {
+		return err
+	}
+
+	var tps []link.Link
+	for _, tp := range []struct {
+		name string
+		prog *ebpf.Program
+	}{
+		{"sched_process_exec", e.objs.TracepointSchedProcessExec},
+		{"sched_process_exit", e.objs.TracepointSchedProcessExit},
+	} {
+		l, err := link.Tracepoint("sched", tp.name, tp.prog, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ebpf] failed to attach tracepoint %s, using proc connector: %v\n", tp.name, err)
+			for _, l := range tps {
+				l.Close()
+			}
+			tps = nil
+			break
+		}
+		tps = append(tps, l)
+	}
+
+	if tps == nil {
+		go func() {
+			if err := t.ListenConnector(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "[ebpf] proc connector error: %v\n", err)
+			}
+		}()
+	} else {
+		rd, err := perf.NewReader(e.objs.ProcEvents, os.Getpagesize()*64)
+		if err != nil {
+			for _, l := range tps {
+				l.Close()
+			}
+			return fmt.Errorf("failed to create perf reader: %w", err)
+		}
+		e.links = append(e.links, tps...)
+		go func() {
+			<-ctx.Done()
+			rd.Close()
+		}()
+		go readProcEvents(rd, t)
 	}
-	e.dedup[key] = now
-	// Opportunistic GC.
-	if len(e.dedup) > 1024 {
-		for k, t := range e.dedup {
-			if now.Sub(t) > dedupWindow {
-				delete(e.dedup, k)
+
+	go t.Run(ctx)
+	procdetail.UseTracker(t)
+	return nil
+}
+
+// readProcEvents feeds t from the proc_events perf buffer until rd is
+// closed.
+func readProcEvents(rd *perf.Reader, t *procdetail.Tracker) {
+	var pe bpfTaskEvent
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return
 			}
+			continue
+		}
+		if record.LostSamples != 0 {
+			fmt.Fprintf(os.Stderr, "[ebpf] lost %d process events\n", record.LostSamples)
+			continue
+		}
+		if err := binary.Read(bytes.NewReader(record.RawSample), binary.NativeEndian, &pe); err != nil {
+			continue
+		}
+		switch pe.Type {
+		case taskEventExec:
+			t.Exec(int32(pe.Pid), int32(pe.Ppid), procdetail.StartTicks(pe.StartNs), pe.Uid,
+				nullTerm(pe.Comm[:]), nullTerm(pe.Filename[:]))
+		case taskEventExit:
+			t.Exit(int32(pe.Pid), procdetail.StartTicks(pe.StartNs))
 		}
 	}
-	return false
 }
 
 // Cleanup detaches probes and releases the eBPF objects.
@@ -455,6 +800,46 @@ func (e *Input) Cleanup() {
 	e.objs.Close()
 }
 
+// IP protocol numbers found in bpfEvent.Protocol.
+const (
+	ipprotoICMP   = 1
+	ipprotoTCP    = 6
+	ipprotoUDP    = 17
+	ipprotoICMPv6 = 58
+	ipprotoSCTP   = 132
+	ipprotoRaw    = 255
+)
+
+// protoName returns the entry.Connection protocol for evt.
+func protoName(evt *bpfEvent) string {
+	switch evt.Protocol {
+	case ipprotoICMP:
+		return "icmp"
+	case ipprotoTCP:
+		return "tcp"
+	case ipprotoUDP:
+		return "udp"
+	case ipprotoICMPv6:
+		return "icmpv6"
+	case ipprotoSCTP:
+		return "sctp"
+	case ipprotoRaw:
+		return "raw"
+	}
+	return strconv.Itoa(int(evt.Protocol))
+}
+
+func srcToIP(evt *bpfEvent) net.IP {
+	if evt.IPVersion == 6 {
+		ip := make(net.IP, 16)
+		copy(ip, evt.Saddr6[:])
+		return ip
+	}
+	ip := make(net.IP, 4)
+	copy(ip, evt.Saddr[:])
+	return ip
+}
+
 func destToIP(evt *bpfEvent) net.IP {
 	if evt.IPVersion == 6 {
 		ip := make(net.IP, 16)
@@ -466,36 +851,34 @@ func destToIP(evt *bpfEvent) net.IP {
 	return ip
 }
 
-func fallbackProc(pid int32, comm []byte) *procdetail.ProcessDetail {
-	name := nullTerm(comm)
-	if name == "" {
-		name = "unknown"
-	}
+// procFromEvent returns the process details captured in kernel context.
+// The result still has to be completed from /proc.
+func procFromEvent(evt *bpfEvent) *procdetail.ProcessDetail {
 	return &procdetail.ProcessDetail{
-		Pid:     pid,
-		Name:    name,
-		CmdLine: name,
-		User:    "unknown",
-		Parent: &procdetail.ProcessDetail{
-			Name:    "unknown",
-			CmdLine: "unknown",
-			User:    "unknown",
-			Parent: &procdetail.ProcessDetail{
-				Name:    "unknown",
-				CmdLine: "unknown",
-				User:    "unknown",
-			},
-		},
+		Pid:      int32(evt.Pid),
+		Tid:      int32(evt.Tid),
+		Name:     nullTerm(evt.Comm[:]),
+		UID:      evt.UID,
+		GID:      evt.GID,
+		EUID:     evt.EUID,
+		Start:    procdetail.StartTicks(evt.StartNs),
+		ExeInode: evt.ExeIno,
+		CgroupID: evt.CgroupID,
+		MntNS:    evt.MntNS,
+		NetNS:    evt.NetNS,
+		Parent:   &procdetail.ProcessDetail{Pid: int32(evt.Ppid)},
 	}
 }
 
-func nullTerm(b []byte) string {
-	for i, c := range b {
+func nullTerm[T ~byte | ~int8](b []T) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
 		if c == 0 {
-			return string(b[:i])
+			break
 		}
+		s = append(s, byte(c))
 	}
-	return string(b)
+	return string(s)
 }
 
 func init() {
@@ -0,0 +1,188 @@
+package ebpf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf/btf"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// TestEventLayout checks that bpfEvent matches `struct event` in the
+// embedded object, field by field.
+func TestEventLayout(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s *btf.Struct
+	if err := spec.Types.TypeByName("event", &s); err != nil {
+		t.Fatal(err)
+	}
+
+	typ := reflect.TypeFor[bpfEvent]()
+	if int(s.Size) != int(typ.Size()) {
+		t.Errorf("struct event is %d bytes, bpfEvent %d", s.Size, typ.Size())
+	}
+	if len(s.Members) != typ.NumField() {
+		t.Fatalf("struct event has %d members, bpfEvent %d fields", len(s.Members), typ.NumField())
+	}
+	for i, m := range s.Members {
+		f := typ.Field(i)
+		if off := m.Offset.Bytes(); off != uint32(f.Offset) {
+			t.Errorf("%s is at offset %d, bpfEvent.%s at %d", m.Name, off, f.Name, f.Offset)
+		}
+		size, err := btf.Sizeof(m.Type)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int(f.Type.Size()) {
+			t.Errorf("%s is %d bytes, bpfEvent.%s %d", m.Name, size, f.Name, f.Type.Size())
+		}
+	}
+}
+
+// replay returns the connections handle() emits for the dump name, with
+// options opts.
+func replay(t *testing.T, name string, opts map[string]string) []entry.Connection {
+	t.Helper()
+	e := &Input{}
+	for k, v := range opts {
+		if err := e.SetOption(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.SetOption("replay", name); err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan entry.Connection, 16)
+	e.Process(context.Background(), c)
+	close(c)
+	var ents []entry.Connection
+	for ent := range c {
+		ents = append(ents, ent)
+	}
+	return ents
+}
+
+// bigEndian writes testdata/replay.dump as recorded by a big-endian host,
+// and returns its name.
+func bigEndian(t *testing.T) string {
+	rd, err := openDump("testdata/replay.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	var buf bytes.Buffer
+	buf.WriteString(dumpMagic + "B")
+	for {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sample := rec.RawSample
+		if len(sample) > 0 {
+			var evt bpfEvent
+			if err := binary.Read(bytes.NewReader(sample), rd.order, &evt); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			binary.Write(&out, binary.BigEndian, &evt)
+			sample = out.Bytes()
+		}
+		binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(rec.LostSamples), uint32(len(sample))})
+		buf.Write(sample)
+	}
+	name := filepath.Join(t.TempDir(), "replay-be.dump")
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// TestReplay feeds testdata/replay.dump to handle() through the replay
+// option, as recorded and as a big-endian host would have recorded it.
+// The dump holds, in order: a TCP connect by curl, a lost-samples record,
+// a UDP send over IPv6, a loopback connect, a connect to an ignored
+// network, an accepted SSH connection and an ICMP echo.
+func TestReplay(t *testing.T) {
+	type conn struct {
+		direction, protocol string
+		src                 string
+		sport               uint16
+		dest                string
+		dport               uint16
+		ipv                 uint8
+		pid                 int32
+		name                string
+		uid                 uint32
+	}
+	want := []conn{
+		{entry.Egress, "tcp", "192.0.2.10", 40000, "198.51.100.7", 443, 4, 4194401, "curl", 1000},
+		{entry.Egress, "udp", "2001:db8::10", 50000, "2001:db8::53", 53, 6, 4194403, "resolved", 0},
+		{entry.Ingress, "tcp", "203.0.113.50", 51000, "192.0.2.10", 22, 4, 4194406, "sshd", 0},
+		{entry.Egress, "icmp", "192.0.2.10", 0, "198.51.100.8", 0, 4, 4194407, "ping", 0},
+	}
+	for _, tc := range []struct {
+		name string
+		dump string
+	}{
+		{"recorded", "testdata/replay.dump"},
+		{"big-endian", bigEndian(t)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []conn
+			for _, ent := range replay(t, tc.dump, map[string]string{"quiet": "true", "ignore-cidr": "203.0.113.9/32"}) {
+				if ent.Hook != "ebpf" {
+					t.Errorf("hook is %q, want ebpf", ent.Hook)
+				}
+				got = append(got, conn{ent.Direction, ent.Protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort,
+					ent.IPv, ent.Proc.Pid, ent.Proc.Name, ent.Proc.UID})
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("replay emitted\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+// TestReplayLocalPid checks that replayed processes are not looked up on
+// the local host, by replaying the curl connect of testdata/replay.dump
+// with the pid of the test.
+func TestReplayLocalPid(t *testing.T) {
+	dump, err := os.ReadFile("testdata/replay.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first sample follows the dump header and its record header.
+	sample := dump[len(dumpMagic)+1+8:]
+	binary.LittleEndian.PutUint32(sample[unsafe.Offsetof(bpfEvent{}.Pid):], uint32(os.Getpid()))
+	name := filepath.Join(t.TempDir(), "replay.dump")
+	if err := os.WriteFile(name, dump, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ents := replay(t, name, map[string]string{"quiet": "true"})
+	if len(ents) == 0 {
+		t.Fatal("nothing replayed")
+	}
+	p := ents[0].Proc
+	if p.Pid != int32(os.Getpid()) || p.Name != "curl" || p.CmdLine != "curl" || p.Exe != "" {
+		t.Errorf("got process %d %q (%q, exe %q), want the recorded curl", p.Pid, p.Name, p.CmdLine, p.Exe)
+	}
+	if p.User != "1000" || p.Parent == nil || p.Parent.Name != "unknown" {
+		t.Errorf("got user %q and parent %+v, want uid 1000 and an unknown parent", p.User, p.Parent)
+	}
+}
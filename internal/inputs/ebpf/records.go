@@ -0,0 +1,161 @@
+package ebpf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cilium/ebpf/perf"
+)
+
+// recordReader is what the event loop reads raw `struct event` samples
+// from. *perf.Reader implements it for live capture, dumpFile for replays.
+type recordReader interface {
+	Read() (perf.Record, error)
+	Close() error
+}
+
+// Raw dumps start with dumpMagic and the byte order of the samples, that
+// of the host that recorded them ('L' or 'B'), followed by one entry per
+// perf record: lost samples (uint32), sample length (uint32), then the
+// sample as sent by the kernel. Record headers are little-endian.
+const dumpMagic = "EAEBPF02"
+
+// hostOrder is 'L' or 'B', the byte order of this host in dumps.
+var hostOrder = func() byte {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		return 'L'
+	}
+	return 'B'
+}()
+
+// maxDumpSample bounds sample lengths read from dumps, so a corrupted file
+// does not turn into a huge allocation.
+const maxDumpSample = 1 << 16
+
+// dumpFile replays records from a raw dump.
+type dumpFile struct {
+	f     *os.File
+	r     *bufio.Reader
+	order binary.ByteOrder // of the samples
+}
+
+// openDump opens a raw dump written with the dump-raw option.
+func openDump(name string) (*dumpFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &dumpFile{f: f, r: bufio.NewReader(f)}
+	hdr := make([]byte, len(dumpMagic)+1)
+	if _, err := io.ReadFull(d.r, hdr); err != nil || string(hdr[:len(dumpMagic)]) != dumpMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not an ebpf raw dump", name)
+	}
+	switch hdr[len(dumpMagic)] {
+	case 'L':
+		d.order = binary.LittleEndian
+	case 'B':
+		d.order = binary.BigEndian
+	default:
+		f.Close()
+		return nil, fmt.Errorf("%s: unknown byte order %q", name, hdr[len(dumpMagic)])
+	}
+	return d, nil
+}
+
+// Read returns the next record, or io.EOF at the end of the dump.
+func (d *dumpFile) Read() (perf.Record, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return perf.Record{}, fmt.Errorf("truncated dump")
+		}
+		return perf.Record{}, err
+	}
+	rec := perf.Record{LostSamples: uint64(binary.LittleEndian.Uint32(hdr[0:4]))}
+	n := binary.LittleEndian.Uint32(hdr[4:8])
+	if n > maxDumpSample {
+		return perf.Record{}, fmt.Errorf("invalid sample length %d in dump", n)
+	}
+	if n > 0 {
+		rec.RawSample = make([]byte, n)
+		if _, err := io.ReadFull(d.r, rec.RawSample); err != nil {
+			return perf.Record{}, fmt.Errorf("truncated dump")
+		}
+	}
+	return rec, nil
+}
+
+// Close closes the dump.
+func (d *dumpFile) Close() error {
+	return d.f.Close()
+}
+
+// teeReader copies every record read from its source to a raw dump.
+type teeReader struct {
+	recordReader
+	mu sync.Mutex // Close is called concurrently with Read
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// newTeeReader creates (or truncates) name and returns a reader dumping
+// every record read from src into it.
+func newTeeReader(src recordReader, name string) (*teeReader, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	t := &teeReader{recordReader: src, f: f, w: bufio.NewWriter(f)}
+	if _, err := t.w.WriteString(dumpMagic + string(hostOrder)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Read reads a record from the source and appends it to the dump. Write
+// errors are reported but do not interrupt the capture.
+func (t *teeReader) Read() (perf.Record, error) {
+	rec, err := t.recordReader.Read()
+	if err != nil {
+		return rec, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w == nil {
+		return rec, nil
+	}
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(rec.LostSamples))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(rec.RawSample)))
+	t.w.Write(hdr[:])
+	t.w.Write(rec.RawSample)
+	// Flush each record so the dump is usable even if the process is
+	// killed.
+	if err := t.w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "[ebpf] failed to write raw dump: %v\n", err)
+	}
+	return rec, nil
+}
+
+// Close closes the source and the dump.
+func (t *teeReader) Close() error {
+	err := t.recordReader.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w == nil {
+		return err
+	}
+	t.w.Flush()
+	t.w = nil
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package inputs
 
 import (
 	"context"
+	"sync"
 
 	"github.com/devops-works/egress-auditor/internal/entry"
 )
@@ -9,11 +10,51 @@ import (
 // Input interface must be implemented by plugins that capture egress connections
 type Input interface {
 	Description() string
+	// Process sends captured connections to the channel until the context
+	// is cancelled. Inputs reading a finite source (files, replays) return
+	// once it is exhausted; the program exits when every input returned.
+	// Nothing may be sent once Process returned: the channel is closed
+	// then, so goroutines sending to it must be joined first (see Sender).
 	Process(context.Context, chan<- entry.Connection)
 	Cleanup()
 	SetOption(string, string) error
 }
 
+// Sender sends connections from callbacks run on goroutines the input does
+// not own, such as the receive goroutines of netlink libraries, which may
+// still run after their Close returned. Process must Close the sender
+// before returning, since the channel is closed once every input returned.
+type Sender struct {
+	mu     sync.RWMutex // held for reading by sends in progress
+	c      chan<- entry.Connection
+	closed bool
+}
+
+// NewSender returns a Sender sending to c.
+func NewSender(c chan<- entry.Connection) *Sender {
+	return &Sender{c: c}
+}
+
+// Send sends ent, unless ctx is cancelled first or s is closed.
+func (s *Sender) Send(ctx context.Context, ent entry.Connection) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- ent:
+	case <-ctx.Done():
+	}
+}
+
+// Close waits for sends in progress; later ones are dropped.
+func (s *Sender) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
 // Inputs has a list of available inputs
 var Inputs = map[string]Input{}
 
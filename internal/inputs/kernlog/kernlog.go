@@ -0,0 +1,275 @@
+// Package kernlog implements an input reading packets logged by the
+// iptables LOG target (or nft "log" statements) from kernel log files or
+// journal exports.
+package kernlog
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/flows"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/tail"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+)
+
+// liveDelay is how old a followed log line can be for its socket to be
+// looked up in /proc.
+const liveDelay = 5 * time.Second
+
+// KernLog reads connections from kernel firewall logs
+type KernLog struct {
+	files         []string
+	follow        bool
+	prefix        string
+	allowLoopback bool
+	quiet         bool
+	flowIdle      time.Duration
+	flows         *flows.Table
+}
+
+// Description returns a description for the module, including the available
+// options
+func (k *KernLog) Description() string {
+	return `
+	kernel firewall log reader
+	Reads packets logged by the iptables LOG target (or nft "log") from
+	kern.log / syslog files, dmesg output, or "journalctl -o json" exports,
+	e.g. for rules like:
+
+		sudo iptables -I OUTPUT -m state --state NEW -j LOG --log-prefix "EGRESS " --log-uid
+
+	Packets logged from OUTPUT are egress, from INPUT ingress; forwarded
+	packets are ignored. Connections are attributed to the user in the UID=
+	field (--log-uid). When following a file, the owner of the socket is
+	looked up first, like with the nflog input.
+
+	Options:
+		- "kernlog:file:<path>": file to read, "-" for stdin; may be
+		    specified multiple times
+		- "kernlog:follow:<false|true>": read lines appended to files
+		    (starting at their end) and follow rotations, like "tail -F"
+		- "kernlog:prefix:<string>": only use lines whose log prefix starts
+		    with string (e.g. "EGRESS")
+		- "kernlog:allow-loopback:<false|true>": include loopback traffic
+		- "kernlog:quiet:<false|true>": suppress per-connection messages on stderr
+		- "kernlog:udp-idle-timeout:<duration>": idle time, in log time, after
+		    which a UDP flow ends (default 30s), see "UDP flows" in the README
+
+	Example:
+		egress-auditor -i kernlog -I kernlog:file:/var/log/kern.log -I kernlog:prefix:EGRESS -o iptables
+		journalctl -k -o json | egress-auditor -i kernlog -I kernlog:file:- -o logfmt
+	`
+}
+
+// Process reads the log files and sends connections found to c
+func (k *KernLog) Process(ctx context.Context, c chan<- entry.Connection) {
+	k.flows = flows.New(k.flowIdle, 0)
+
+	if !k.follow {
+		for _, name := range k.files {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := k.read(ctx, name, c); err != nil {
+				fmt.Fprintf(os.Stderr, "[kernlog] error reading %s: %v\n", name, err)
+			}
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range k.files {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			var err error
+			if name == "-" {
+				err = k.read(ctx, name, c)
+			} else {
+				err = tail.Follow(ctx, name, false, func(line string) { k.line(ctx, line, c) })
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[kernlog] error reading %s: %v\n", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// read reads file name ("-" for stdin) up to its end.
+func (k *KernLog) read(ctx context.Context, name string, c chan<- entry.Connection) error {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	return tail.Lines(ctx, f, func(line string) { k.line(ctx, line, c) })
+}
+
+// line handles a log line, sending the connection it describes, if any,
+// to c.
+func (k *KernLog) line(ctx context.Context, line string, c chan<- entry.Connection) {
+	now := time.Now()
+	r, ok := parseLine(line, now)
+	if !ok || !strings.HasPrefix(r.prefix, k.prefix) {
+		return
+	}
+	ent, ok := k.entry(r, now)
+	if !ok {
+		return
+	}
+	select {
+	case c <- ent:
+	case <-ctx.Done():
+	}
+}
+
+// entry returns the connection started by the packet in r, or false if r
+// does not start a connection or is filtered out.
+func (k *KernLog) entry(r record, now time.Time) (entry.Connection, bool) {
+	var direction string
+	switch {
+	case r.out != "" && r.in == "":
+		direction = entry.Egress
+	case r.in != "" && r.out == "":
+		direction = entry.Ingress
+	default:
+		return entry.Connection{}, false
+	}
+	if r.dst.IsLoopback() && !k.allowLoopback {
+		return entry.Connection{}, false
+	}
+
+	ts := r.time
+	if ts.IsZero() {
+		ts = now
+	}
+	var flow *flows.Flow
+	switch r.protocol {
+	case "tcp":
+		if !r.syn || r.ack {
+			return entry.Connection{}, false
+		}
+	case "udp":
+		f, isNew := k.flows.Seen(flows.HostKey(r.protocol, r.src, r.spt, r.dst, r.dpt), ts)
+		if !isNew {
+			return entry.Connection{}, false
+		}
+		flow = &f
+	}
+
+	ent := entry.Connection{
+		Hook:      "kernlog",
+		Direction: direction,
+		Protocol:  r.protocol,
+		SrcIP:     r.src.String(),
+		SrcPort:   r.spt,
+		DestIP:    r.dst.String(),
+		DestPort:  r.dpt,
+		IPv:       6,
+		Time:      r.time,
+		Flow:      flow,
+	}
+	if r.src.To4() != nil {
+		ent.IPv = 4
+	}
+	ent.Proc = k.owner(r, direction, now.Sub(ts) < liveDelay)
+
+	if !k.quiet {
+		fmt.Fprintf(os.Stderr, "[kernlog] %s %s %s connection %s:%d -> %s:%d by %s (%s)\n",
+			ts.Format(time.RFC3339), direction, ent.Protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort, ent.Proc.Name, ent.Proc.User)
+	}
+	return ent, true
+}
+
+// owner returns the process that sent or received the packet in r. Sockets
+// are only looked up for recent lines of followed files; otherwise only
+// the logged user is known.
+func (k *KernLog) owner(r record, direction string, recent bool) *procdetail.ProcessDetail {
+	if k.follow && recent && (r.protocol == "tcp" || r.protocol == "udp") {
+		var (
+			proc *procdetail.ProcessDetail
+			err  error
+		)
+		// Syslog timestamps may be truncated to the second, which could
+		// predate the process; the line is recent, so use the current time.
+		now := time.Now()
+		if direction == entry.Ingress {
+			proc, err = procdetail.GetOwnerOfListener(r.protocol, r.dst, r.dpt, now)
+		} else {
+			proc, err = procdetail.GetOwnerOfConnection(r.protocol, r.src, r.spt, r.dst, r.dpt, now)
+		}
+		if err != nil && !k.quiet {
+			fmt.Fprintf(os.Stderr, "[kernlog] unable to get process: %v\n", err)
+		}
+		if proc != nil && proc.Pid != 0 {
+			return proc
+		}
+	}
+	if r.uid >= 0 {
+		return procdetail.ForUser(uint32(r.uid))
+	}
+	return procdetail.Unknown()
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (k *KernLog) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (k *KernLog) SetOption(key, v string) error {
+	switch key {
+	case "file":
+		k.files = append(k.files, v)
+	case "follow":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		k.follow = b
+	case "prefix":
+		// Logged prefixes are trimmed, and --log-prefix values usually end
+		// with a space.
+		k.prefix = strings.TrimSpace(v)
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		k.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		k.quiet = b
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		k.flowIdle = d
+	default:
+		return fmt.Errorf("option %q unknown for kernlog input", key)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("kernlog", &KernLog{})
+}
@@ -0,0 +1,34 @@
+package kernlog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+func TestPrefix(t *testing.T) {
+	const line = "Oct 19 10:00:00 host kernel: [ 1234.567890] EGRESS IN= OUT=eth0 SRC=192.0.2.10 DST=203.0.113.80 LEN=60 TOS=0x00 PREC=0x00 TTL=64 ID=1 DF PROTO=TCP SPT=41000 DPT=443 WINDOW=64240 RES=0x00 SYN URGP=0 UID=1000 GID=1000"
+	for _, tc := range []struct {
+		prefix string
+		want   bool
+	}{
+		{"", true},
+		{"EGRESS", true},
+		{"EGRESS ", true},
+		{" EGRESS", true},
+		{"EGR", true},
+		{"INGRESS", false},
+	} {
+		k := &KernLog{quiet: true}
+		if err := k.SetOption("prefix", tc.prefix); err != nil {
+			t.Fatal(err)
+		}
+
+		c := make(chan entry.Connection, 1)
+		k.line(context.Background(), line, c)
+		if got := len(c) == 1; got != tc.want {
+			t.Errorf("prefix %q: got %t, want %t", tc.prefix, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package kernlog
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record is a packet logged by the LOG target (or nft "log"), which both
+// use the nf_log_syslog format:
+//
+//	EGRESS IN= OUT=eth0 SRC=10.0.0.1 DST=1.1.1.1 LEN=60 ... PROTO=TCP SPT=40000 DPT=443 ... SYN URGP=0 UID=1000 GID=1000
+type record struct {
+	time     time.Time // zero if the line has no usable timestamp
+	prefix   string
+	in, out  string
+	src, dst net.IP
+	protocol string
+	spt, dpt uint16
+	uid      int64 // -1 when not logged (--log-uid / "log flags skuid")
+	syn, ack bool
+}
+
+// journalEntry holds the fields we use from "journalctl -o json" lines.
+type journalEntry struct {
+	Message  interface{} `json:"MESSAGE"`
+	Realtime string      `json:"__REALTIME_TIMESTAMP"`
+}
+
+// parseLine parses a syslog line, a kernel ring buffer line or a journal
+// JSON entry. now is used to guess the year of classic syslog timestamps.
+// It returns false if the line is not a packet log.
+func parseLine(line string, now time.Time) (record, bool) {
+	if strings.HasPrefix(line, "{") {
+		var j journalEntry
+		if err := json.Unmarshal([]byte(line), &j); err != nil {
+			return record{}, false
+		}
+		// Non UTF-8 messages are exported as byte arrays; packet logs
+		// never are.
+		msg, ok := j.Message.(string)
+		if !ok {
+			return record{}, false
+		}
+		r, ok := parseMessage(msg)
+		if !ok {
+			return r, false
+		}
+		if us, err := strconv.ParseInt(j.Realtime, 10, 64); err == nil {
+			r.time = time.UnixMicro(us)
+		}
+		return r, true
+	}
+
+	i := strings.Index(line, "IN=")
+	if i < 0 {
+		return record{}, false
+	}
+	head := line[:i]
+	msg := line[i:]
+
+	var ts time.Time
+	if k := strings.Index(head, "kernel: "); k >= 0 {
+		ts = parseSyslogTime(head[:k], now)
+		head = head[k+len("kernel: "):]
+	}
+	// Ring buffer timestamp, as printed by the kernel or dmesg; prefixes
+	// can be bracketed too ("[UFW BLOCK] ").
+	if strings.HasPrefix(head, "[") {
+		if k := strings.IndexByte(head, ']'); k >= 0 && isUptime(head[1:k]) {
+			head = head[k+1:]
+		}
+	}
+
+	r, ok := parseMessage(strings.TrimSpace(head) + " " + msg)
+	r.time = ts
+	return r, ok
+}
+
+// isUptime returns true if s looks like a ring buffer timestamp (seconds
+// since boot, e.g. " 1234.567890").
+func isUptime(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// parseMessage parses a packet log message, starting with the log prefix.
+func parseMessage(msg string) (record, bool) {
+	r := record{uid: -1}
+
+	i := strings.Index(msg, "IN=")
+	if i < 0 {
+		return r, false
+	}
+	r.prefix = strings.TrimSpace(msg[:i])
+
+	for _, f := range strings.Fields(msg[i:]) {
+		k, v, hasValue := strings.Cut(f, "=")
+		if !hasValue {
+			switch k {
+			case "SYN":
+				r.syn = true
+			case "ACK":
+				r.ack = true
+			}
+			continue
+		}
+		switch k {
+		case "IN":
+			r.in = v
+		case "OUT":
+			r.out = v
+		case "SRC":
+			r.src = net.ParseIP(v)
+		case "DST":
+			r.dst = net.ParseIP(v)
+		case "PROTO":
+			r.protocol = strings.ToLower(v)
+		case "SPT":
+			if n, err := strconv.ParseUint(v, 10, 16); err == nil {
+				r.spt = uint16(n)
+			}
+		case "DPT":
+			if n, err := strconv.ParseUint(v, 10, 16); err == nil {
+				r.dpt = uint16(n)
+			}
+		case "UID":
+			if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+				r.uid = int64(n)
+			}
+		}
+	}
+
+	if r.src == nil || r.dst == nil || r.protocol == "" {
+		return r, false
+	}
+	return r, true
+}
+
+// parseSyslogTime parses the timestamp starting a syslog line: RFC 3339
+// (rsyslog high precision format) or the classic "Jan _2 15:04:05", whose
+// year is guessed from now. It returns the zero time if s does not start
+// with a timestamp.
+func parseSyslogTime(s string, now time.Time) time.Time {
+	field, _, _ := strings.Cut(s, " ")
+	if t, err := time.Parse(time.RFC3339Nano, field); err == nil {
+		return t
+	}
+	if len(s) < len(time.Stamp) {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], now.Location())
+	if err != nil {
+		return time.Time{}
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	// Logs from December read in January.
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
@@ -0,0 +1,85 @@
+package kernlog
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	// Classic syslog timestamps have no year: December lines are from
+	// the year before.
+	now := time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		file string // in testdata
+		want []record
+	}{
+		{
+			// A TCP SYN, UDP from last year, a non kernel line, a high
+			// precision timestamp with IPv6, an input packet and a TCP
+			// ACK.
+			file: "kern.log",
+			want: []record{
+				{time: time.Date(2026, 1, 5, 11, 59, 58, 0, time.UTC), prefix: "EGRESS", out: "eth0", src: net.ParseIP("192.0.2.10"), dst: net.ParseIP("203.0.113.80"), protocol: "tcp", spt: 41000, dpt: 443, uid: 1000, syn: true},
+				{time: time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), prefix: "EGRESS", out: "eth0", src: net.ParseIP("192.0.2.10"), dst: net.ParseIP("198.51.100.53"), protocol: "udp", spt: 53001, dpt: 53, uid: 0},
+				{time: time.Date(2026, 1, 5, 11, 59, 59, 123456000, time.UTC), prefix: "EGRESS", out: "eth0", src: net.ParseIP("2001:db8::10"), dst: net.ParseIP("2001:db8::80"), protocol: "tcp", spt: 41001, dpt: 443, uid: 1000, syn: true},
+				{time: time.Date(2026, 1, 5, 11, 59, 59, 0, time.UTC), prefix: "INGRESS", in: "eth0", src: net.ParseIP("203.0.113.7"), dst: net.ParseIP("192.0.2.10"), protocol: "tcp", spt: 50000, dpt: 22, uid: -1, syn: true},
+				{time: time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC), prefix: "EGRESS", out: "eth0", src: net.ParseIP("192.0.2.10"), dst: net.ParseIP("203.0.113.80"), protocol: "tcp", spt: 41000, dpt: 443, uid: 1000, ack: true},
+			},
+		},
+		{
+			// Ring buffer lines have no usable time; prefixes may be
+			// bracketed.
+			file: "dmesg.txt",
+			want: []record{
+				{prefix: "EGRESS", out: "eth0", src: net.ParseIP("192.0.2.10"), dst: net.ParseIP("203.0.113.80"), protocol: "tcp", spt: 41000, dpt: 443, uid: 1000, syn: true},
+				{prefix: "[UFW BLOCK]", in: "eth0", src: net.ParseIP("203.0.113.7"), dst: net.ParseIP("192.0.2.10"), protocol: "tcp", spt: 50001, dpt: 23, uid: -1, syn: true},
+				{prefix: "EGRESS", out: "eth0", src: net.ParseIP("fe80::5054:ff:fe12:3456"), dst: net.ParseIP("ff02::fb"), protocol: "udp", spt: 5353, dpt: 5353, uid: -1},
+			},
+		},
+		{
+			// Byte array messages and broken lines are skipped.
+			file: "journal.json",
+			want: []record{
+				{time: time.UnixMicro(1767614398123456), prefix: "EGRESS", out: "eth0", src: net.ParseIP("192.0.2.10"), dst: net.ParseIP("203.0.113.80"), protocol: "tcp", spt: 41000, dpt: 443, uid: 1000, syn: true},
+				{time: time.UnixMicro(1767614399000000), prefix: "EGRESS", out: "eth0", src: net.ParseIP("2001:db8::10"), dst: net.ParseIP("2001:db8::35"), protocol: "udp", spt: 53002, dpt: 53, uid: 101},
+			},
+		},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var got []record
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				if r, ok := parseLine(s.Text(), now); ok {
+					got = append(got, r)
+				}
+			}
+			if err := s.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d records, want %d: %+v", len(got), len(tc.want), got)
+			}
+			for i := range got {
+				// RFC 3339 timestamps are in a fixed zone.
+				if got[i].time.Equal(tc.want[i].time) {
+					got[i].time = tc.want[i].time
+				}
+				if !reflect.DeepEqual(got[i], tc.want[i]) {
+					t.Errorf("record %d: got %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
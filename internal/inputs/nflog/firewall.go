@@ -0,0 +1,237 @@
+package nflog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// firewall installs and removes the rules sending packets to the nflog
+// group. Both operations are idempotent: install first removes what a
+// previous run (that maybe crashed) left behind.
+type firewall interface {
+	install() error
+	remove() error
+}
+
+// ruleSpec is what the managed rules log.
+type ruleSpec struct {
+	group    int
+	loopback bool         // log loopback traffic too
+	dns      bool         // log DNS answers (INPUT)
+	exclude  []*net.IPNet // destinations not logged
+	forward  bool         // log routed traffic (FORWARD) instead of local
+}
+
+// hooks returns the built-in chains new connections and DNS answers are
+// logged from.
+func (s ruleSpec) hooks() (out, in string) {
+	if s.forward {
+		return "FORWARD", "FORWARD"
+	}
+	return "OUTPUT", "INPUT"
+}
+
+// ruleComment marks every managed rule; it must not contain spaces so that
+// rules can be parsed back from "iptables -S".
+const ruleComment = "egress-auditor"
+
+// comment returns the iptables rule args followed by the ruleComment match.
+func comment(args ...string) []string {
+	return append(args, "-m", "comment", "--comment", ruleComment)
+}
+
+// iptables manages rules in dedicated chains with iptables and ip6tables.
+type iptables struct {
+	spec ruleSpec
+}
+
+func (t *iptables) chains() (out, in string) {
+	g := strconv.Itoa(t.spec.group)
+	return "EGRESS-AUDITOR-" + g, "EGRESS-AUDITOR-IN-" + g
+}
+
+func (t *iptables) install() error {
+	if err := t.remove(); err != nil {
+		return err
+	}
+
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			if bin == "iptables" {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "[nflog] %s not found, not logging IPv6\n", bin)
+			continue
+		}
+		for _, args := range t.commands(bin == "ip6tables") {
+			if err := run(bin, args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commands returns the arguments of the iptables (ip6tables if v6)
+// commands creating the chains and rules.
+func (t *iptables) commands(v6 bool) [][]string {
+	out, in := t.chains()
+	outHook, inHook := t.spec.hooks()
+
+	cmds := [][]string{{"-N", out}}
+	if !t.spec.loopback && !t.spec.forward {
+		cmds = append(cmds, comment("-A", out, "-o", "lo", "-j", "RETURN"))
+	}
+	for _, n := range t.spec.exclude {
+		if (n.IP.To4() == nil) == v6 {
+			cmds = append(cmds, comment("-A", out, "-d", n.String(), "-j", "RETURN"))
+		}
+	}
+	for _, proto := range []string{"tcp", "udp"} {
+		cmds = append(cmds, comment("-A", out, "-m", "state", "--state", "NEW", "-p", proto,
+			"-j", "NFLOG", "--nflog-group", strconv.Itoa(t.spec.group)))
+	}
+	cmds = append(cmds, comment("-I", outHook, "-j", out))
+
+	if t.spec.dns {
+		cmds = append(cmds, []string{"-N", in})
+		for _, proto := range []string{"tcp", "udp"} {
+			cmds = append(cmds, comment("-A", in, "-p", proto, "--sport", "53",
+				"-j", "NFLOG", "--nflog-group", strconv.Itoa(t.spec.group)))
+		}
+		cmds = append(cmds, comment("-I", inHook, "-j", in))
+	}
+	return cmds
+}
+
+func (t *iptables) remove() error {
+	out, in := t.chains()
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			continue
+		}
+		// A previous run may have been in another mode: look for jumps
+		// in all the chains that may have them.
+		for _, builtin := range []string{"OUTPUT", "INPUT", "FORWARD"} {
+			if err := deleteJumps(bin, builtin, out, in); err != nil {
+				return err
+			}
+		}
+		for _, chain := range []string{out, in} {
+			// The chain may not exist.
+			if run(bin, "-F", chain) == nil {
+				if err := run(bin, "-X", chain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deleteJumps deletes the rules of builtin jumping to one of chains.
+func deleteJumps(bin, builtin string, chains ...string) error {
+	listing, err := exec.Command(bin, "-S", builtin).Output()
+	if err != nil {
+		return fmt.Errorf("%s -S %s: %w", bin, builtin, err)
+	}
+	for _, line := range strings.Split(string(listing), "\n") {
+		args := strings.Fields(line)
+		if len(args) < 2 || args[0] != "-A" || args[len(args)-2] != "-j" || !slices.Contains(chains, args[len(args)-1]) {
+			continue
+		}
+		args[0] = "-D"
+		if err := run(bin, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nftables manages rules in a dedicated inet table.
+type nftables struct {
+	spec ruleSpec
+}
+
+func (t *nftables) table() string {
+	return "egress_auditor_" + strconv.Itoa(t.spec.group)
+}
+
+// ruleset returns the nft script creating the table, replacing any
+// previous one atomically.
+func (t *nftables) ruleset() string {
+	var b strings.Builder
+	table := t.table()
+
+	// Declaring the table first makes the delete succeed when it does not
+	// exist yet.
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	// Chains are named after their hook, except the DNS one in forward
+	// mode, which shares the hook of the main one.
+	out, outHook, in, inHook := "output", "output", "input", "input"
+	if t.spec.forward {
+		out, outHook, in, inHook = "forward", "forward", "forward_dns", "forward"
+	}
+	fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook %s priority -10; policy accept;\n", out, outHook)
+	if !t.spec.loopback && !t.spec.forward {
+		fmt.Fprintf(&b, "\t\toifname \"lo\" return comment %q\n", ruleComment)
+	}
+	var v4, v6 []string
+	for _, n := range t.spec.exclude {
+		if n.IP.To4() != nil {
+			v4 = append(v4, n.String())
+		} else {
+			v6 = append(v6, n.String())
+		}
+	}
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "\t\tip daddr { %s } return comment %q\n", strings.Join(v4, ", "), ruleComment)
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "\t\tip6 daddr { %s } return comment %q\n", strings.Join(v6, ", "), ruleComment)
+	}
+	fmt.Fprintf(&b, "\t\tct state new meta l4proto { tcp, udp } log group %d comment %q\n", t.spec.group, ruleComment)
+	b.WriteString("\t}\n")
+	if t.spec.dns {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook %s priority -10; policy accept;\n", in, inHook)
+		fmt.Fprintf(&b, "\t\tmeta l4proto { tcp, udp } th sport 53 log group %d comment %q\n", t.spec.group, ruleComment)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (t *nftables) install() error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(t.ruleset())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft -f: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (t *nftables) remove() error {
+	table := t.table()
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft -f: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// run runs a command, returning its output in the error when it fails.
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
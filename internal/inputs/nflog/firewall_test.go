@@ -0,0 +1,65 @@
+package nflog
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testSpec(t *testing.T) ruleSpec {
+	_, v4, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, v6, err := net.ParseCIDR("fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ruleSpec{group: 100, dns: true, exclude: []*net.IPNet{v4, v6}}
+}
+
+// TestIptablesComments checks that every rule installed carries the
+// ownership comment.
+func TestIptablesComments(t *testing.T) {
+	fw := &iptables{spec: testSpec(t)}
+	for _, v6 := range []bool{false, true} {
+		rules := 0
+		for _, args := range fw.commands(v6) {
+			if args[0] == "-N" {
+				continue
+			}
+			rules++
+			i := slices.Index(args, "--comment")
+			if i < 0 || i+1 == len(args) || args[i+1] != ruleComment {
+				t.Errorf("rule %q has no %q comment", args, ruleComment)
+			}
+		}
+		// Loopback, one exclusion, tcp and udp, the jump, and the same
+		// for DNS answers without exclusions.
+		if rules != 8 {
+			t.Errorf("v6 %t: got %d rules, want 8", v6, rules)
+		}
+	}
+}
+
+// TestNftablesComments checks that every rule of the ruleset carries the
+// ownership comment.
+func TestNftablesComments(t *testing.T) {
+	fw := &nftables{spec: testSpec(t)}
+	rules := 0
+	for _, line := range strings.Split(fw.ruleset(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "}" || strings.HasPrefix(line, "table ") || strings.HasPrefix(line, "delete ") ||
+			strings.HasPrefix(line, "chain ") || strings.HasPrefix(line, "type ") {
+			continue
+		}
+		rules++
+		if !strings.HasSuffix(line, ` comment "`+ruleComment+`"`) {
+			t.Errorf("rule %q has no %q comment", line, ruleComment)
+		}
+	}
+	if rules != 5 {
+		t.Errorf("got %d rules, want 5", rules)
+	}
+}
@@ -0,0 +1,121 @@
+package nflog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	nfl "github.com/florianl/go-nflog/v2"
+	"golang.org/x/sys/unix"
+)
+
+// reopenDelay is the time waited before reopening a group whose socket
+// failed.
+const reopenDelay = time.Second
+
+// listener receives the packets logged to one nflog group. The kernel
+// drops messages when the socket receive buffer is full (ENOBUFS); the
+// listener keeps receiving and counts the lost messages from the gaps in
+// the group sequence numbers. Other socket errors reopen the group.
+type listener struct {
+	config nfl.Config
+	rcvbuf int // socket receive buffer size, 0 for the system default
+
+	overruns atomic.Uint64 // ENOBUFS errors
+	lost     atomic.Uint64 // messages missing from the sequence
+}
+
+// run receives packets until ctx is cancelled, calling handle for each of
+// them. It gives up if the group can not be set up the first time (bad
+// group, missing privileges).
+func (l *listener) run(ctx context.Context, handle func(nfl.Attribute)) {
+	for started := false; ; started = true {
+		registered, err := l.listen(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		if !registered && !started {
+			fmt.Fprintf(os.Stderr, "[nflog] group %d: %v\n", l.config.Group, err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[nflog] group %d: %v, reopening in %s\n", l.config.Group, err, reopenDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reopenDelay):
+		}
+	}
+}
+
+// listen opens the group and receives packets until ctx is cancelled or
+// the socket fails. registered tells whether the group was set up.
+func (l *listener) listen(ctx context.Context, handle func(nfl.Attribute)) (registered bool, err error) {
+	nf, err := nfl.Open(&l.config)
+	if err != nil {
+		return false, fmt.Errorf("error opening nflog: %w", err)
+	}
+
+	// Close waits for the context watcher started by the registration, so
+	// it must be cancelled first.
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		nf.Close()
+	}()
+
+	if l.rcvbuf > 0 {
+		if err := nf.Con.SetReadBuffer(l.rcvbuf); err != nil {
+			fmt.Fprintf(os.Stderr, "[nflog] group %d: unable to set receive buffer size: %v\n", l.config.Group, err)
+		}
+	}
+
+	// Sequence numbers restart with each new binding.
+	var (
+		last   uint32
+		synced bool
+	)
+	hook := func(a nfl.Attribute) int {
+		if a.Seq != nil {
+			if gap := *a.Seq - last - 1; synced && gap != 0 && gap < 1<<31 {
+				total := l.lost.Add(uint64(gap))
+				fmt.Fprintf(os.Stderr, "[nflog] group %d: %d messages lost (%d total)\n", l.config.Group, gap, total)
+			}
+			last, synced = *a.Seq, true
+		}
+		handle(a)
+		return 0
+	}
+
+	failed := make(chan error, 1)
+	errfn := func(err error) int {
+		if ctx.Err() != nil {
+			return 1
+		}
+		if errors.Is(err, unix.ENOBUFS) {
+			n := l.overruns.Add(1)
+			fmt.Fprintf(os.Stderr, "[nflog] group %d: receive buffer overrun (%d so far), consider raising nflog:buffer\n", l.config.Group, n)
+			return 0
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return 0
+		}
+		failed <- err
+		return 1
+	}
+
+	if err := nf.RegisterWithErrorFunc(ctx, hook, errfn); err != nil {
+		return false, fmt.Errorf("error registering nflog: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return true, nil
+	case err := <-failed:
+		return true, fmt.Errorf("error receiving: %w", err)
+	}
+}
@@ -5,30 +5,44 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"slices"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/devops-works/egress-auditor/internal/entry"
 	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/packets"
 	"github.com/devops-works/egress-auditor/pkg/procdetail"
 	nfl "github.com/florianl/go-nflog/v2"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 )
 
 // NFLog catches connections from NFLOG iptables target
 type NFLog struct {
 	Config        nfl.Config
-	group         int
+	groups        []int
+	copyRange     uint32
+	qthresh       uint32
+	rcvbuf        int
 	allowLoopback bool
 	quiet         bool
+	trackProcs    bool
+	flowIdle      time.Duration
+	dns           bool
+	rules         []string
+	manageRules   string
+	removeRules   bool
+	excludeCIDRs  []*net.IPNet
+	gateway       bool
+	parser        *packets.Parser
+
+	mu        sync.Mutex // guards firewall and listeners, read by Cleanup
+	firewall  firewall
+	listeners []*listener
 	// Output outputs.Output
 }
 
-const (
-	layerIPv4 = 0x0800
-	layerIPv6 = 0x86DD
-)
-
 // Description returns a description for the module, including the available
 // options
 func (nfh *NFLog) Description() string {
@@ -40,10 +54,76 @@ func (nfh *NFLog) Description() string {
 		sudo iptables -I OUTPUT -m state --state NEW -p tcp -j NFLOG --nflog-group 100
 		sudo iptables -I OUTPUT -m state --state NEW -p udp -j NFLOG --nflog-group 100
 
+	To also audit inbound connections, log NEW packets in the INPUT chain to the
+	same group; they are reported with direction=ingress and attributed to the
+	process owning the listening socket:
+
+		sudo iptables -I INPUT -m state --state NEW -p tcp -j NFLOG --nflog-group 100
+		sudo iptables -I INPUT -m state --state NEW -p udp -j NFLOG --nflog-group 100
+
+	On gateways, packets logged in the FORWARD chain are reported with
+	direction=forward. Processes are not looked up for them: connections are
+	attributed to the source host (address, MAC address and input interface):
+
+		sudo iptables -I FORWARD -m state --state NEW -j NFLOG --nflog-group 100
+
+	When the process that owns a socket can not be found (it already exited),
+	connections are attributed to the user id the kernel attaches to logged
+	packets. Packet marks are reported, to tell which rules a packet went
+	through.
+
+	The --nflog-prefix of the rule that logged a packet tags connections
+	(rule=), along with the chain. Prefixes like "DROP:<name>" or
+	"ALLOW:<name>" also set the verdict, for rules logging packets before
+	dropping or accepting them:
+
+		sudo iptables -A OUTPUT -j NFLOG --nflog-group 100 --nflog-prefix DROP:default
+		sudo iptables -A OUTPUT -j DROP
+
 	Options:
-		- "nflog:group:<ID>": listens for packet send to nflog entry identified by this group ID
+		- "nflog:group:<ID>": listens for packet send to nflog entry identified by this group ID;
+		    may be specified multiple times to listen to several groups
+		- "nflog:buffer:<bytes>": netlink socket receive buffer size, per
+		    group (default: system default, see net.core.rmem_default). When
+		    it overflows the kernel drops messages; they are counted and
+		    reported on stderr, and reception goes on
+		- "nflog:qthreshold:<n>": number of packets the kernel batches before
+		    sending them (default: kernel default)
+		- "nflog:copy-range:<bytes>": number of bytes of each packet copied
+		    to user space (default: whole packet); 128 is enough for headers,
+		    but DNS answers need more
 		- "nflog:allow-loopback:<false|true>": whether to check on loopback traffic or not
 		- "nflog:quiet:<false|true>": suppress per-connection messages on stderr
+		- "nflog:track-procs:<false|true>": maintain a process tree from the
+		    netlink proc connector so ancestors that already exited are still
+		    reported
+		- "nflog:udp-idle-timeout:<duration>": idle time after which a UDP
+		    flow ends (default 30s), see "UDP flows" in the README
+		- "nflog:dns:<false|true>": parse DNS answers logged to the group and
+		    annotate connections with the name the destination IP was
+		    resolved from (dest_host). Answers must be logged too:
+
+		sudo iptables -I INPUT -p udp --sport 53 -j NFLOG --nflog-group 100
+		sudo iptables -I INPUT -p tcp --sport 53 -j NFLOG --nflog-group 100
+		- "nflog:manage-rules:<iptables|nftables>": install the rules logging
+		    new TCP and UDP connections (IPv4 and IPv6) to the group at
+		    startup, in dedicated chains (EGRESS-AUDITOR-<group>) or table
+		    (inet egress_auditor_<group>), and remove them on exit. Rules
+		    left by a crash are replaced at the next start. Loopback traffic
+		    is excluded unless allow-loopback is set; DNS answers are logged
+		    when dns is set. Rules log to the first group
+		- "nflog:remove-rules:<false|true>": with manage-rules, remove the
+		    rules a previous run left and exit instead of capturing (e.g.
+		    in ExecStopPost)
+		- "nflog:exclude-cidr:<CIDR>": with manage-rules, do not log
+		    connections to this network; may be specified multiple times
+		- "nflog:gateway:<false|true>": audit traffic routed by this host:
+		    managed rules log new connections in the FORWARD chain instead
+		    of OUTPUT, and packets logged in PREROUTING or POSTROUTING are
+		    considered forwarded too
+		- "nflog:rule:<pattern>": only report connections whose rule tag
+		    matches pattern (path.Match globs, e.g. "app-*"); may be
+		    specified multiple times
 
 	Example:
 		egress-auditor -i nflog -I nflog:group:100 ...
@@ -52,136 +132,290 @@ func (nfh *NFLog) Description() string {
 
 // Process starts handling connections capture
 func (nfh *NFLog) Process(ctx context.Context, c chan<- entry.Connection) {
+	if len(nfh.groups) == 0 {
+		nfh.groups = []int{0}
+	}
 	nfh.Config = nfl.Config{
-		Group:    uint16(nfh.group),
+		Flags:    nfl.FlagSeq,
 		Copymode: nfl.CopyPacket,
+		Bufsize:  nfh.copyRange,
+		QThresh:  nfh.qthresh,
+	}
+
+	nfh.parser = packets.NewParser(nfh.flowIdle, nfh.dns)
+	// Packets are handled on the receive goroutines of the nflog library,
+	// which closing a group does not wait for.
+	out := inputs.NewSender(c)
+	defer out.Close()
+
+	spec := ruleSpec{
+		group:    nfh.groups[0],
+		loopback: nfh.allowLoopback,
+		dns:      nfh.dns,
+		exclude:  nfh.excludeCIDRs,
+		forward:  nfh.gateway,
+	}
+	var fw firewall
+	switch nfh.manageRules {
+	case "iptables":
+		fw = &iptables{spec: spec}
+	case "nftables":
+		fw = &nftables{spec: spec}
 	}
 
-	nf, err := nfl.Open(&nfh.Config)
-	if err != nil {
-		// Pass logger in context, log & return ?
-		fmt.Fprintf(os.Stderr, "error opening nflog: %v\n", err)
+	if nfh.removeRules {
+		if fw == nil {
+			fmt.Fprintf(os.Stderr, "[nflog] remove-rules requires manage-rules\n")
+			return
+		}
+		if err := fw.remove(); err != nil {
+			fmt.Fprintf(os.Stderr, "[nflog] unable to remove %s rules: %v\n", nfh.manageRules, err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[nflog] %s rules removed for group %d\n", nfh.manageRules, nfh.groups[0])
 		return
 	}
 
-	defer nf.Close()
+	if nfh.trackProcs {
+		t := procdetail.NewTracker(time.Minute)
+		if err := t.Scan(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to scan processes: %v\n", err)
+		}
+		go func() {
+			if err := t.ListenConnector(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "proc connector error: %v\n", err)
+			}
+		}()
+		go t.Run(ctx)
+		procdetail.UseTracker(t)
+	}
 
-	fn := func(a nfl.Attribute) int {
-		var (
-			layerType    gopacket.LayerType
-			p            gopacket.Packet
-			srcIP, dstIP net.IP
-			ipv          uint8
-		)
+	if fw != nil {
+		if err := fw.install(); err != nil {
+			fmt.Fprintf(os.Stderr, "[nflog] unable to install %s rules: %v\n", nfh.manageRules, err)
+			if err := fw.remove(); err != nil {
+				fmt.Fprintf(os.Stderr, "[nflog] unable to remove %s rules: %v\n", nfh.manageRules, err)
+			}
+			return
+		}
+		nfh.mu.Lock()
+		nfh.firewall = fw
+		nfh.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "[nflog] %s rules installed for group %d\n", nfh.manageRules, nfh.groups[0])
+	}
 
+	fn := func(a nfl.Attribute) {
 		if a.HwProtocol == nil || a.Payload == nil {
-			return 0
-		}
-
-		switch *a.HwProtocol {
-		case layerIPv4:
-			layerType = layers.LayerTypeIPv4
-		case layerIPv6:
-			layerType = layers.LayerTypeIPv6
-		default:
-			return 0
-		}
-
-		p = gopacket.NewPacket(*a.Payload, layerType, gopacket.Default)
-
-		ipLayer := p.Layer(layerType)
-		// helper to extract IPs from the IP layer
-		extractIPs := func() bool {
-			switch ipLayer.LayerType() {
-			case layers.LayerTypeIPv4:
-				ip, _ := ipLayer.(*layers.IPv4)
-				srcIP = ip.SrcIP
-				dstIP = ip.DstIP
-				ipv = 4
-			case layers.LayerTypeIPv6:
-				ip, _ := ipLayer.(*layers.IPv6)
-				srcIP = ip.SrcIP
-				dstIP = ip.DstIP
-				ipv = 6
-			default:
-				return false
-			}
-			return true
+			return
 		}
 
-		if tcpLayer := p.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-			if !extractIPs() {
-				return 0
-			}
-			if tcp.SYN && (!dstIP.IsLoopback() || nfh.allowLoopback) {
-				proc, err := procdetail.GetOwnerOfConnection("tcp", srcIP, uint16(tcp.SrcPort), dstIP, uint16(tcp.DstPort))
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "unable to get process: %v\n", err)
-				} else if !nfh.quiet {
-					fmt.Fprintf(os.Stderr, "new tcp connection %s:%s -> %s:%s by %s\n", srcIP, tcp.SrcPort, dstIP, tcp.DstPort, proc.Name)
-				}
-				c <- entry.Connection{
-					Hook:     "nflog",
-					Protocol: "tcp",
-					DestIP:   dstIP.String(),
-					DestPort: uint16(tcp.DstPort),
-					Proc:     proc,
-					IPv:      ipv,
-				}
+		p, _, ok := packets.Decode(*a.HwProtocol, *a.Payload)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		conn, ok := nfh.parser.Parse(p, now)
+		if !ok {
+			return
+		}
+
+		if conn.DstIP.IsLoopback() && !nfh.allowLoopback {
+			return
+		}
+
+		var rule, verdict string
+		if a.Prefix != nil {
+			rule, verdict = parsePrefix(*a.Prefix)
+		}
+		if !nfh.matchRule(rule) {
+			return
+		}
+
+		direction := nfh.direction(a)
+		if direction == entry.Forward {
+			// Processes of other hosts can not be found; the connection is
+			// attributed to the host that sent it.
+			ent := conn.Entry("nflog", entry.Forward)
+			ent.DestHost = nfh.parser.Host(conn, now)
+			ent.Proc = procdetail.Unknown()
+			ent.SrcHost = sourceHost(conn.SrcIP, a)
+			if !nfh.quiet {
+				fmt.Fprintf(os.Stderr, "new forwarded %s connection %s:%d -> %s:%d from %s\n", conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, hostLabel(ent.SrcHost))
 			}
-			return 0
+			nfh.send(ctx, out, ent, a, rule, verdict)
+			return
 		}
 
-		if udpLayer := p.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp, _ := udpLayer.(*layers.UDP)
-			if !extractIPs() {
-				return 0
+		var (
+			proc *procdetail.ProcessDetail
+			err  error
+		)
+		at := now
+		if a.Timestamp != nil {
+			at = *a.Timestamp
+		}
+		ingress := direction == entry.Ingress
+		if ingress {
+			proc, err = procdetail.GetOwnerOfListener(conn.Protocol, conn.DstIP, conn.DstPort, at)
+		} else {
+			proc, err = procdetail.GetOwnerOfConnection(conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, at)
+		}
+		if proc.Pid == 0 && a.UID != nil {
+			// The process is gone (or not found) but the kernel told us
+			// who owned the socket.
+			proc = procdetail.ForUser(*a.UID)
+			if a.GID != nil {
+				proc.GID = *a.GID
 			}
-			if !dstIP.IsLoopback() || nfh.allowLoopback {
-				proc, err := procdetail.GetOwnerOfConnection("udp", srcIP, uint16(udp.SrcPort), dstIP, uint16(udp.DstPort))
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "unable to get process: %v\n", err)
-				} else if !nfh.quiet {
-					fmt.Fprintf(os.Stderr, "new udp connection %s:%s -> %s:%s by %s\n", srcIP, udp.SrcPort, dstIP, udp.DstPort, proc.Name)
-				}
-				c <- entry.Connection{
-					Hook:     "nflog",
-					Protocol: "udp",
-					DestIP:   dstIP.String(),
-					DestPort: uint16(udp.DstPort),
-					Proc:     proc,
-					IPv:      ipv,
-				}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to get process: %v\n", err)
+		} else if !nfh.quiet {
+			if ingress {
+				fmt.Fprintf(os.Stderr, "new ingress %s connection %s:%d -> %s:%d accepted by %s\n", conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, proc.Name)
+			} else {
+				fmt.Fprintf(os.Stderr, "new %s connection %s:%d -> %s:%d by %s\n", conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort, proc.Name)
 			}
-			return 0
 		}
-		return 0
+
+		var ent entry.Connection
+		if ingress {
+			ent = conn.Entry("nflog", entry.Ingress)
+		} else {
+			ent = conn.Entry("nflog", entry.Egress)
+			ent.DestHost = nfh.parser.Host(conn, now)
+		}
+		ent.Proc = proc
+		nfh.send(ctx, out, ent, a, rule, verdict)
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range nfh.groups {
+		l := &listener{config: nfh.Config, rcvbuf: nfh.rcvbuf}
+		l.config.Group = uint16(g)
+		nfh.mu.Lock()
+		nfh.listeners = append(nfh.listeners, l)
+		nfh.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.run(ctx, fn)
+		}()
+	}
+	wg.Wait()
+}
+
+// matchRule returns true if connections tagged with rule are reported.
+func (nfh *NFLog) matchRule(rule string) bool {
+	if len(nfh.rules) == 0 {
+		return true
+	}
+	for _, pattern := range nfh.rules {
+		if ok, _ := path.Match(pattern, rule); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := nf.Register(ctx, fn); err != nil {
-		fmt.Fprintf(os.Stderr, "error registering nflog: %v\n", err)
-		panic(err)
-		// TODO:exit gorouting and catch in a rungroup in main, then cancel ctx there
+// send completes ent with the attributes of the packet it was seen in and
+// sends it to out.
+func (nfh *NFLog) send(ctx context.Context, out *inputs.Sender, ent entry.Connection, a nfl.Attribute, rule, verdict string) {
+	if a.Mark != nil {
+		ent.Mark = *a.Mark
+	}
+	if a.Timestamp != nil {
+		ent.Time = *a.Timestamp
 	}
+	if a.Hook != nil {
+		ent.Chain = packets.Chain(*a.Hook)
+	}
+	ent.Rule, ent.Verdict = rule, verdict
+	out.Send(ctx, ent)
+}
+
+// direction returns the direction of the connection a was logged for (see
+// packets.Direction).
+func (nfh *NFLog) direction(a nfl.Attribute) string {
+	return packets.Direction(a.Hook, a.InDev, a.OutDev, nfh.gateway)
+}
+
+// sourceHost returns what a tells about the host that sent it.
+func sourceHost(ip net.IP, a nfl.Attribute) *entry.Host {
+	h := &entry.Host{IP: ip.String()}
+	if a.HwAddr != nil && len(*a.HwAddr) > 0 {
+		h.MAC = net.HardwareAddr(*a.HwAddr).String()
+	}
+	if a.InDev != nil {
+		if ifc, err := net.InterfaceByIndex(int(*a.InDev)); err == nil {
+			h.Interface = ifc.Name
+		}
+	}
+	return h
+}
 
-	<-ctx.Done()
+// hostLabel returns a short description of h for messages.
+func hostLabel(h *entry.Host) string {
+	if h.MAC == "" {
+		return h.IP
+	}
+	if h.Interface == "" {
+		return fmt.Sprintf("%s (%s)", h.IP, h.MAC)
+	}
+	return fmt.Sprintf("%s (%s on %s)", h.IP, h.MAC, h.Interface)
 }
 
 // Cleanup any stuff that needs to be sorted out before exiting
 func (nfh *NFLog) Cleanup() {
+	nfh.mu.Lock()
+	defer nfh.mu.Unlock()
+	for _, l := range nfh.listeners {
+		if n := l.overruns.Load(); n > 0 {
+			fmt.Fprintf(os.Stderr, "[nflog] group %d: %d receive buffer overruns, %d messages lost\n", l.config.Group, n, l.lost.Load())
+		}
+	}
+	if nfh.firewall == nil {
+		return
+	}
+	if err := nfh.firewall.remove(); err != nil {
+		fmt.Fprintf(os.Stderr, "[nflog] unable to remove %s rules: %v\n", nfh.manageRules, err)
+	}
 }
 
 // SetOption let caller set specific module suboptions
 func (nfh *NFLog) SetOption(k, v string) error {
 	switch k {
 	case "group":
-		g, err := strconv.Atoi(v)
+		g, err := strconv.ParseUint(v, 10, 16)
 		if err != nil {
 			return err
 		}
-		nfh.group = g
-		fmt.Fprintf(os.Stderr, "setting nflog group to %d\n", nfh.group)
+		if slices.Contains(nfh.groups, int(g)) {
+			return nil
+		}
+		nfh.groups = append(nfh.groups, int(g))
+		fmt.Fprintf(os.Stderr, "adding nflog group %d\n", g)
+	case "buffer":
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if b <= 0 {
+			return fmt.Errorf("buffer must be positive")
+		}
+		nfh.rcvbuf = b
+	case "qthreshold":
+		q, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return err
+		}
+		nfh.qthresh = uint32(q)
+	case "copy-range":
+		r, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return err
+		}
+		nfh.copyRange = uint32(r)
 	case "allow-loopback":
 		a, err := strconv.ParseBool(v)
 		if err != nil {
@@ -195,6 +429,55 @@ func (nfh *NFLog) SetOption(k, v string) error {
 			return err
 		}
 		nfh.quiet = q
+	case "track-procs":
+		t, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		nfh.trackProcs = t
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		nfh.flowIdle = d
+	case "dns":
+		d, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		nfh.dns = d
+	case "manage-rules":
+		if v != "iptables" && v != "nftables" {
+			return fmt.Errorf("manage-rules must be iptables or nftables")
+		}
+		nfh.manageRules = v
+	case "remove-rules":
+		r, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		nfh.removeRules = r
+	case "exclude-cidr":
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		nfh.excludeCIDRs = append(nfh.excludeCIDRs, n)
+	case "gateway":
+		g, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		nfh.gateway = g
+	case "rule":
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid rule pattern %q: %w", v, err)
+		}
+		nfh.rules = append(nfh.rules, v)
 	}
 	return nil
 }
@@ -0,0 +1,29 @@
+package nflog
+
+import (
+	"strings"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// verdictPrefixes are the log prefixes marking what the rule following the
+// NFLOG one does with the packet.
+var verdictPrefixes = map[string]string{
+	"DROP":   entry.VerdictDrop,
+	"REJECT": entry.VerdictDrop,
+	"ALLOW":  entry.VerdictAccept,
+	"ACCEPT": entry.VerdictAccept,
+}
+
+// parsePrefix splits an NFLOG prefix into a rule tag and a verdict.
+// Prefixes like "DROP:name" or "ALLOW:name" (case insensitive) set the
+// verdict and tag the rule with name; other prefixes are tags as is.
+func parsePrefix(prefix string) (rule, verdict string) {
+	prefix = strings.TrimSpace(strings.TrimRight(prefix, "\x00"))
+	if head, tail, ok := strings.Cut(prefix, ":"); ok {
+		if v, ok := verdictPrefixes[strings.ToUpper(head)]; ok {
+			return strings.TrimSpace(tail), v
+		}
+	}
+	return prefix, ""
+}
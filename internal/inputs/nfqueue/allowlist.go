@@ -0,0 +1,169 @@
+package nfqueue
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+)
+
+// rule is one allowlist entry; every field that is set must match. Process
+// names support path.Match globs.
+type rule struct {
+	raw       string
+	proc      string
+	parent    string
+	ancestor  string
+	container string
+	pod       string
+	unit      string
+	user      string
+	proto     string
+	direction string
+	src       *net.IPNet
+	dst       *net.IPNet
+	port      uint16
+}
+
+// parseRule parses a rule such as "proc=curl,dst=10.0.0.0/8,port=443".
+// Keys are proc, parent, ancestor (any ancestor), container (id), pod
+// (UID), unit (systemd), user, proto, direction (egress or ingress), src,
+// dst (CIDR or address) and port.
+func parseRule(s string) (*rule, error) {
+	r := &rule{raw: s}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rule %q: %q is not key=value", s, kv)
+		}
+		k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch k {
+		case "proc", "parent", "ancestor", "container", "pod", "unit":
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("invalid rule %q: bad pattern %q", s, v)
+			}
+			switch k {
+			case "proc":
+				r.proc = v
+			case "parent":
+				r.parent = v
+			case "ancestor":
+				r.ancestor = v
+			case "container":
+				r.container = v
+			case "pod":
+				r.pod = v
+			default:
+				r.unit = v
+			}
+		case "user":
+			r.user = v
+		case "proto":
+			r.proto = v
+		case "direction":
+			if v != entry.Egress && v != entry.Ingress {
+				return nil, fmt.Errorf("invalid rule %q: direction must be %s or %s", s, entry.Egress, entry.Ingress)
+			}
+			r.direction = v
+		case "src", "dst":
+			n, err := packets.ParseNet(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %w", s, err)
+			}
+			if k == "src" {
+				r.src = n
+			} else {
+				r.dst = n
+			}
+		case "port":
+			p, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: bad port %q", s, v)
+			}
+			r.port = uint16(p)
+		default:
+			return nil, fmt.Errorf("invalid rule %q: unknown key %q", s, k)
+		}
+	}
+	return r, nil
+}
+
+// needsProc returns true if r can only match once the process is known.
+func (r *rule) needsProc() bool {
+	return r.proc != "" || r.parent != "" || r.ancestor != "" || r.user != "" ||
+		r.container != "" || r.pod != "" || r.unit != ""
+}
+
+// matches returns true if c is allowed by r.
+func (r *rule) matches(c entry.Connection) bool {
+	if r.direction != "" && r.direction != direction(c) {
+		return false
+	}
+	if r.proto != "" && r.proto != c.Protocol {
+		return false
+	}
+	if r.port != 0 && r.port != c.DestPort {
+		return false
+	}
+	if r.src != nil && !r.src.Contains(net.ParseIP(c.SrcIP)) {
+		return false
+	}
+	if r.dst != nil && !r.dst.Contains(net.ParseIP(c.DestIP)) {
+		return false
+	}
+	if !r.needsProc() {
+		return true
+	}
+	if c.Proc == nil {
+		return false
+	}
+	if r.proc != "" && !globMatch(r.proc, c.Proc.Name) {
+		return false
+	}
+	if r.parent != "" && (c.Proc.Parent == nil || !globMatch(r.parent, c.Proc.Parent.Name)) {
+		return false
+	}
+	if r.ancestor != "" && !slices.ContainsFunc(c.Proc.Ancestry(), func(a *procdetail.ProcessDetail) bool {
+		return globMatch(r.ancestor, a.Name)
+	}) {
+		return false
+	}
+	if r.user != "" && r.user != c.Proc.User {
+		return false
+	}
+	if r.container != "" || r.pod != "" || r.unit != "" {
+		cg := c.Proc.Cgroup
+		if cg == nil {
+			return false
+		}
+		// Container ids are usually written in their short form.
+		if r.container != "" && !globMatch(r.container, cg.ContainerID) && !globMatch(r.container, cg.ShortID()) {
+			return false
+		}
+		if r.pod != "" && !globMatch(r.pod, cg.PodUID) {
+			return false
+		}
+		if r.unit != "" && !globMatch(r.unit, cg.Unit) {
+			return false
+		}
+	}
+	return true
+}
+
+func globMatch(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func direction(c entry.Connection) string {
+	if c.Direction == "" {
+		return entry.Egress
+	}
+	return c.Direction
+}
@@ -0,0 +1,329 @@
+// Package nfqueue implements an input that receives new connections from
+// the iptables NFQUEUE target and accepts or drops them depending on the
+// process that initiated them.
+package nfqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+	nfq "github.com/florianl/go-nfqueue/v2"
+	"github.com/mdlayher/netlink"
+)
+
+// NFQueue decides the fate of packets queued by the NFQUEUE target
+type NFQueue struct {
+	queue         int
+	allowLoopback bool
+	quiet         bool
+	failOpen      bool
+	dryRun        bool
+	rules         []*rule
+	flowIdle      time.Duration
+	parser        *packets.Parser
+}
+
+// Description returns a description for the module, including the available
+// options
+func (q *NFQueue) Description() string {
+	return `
+	nfqueue iptables hook
+	Gets new connections from iptables NFQUEUE target, finds the process
+	that initiated them and accepts or drops them according to an allowlist.
+	Every decision is sent to outputs, with its verdict.
+	Queue TCP and UDP packets like so:
+
+		sudo iptables -I OUTPUT -m state --state NEW -p tcp -j NFQUEUE --queue-num 100 --queue-bypass
+		sudo iptables -I OUTPUT -m state --state NEW -p udp -j NFQUEUE --queue-num 100 --queue-bypass
+
+	(--queue-bypass accepts packets while egress-auditor is not running; drop
+	it to fail closed.) Packets queued from the INPUT chain are handled as
+	inbound connections, attributed to the process owning the listening
+	socket.
+
+	Options:
+		- "nfqueue:queue:<ID>": queue number to receive packets from
+		- "nfqueue:allow:<rule>": accept connections matching rule; may be
+		    specified multiple times. A rule is a comma separated list of
+		    key=value, all of which must match:
+		      proc=<name>       process name (glob wildcards * ? [...])
+		      parent=<name>     parent process name (same syntax)
+		      ancestor=<name>   name of any ancestor, up to --ancestry-depth
+		                        (same syntax)
+		      container=<id>    container id, short or full (same syntax)
+		      pod=<uid>         Kubernetes pod UID (same syntax)
+		      unit=<name>       systemd unit, e.g. nginx.service (same syntax)
+		      user=<name>       user running the process
+		      proto=<tcp|udp>   protocol
+		      direction=<egress|ingress>
+		      src=<CIDR|IP>     source address (the peer for ingress)
+		      dst=<CIDR|IP>     destination address
+		      port=<port>       destination port (the local port for ingress)
+		    e.g. "nfqueue:allow:proc=curl,dst=10.0.0.0/8,port=443"
+		- "nfqueue:fail-open:<false|true>": accept connections whose process
+		    can not be found (unless a rule with none of the process keys,
+		    proc to unit and user, matches them), and let the kernel accept
+		    packets when the queue is full. Defaults to false: such
+		    connections are dropped
+		- "nfqueue:dry-run:<false|true>": accept everything, but log and
+		    report "would-drop" for connections that would have been dropped
+		- "nfqueue:allow-loopback:<false|true>": apply rules to loopback
+		    traffic; otherwise it is accepted without being reported
+		- "nfqueue:quiet:<false|true>": suppress per-connection messages on stderr
+		- "nfqueue:udp-idle-timeout:<duration>": idle time after which a UDP
+		    flow ends (default 30s), see "UDP flows" in the README; every
+		    packet gets a verdict, but only the first of a flow is reported
+
+	Example:
+		egress-auditor -i nfqueue -I nfqueue:queue:100 \
+		    -I nfqueue:allow:proc=apt*,port=443 \
+		    -I nfqueue:allow:dst=10.0.0.0/8 \
+		    -I nfqueue:dry-run:true -o logfmt
+	`
+}
+
+// Process starts handling queued packets
+func (q *NFQueue) Process(ctx context.Context, c chan<- entry.Connection) {
+	q.parser = packets.NewParser(q.flowIdle, false)
+
+	var flags uint32
+	if q.failOpen {
+		flags |= nfq.NfQaCfgFlagFailOpen
+	}
+	config := nfq.Config{
+		NfQueue:      uint16(q.queue),
+		MaxQueueLen:  1024,
+		MaxPacketLen: 128, // enough for IP and TCP/UDP headers
+		Copymode:     nfq.NfQnlCopyPacket,
+		Flags:        flags,
+		WriteTimeout: 15 * time.Millisecond,
+	}
+
+	nf, err := nfq.Open(&config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[nfqueue] error opening queue: %v\n", err)
+		return
+	}
+	defer nf.Close()
+	// Hooks run on the receive goroutine of nf, which Close does not wait
+	// for.
+	out := inputs.NewSender(c)
+	defer out.Close()
+
+	// Lost messages leave packets without verdict, which the kernel
+	// eventually drops; there is nothing better to do than keep going.
+	if err := nf.SetOption(netlink.NoENOBUFS, true); err != nil {
+		fmt.Fprintf(os.Stderr, "[nfqueue] unable to set NoENOBUFS: %v\n", err)
+	}
+
+	fn := func(a nfq.Attribute) int {
+		if a.PacketID == nil {
+			return 0
+		}
+		id := *a.PacketID
+
+		conn, report, ok := q.decode(a)
+		if !ok {
+			// Not something we can attribute: apply the failure policy.
+			v := nfq.NfDrop
+			if q.failOpen || q.dryRun {
+				v = nfq.NfAccept
+			}
+			if err := nf.SetVerdict(id, v); err != nil {
+				fmt.Fprintf(os.Stderr, "[nfqueue] unable to set verdict: %v\n", err)
+			}
+			return 0
+		}
+		if conn.Proc == nil {
+			// Loopback traffic: accepted, not reported.
+			if err := nf.SetVerdict(id, nfq.NfAccept); err != nil {
+				fmt.Fprintf(os.Stderr, "[nfqueue] unable to set verdict: %v\n", err)
+			}
+			return 0
+		}
+
+		verdict, reason := q.decide(conn)
+		v := nfq.NfAccept
+		switch {
+		case verdict == entry.VerdictAccept:
+		case q.dryRun:
+			verdict = entry.VerdictWouldDrop
+		default:
+			v = nfq.NfDrop
+		}
+		// Set the verdict before anything else: the packet is held by
+		// the kernel until then.
+		if err := nf.SetVerdict(id, v); err != nil {
+			fmt.Fprintf(os.Stderr, "[nfqueue] unable to set verdict: %v\n", err)
+		}
+
+		if !report {
+			return 0
+		}
+		conn.Verdict = verdict
+		if !q.quiet || verdict == entry.VerdictWouldDrop {
+			msg := verdict
+			if verdict == entry.VerdictWouldDrop {
+				msg = "would drop"
+			}
+			fmt.Fprintf(os.Stderr, "[nfqueue] %s %s %s connection %s:%d -> %s:%d by %s (%s)\n",
+				msg, conn.Direction, conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DestIP, conn.DestPort, conn.Proc.Name, reason)
+		}
+		out.Send(ctx, conn)
+		return 0
+	}
+
+	errfn := func(err error) int {
+		if ctx.Err() != nil {
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "[nfqueue] receive error: %v\n", err)
+		return 0
+	}
+
+	if err := nf.RegisterWithErrorFunc(ctx, fn, errfn); err != nil {
+		fmt.Fprintf(os.Stderr, "[nfqueue] error registering queue: %v\n", err)
+		return
+	}
+
+	<-ctx.Done()
+}
+
+// decode parses the packet in a and resolves its process. It returns false
+// when the packet is not TCP or UDP over IP. report is false for packets
+// of UDP flows that were already reported. Loopback packets are returned
+// with a nil Proc unless allowLoopback is set.
+func (q *NFQueue) decode(a nfq.Attribute) (conn entry.Connection, report bool, ok bool) {
+	if a.HwProtocol == nil || a.Payload == nil {
+		return conn, false, false
+	}
+	_, c, ok := packets.Decode(*a.HwProtocol, *a.Payload)
+	if !ok {
+		return conn, false, false
+	}
+
+	direction := entry.Egress
+	if isIngress(a) {
+		direction = entry.Ingress
+	}
+	conn = c.Entry("nfqueue", direction)
+
+	if c.DstIP.IsLoopback() && !q.allowLoopback {
+		return conn, false, true
+	}
+
+	// Every packet gets a verdict, but only new connections are reported;
+	// TCP packets are always new since only SYNs are in state NEW.
+	now := time.Now()
+	report = c.Protocol == "tcp" || q.parser.IsNew(&c, now)
+	conn.Flow = c.Flow
+
+	var err error
+	if conn.IsIngress() {
+		conn.Proc, err = procdetail.GetOwnerOfListener(c.Protocol, c.DstIP, c.DstPort, now)
+	} else {
+		conn.Proc, err = procdetail.GetOwnerOfConnection(c.Protocol, c.SrcIP, c.SrcPort, c.DstIP, c.DstPort, now)
+	}
+	if err != nil && !q.quiet {
+		fmt.Fprintf(os.Stderr, "[nfqueue] unable to get process: %v\n", err)
+	}
+	return conn, report, true
+}
+
+// decide returns the verdict for conn (accept or drop) and why.
+func (q *NFQueue) decide(conn entry.Connection) (string, string) {
+	// GetOwnerOfConnection returns a placeholder without pid when the
+	// owner can not be found.
+	resolved := conn.Proc.Pid != 0
+	for _, r := range q.rules {
+		if r.needsProc() && !resolved {
+			continue
+		}
+		if r.matches(conn) {
+			return entry.VerdictAccept, "allowed by " + r.raw
+		}
+	}
+	if !resolved {
+		if q.failOpen {
+			return entry.VerdictAccept, "unknown process, failing open"
+		}
+		return entry.VerdictDrop, "unknown process, failing closed"
+	}
+	return entry.VerdictDrop, "no matching rule"
+}
+
+// isIngress returns true if a was queued from the INPUT chain, or from
+// PREROUTING (see packets.Direction); other packets are judged as egress.
+func isIngress(a nfq.Attribute) bool {
+	return packets.Direction(a.Hook, a.InDev, a.OutDev, false) == entry.Ingress
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (q *NFQueue) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (q *NFQueue) SetOption(k, v string) error {
+	switch k {
+	case "queue":
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return err
+		}
+		q.queue = int(n)
+	case "allow":
+		r, err := parseRule(v)
+		if err != nil {
+			return err
+		}
+		q.rules = append(q.rules, r)
+	case "fail-open":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		q.failOpen = b
+	case "dry-run":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		q.dryRun = b
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		q.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		q.quiet = b
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		q.flowIdle = d
+	default:
+		return fmt.Errorf("option %q unknown for nfqueue input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("nfqueue", &NFQueue{})
+}
@@ -0,0 +1,275 @@
+// Package nftrace implements an input that turns nftables trace events
+// (what "nft monitor trace" shows) into connections, with the rule and
+// verdict that applied to them. It needs no log rules, only packets
+// marked with "meta nftrace set 1".
+package nftrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// settle is how long after its last event a traced packet is considered
+// done with: it may go through several base chains, and the verdict of the
+// last one counts.
+const settle = 100 * time.Millisecond
+
+// NFTrace receives nftables trace events
+type NFTrace struct {
+	tables        []string
+	allowLoopback bool
+	quiet         bool
+	flowIdle      time.Duration
+
+	parser *packets.Parser
+	traces map[uint32]*trace
+	ready  []entry.Connection
+}
+
+// Description returns a description for the module, including the available
+// options
+func (n *NFTrace) Description() string {
+	return `
+	nftables trace events
+	Subscribes to nftables trace events, sent for packets marked with
+	"meta nftrace set 1", and reports new TCP and UDP connections with the
+	verdict they got (verdict=accept|drop), the rule or chain policy that
+	gave it (rule="inet filter output handle 12") and its chain. Connections
+	are attributed to processes like with nflog; forwarded ones to their
+	source host.
+
+	Mark new connections before the chains to audit, e.g.:
+
+		nft add table inet trace
+		nft add chain inet trace output '{ type filter hook output priority -150; }'
+		nft add rule inet trace output ct state new meta nftrace set 1
+
+	Other programs tracing packets (nft monitor trace) get the same events,
+	and this input gets theirs.
+
+	Options:
+		- "nftrace:table:<name>": only use events of chains in this table;
+		    may be specified multiple times
+		- "nftrace:allow-loopback:<false|true>": include loopback traffic
+		- "nftrace:quiet:<false|true>": suppress per-connection messages on stderr
+		- "nftrace:udp-idle-timeout:<duration>": idle time after which a UDP
+		    flow ends (default 30s), see "UDP flows" in the README
+
+	Example:
+		sudo egress-auditor -i nftrace -I nftrace:table:filter -o logfmt
+	`
+}
+
+// Process subscribes to trace events and sends connections to c
+func (n *NFTrace) Process(ctx context.Context, c chan<- entry.Connection) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[nftrace] unable to open netlink socket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := conn.JoinGroup(unix.NFNLGRP_NFTRACE); err != nil {
+		fmt.Fprintf(os.Stderr, "[nftrace] unable to subscribe to trace events: %v\n", err)
+		return
+	}
+	// Events are lost rather than the socket being closed when we can not
+	// keep up.
+	if err := conn.SetOption(netlink.NoENOBUFS, true); err != nil {
+		fmt.Fprintf(os.Stderr, "[nftrace] unable to set NoENOBUFS: %v\n", err)
+	}
+
+	n.parser = packets.NewParser(n.flowIdle, false)
+	n.traces = make(map[uint32]*trace)
+	msgType := netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_TRACE)
+
+	for {
+		// Wake up regularly to report settled packets and notice
+		// cancellation.
+		if err := conn.SetReadDeadline(time.Now().Add(settle)); err != nil {
+			fmt.Fprintf(os.Stderr, "[nftrace] %v\n", err)
+			return
+		}
+		msgs, err := conn.Receive()
+		if ctx.Err() != nil {
+			return
+		}
+		var nerr net.Error
+		if err != nil && !(errors.As(err, &nerr) && nerr.Timeout()) {
+			fmt.Fprintf(os.Stderr, "[nftrace] error receiving events: %v\n", err)
+			return
+		}
+
+		now := time.Now()
+		for _, m := range msgs {
+			if m.Header.Type != msgType {
+				continue
+			}
+			ev, err := parseEvent(m.Data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[nftrace] invalid trace event: %v\n", err)
+				continue
+			}
+			n.handle(ev, now)
+		}
+		n.flush(now)
+
+		for _, ent := range n.ready {
+			select {
+			case c <- ent:
+			case <-ctx.Done():
+				return
+			}
+		}
+		n.ready = n.ready[:0]
+	}
+}
+
+// handle adds ev to the trace of its packet.
+func (n *NFTrace) handle(ev event, now time.Time) {
+	if len(n.tables) > 0 && !slices.Contains(n.tables, ev.table) {
+		return
+	}
+
+	t := n.traces[ev.id]
+	if p, conn, ok := ev.decode(); ok {
+		// Headers are sent again in each base chain; only a different
+		// packet (trace ids are reused) starts a new trace.
+		if t == nil || !sameConn(t.conn, conn) {
+			if t != nil {
+				n.finish(ev.id, t)
+			}
+			_, isNew := n.parser.Parse(p, now)
+			if conn.DstIP.IsLoopback() && !n.allowLoopback {
+				isNew = false
+			}
+			t = &trace{conn: conn, new: isNew, seen: now}
+			n.traces[ev.id] = t
+		}
+	}
+	if t == nil {
+		// The packet was traced before we subscribed, or is not TCP
+		// nor UDP.
+		return
+	}
+
+	t.last = now
+	t.interfaces(ev)
+	if ev.mark != 0 {
+		t.mark = ev.mark
+	}
+	if v, ok := ev.terminal(); ok && t.verdict != entry.VerdictDrop {
+		t.verdict, t.rule, t.chain = v, ev.rule(), ev.chain
+		if v == entry.VerdictDrop {
+			// Nothing comes after a drop.
+			n.finish(ev.id, t)
+		}
+	}
+}
+
+// flush finishes the traces that got no event for settle.
+func (n *NFTrace) flush(now time.Time) {
+	for id, t := range n.traces {
+		if now.Sub(t.last) >= settle {
+			n.finish(id, t)
+		}
+	}
+}
+
+// finish forgets trace id, and queues the connection its packet started,
+// if any.
+func (n *NFTrace) finish(id uint32, t *trace) {
+	if n.traces[id] == t {
+		delete(n.traces, id)
+	}
+	if !t.new {
+		return
+	}
+
+	direction := t.direction()
+	ent := t.conn.Entry("nftrace", direction)
+	ent.Time = t.seen
+	ent.Mark = t.mark
+	ent.Rule, ent.Chain, ent.Verdict = t.rule, t.chain, t.verdict
+
+	var err error
+	switch direction {
+	case entry.Forward:
+		ent.Proc = procdetail.Unknown()
+		ent.SrcHost = &entry.Host{IP: ent.SrcIP}
+		if ifc, ierr := net.InterfaceByIndex(int(t.iif)); ierr == nil {
+			ent.SrcHost.Interface = ifc.Name
+		}
+	case entry.Ingress:
+		ent.Proc, err = procdetail.GetOwnerOfListener(t.conn.Protocol, t.conn.DstIP, t.conn.DstPort, t.seen)
+	default:
+		ent.Proc, err = procdetail.GetOwnerOfConnection(t.conn.Protocol, t.conn.SrcIP, t.conn.SrcPort, t.conn.DstIP, t.conn.DstPort, t.seen)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[nftrace] unable to get process: %v\n", err)
+	}
+
+	if !n.quiet {
+		by := ent.Proc.Name
+		if ent.SrcHost != nil {
+			by = "host " + ent.SrcHost.IP
+		}
+		fmt.Fprintf(os.Stderr, "[nftrace] new %s %s connection %s:%d -> %s:%d by %s: %s (%s)\n",
+			direction, ent.Protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort, by, ent.Verdict, ent.Rule)
+	}
+	n.ready = append(n.ready, ent)
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (n *NFTrace) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (n *NFTrace) SetOption(k, v string) error {
+	switch k {
+	case "table":
+		n.tables = append(n.tables, v)
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		n.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		n.quiet = b
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		n.flowIdle = d
+	default:
+		return fmt.Errorf("option %q unknown for nftrace input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("nftrace", &NFTrace{})
+}
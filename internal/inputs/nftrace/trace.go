@@ -0,0 +1,227 @@
+package nftrace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/google/gopacket"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netfilter verdicts (NF_DROP, NF_ACCEPT).
+const (
+	nfDrop   = 0
+	nfAccept = 1
+)
+
+// event is an nftables trace event (NFT_MSG_TRACE). A traced packet
+// generates one event per rule it matches and one when it falls off a base
+// chain (policy), all with the same id. Packet headers are only sent in
+// the first event of each base chain.
+type event struct {
+	id        uint32
+	typ       uint32
+	family    uint8
+	table     string
+	chain     string
+	handle    uint64
+	verdict   int32
+	policy    uint32
+	network   []byte
+	transport []byte
+	iif, oif  uint32
+	mark      uint32
+
+	hasVerdict, hasPolicy bool
+}
+
+// parseEvent parses the payload of an NFT_MSG_TRACE message: a nfgenmsg
+// header followed by NFTA_TRACE_* attributes (big endian).
+func parseEvent(data []byte) (event, error) {
+	var ev event
+	if len(data) < 4 {
+		return ev, fmt.Errorf("short message (%d bytes)", len(data))
+	}
+	ev.family = data[0]
+
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return ev, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_TRACE_ID:
+			ev.id = ad.Uint32()
+		case unix.NFTA_TRACE_TYPE:
+			ev.typ = ad.Uint32()
+		case unix.NFTA_TRACE_TABLE:
+			ev.table = ad.String()
+		case unix.NFTA_TRACE_CHAIN:
+			ev.chain = ad.String()
+		case unix.NFTA_TRACE_RULE_HANDLE:
+			ev.handle = ad.Uint64()
+		case unix.NFTA_TRACE_VERDICT:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == unix.NFTA_VERDICT_CODE {
+						ev.verdict = int32(nad.Uint32())
+						ev.hasVerdict = true
+					}
+				}
+				return nil
+			})
+		case unix.NFTA_TRACE_POLICY:
+			ev.policy = ad.Uint32()
+			ev.hasPolicy = true
+		case unix.NFTA_TRACE_NETWORK_HEADER:
+			ev.network = ad.Bytes()
+		case unix.NFTA_TRACE_TRANSPORT_HEADER:
+			ev.transport = ad.Bytes()
+		case unix.NFTA_TRACE_IIF:
+			ev.iif = ad.Uint32()
+		case unix.NFTA_TRACE_OIF:
+			ev.oif = ad.Uint32()
+		case unix.NFTA_TRACE_MARK:
+			ev.mark = ad.Uint32()
+		}
+	}
+	return ev, ad.Err()
+}
+
+// terminal returns the verdict event ends the packet traversal of a base
+// chain with (accept or drop), if any.
+func (ev event) terminal() (string, bool) {
+	code := int64(-1)
+	switch {
+	case ev.typ == unix.NFT_TRACETYPE_RULE && ev.hasVerdict:
+		code = int64(ev.verdict)
+	case ev.typ == unix.NFT_TRACETYPE_POLICY && ev.hasPolicy:
+		code = int64(ev.policy)
+	}
+	switch code {
+	case nfAccept:
+		return entry.VerdictAccept, true
+	case nfDrop:
+		return entry.VerdictDrop, true
+	}
+	return "", false
+}
+
+// rule returns the nft designation of the rule (or the chain policy) that
+// gave the verdict of ev.
+func (ev event) rule() string {
+	if ev.typ == unix.NFT_TRACETYPE_POLICY {
+		return fmt.Sprintf("%s %s %s policy", familyName(ev.family), ev.table, ev.chain)
+	}
+	return fmt.Sprintf("%s %s %s handle %d", familyName(ev.family), ev.table, ev.chain, ev.handle)
+}
+
+// familyName returns the nft name of an nfproto family.
+func familyName(f uint8) string {
+	switch f {
+	case unix.NFPROTO_INET:
+		return "inet"
+	case unix.NFPROTO_IPV4:
+		return "ip"
+	case unix.NFPROTO_IPV6:
+		return "ip6"
+	case unix.NFPROTO_ARP:
+		return "arp"
+	case unix.NFPROTO_BRIDGE:
+		return "bridge"
+	case unix.NFPROTO_NETDEV:
+		return "netdev"
+	}
+	return fmt.Sprintf("family-%d", f)
+}
+
+// decode decodes the packet headers of ev. The kernel sends at most 20
+// bytes of transport header, so TCP options are cut: the header is made
+// to claim no options so it still decodes.
+func (ev event) decode() (gopacket.Packet, packets.Conn, bool) {
+	if len(ev.network) == 0 {
+		return nil, packets.Conn{}, false
+	}
+
+	var etherType uint16
+	switch ev.network[0] >> 4 {
+	case 4:
+		etherType = packets.EtherTypeIPv4
+	case 6:
+		etherType = packets.EtherTypeIPv6
+	default:
+		return nil, packets.Conn{}, false
+	}
+
+	data := make([]byte, 0, len(ev.network)+len(ev.transport))
+	data = append(data, ev.network...)
+	data = append(data, ev.transport...)
+	if len(ev.transport) >= 20 && ipProtocol(ev.network) == unix.IPPROTO_TCP {
+		off := len(ev.network) + 12
+		data[off] = 5<<4 | data[off]&0x0f
+	}
+	return packets.Decode(etherType, data)
+}
+
+// ipProtocol returns the protocol of the IP header h (next header for IPv6,
+// which is the transport one for packets without extension headers).
+func ipProtocol(h []byte) uint8 {
+	switch {
+	case h[0]>>4 == 4 && len(h) >= 20:
+		return h[9]
+	case h[0]>>4 == 6 && len(h) >= 40:
+		return h[6]
+	}
+	return 0
+}
+
+// trace is what the events of a traced packet told so far.
+type trace struct {
+	conn    packets.Conn
+	new     bool // the packet starts a connection
+	seen    time.Time
+	last    time.Time
+	iif     uint32
+	oif     uint32
+	inFirst bool // received before being sent
+	mark    uint32
+	verdict string
+	rule    string
+	chain   string
+}
+
+// sameConn returns true if a and b have the same 5-tuple.
+func sameConn(a, b packets.Conn) bool {
+	return a.Protocol == b.Protocol && a.SrcIP.Equal(b.SrcIP) && a.DstIP.Equal(b.DstIP) &&
+		a.SrcPort == b.SrcPort && a.DstPort == b.DstPort
+}
+
+// interfaces records the interfaces ev says t's packet went through.
+func (t *trace) interfaces(ev event) {
+	if ev.iif != 0 && t.iif == 0 {
+		t.iif = ev.iif
+		t.inFirst = t.oif == 0
+	}
+	if ev.oif != 0 && t.oif == 0 {
+		t.oif = ev.oif
+	}
+}
+
+// direction returns the direction of the connection started by t's packet,
+// from the interfaces it went through: ingress if it was only received,
+// forward if it was received then sent, egress if it was sent first
+// (including packets to a local address, sent then received on lo).
+func (t *trace) direction() string {
+	switch {
+	case t.inFirst && t.oif != 0:
+		return entry.Forward
+	case t.inFirst:
+		return entry.Ingress
+	}
+	return entry.Egress
+}
@@ -0,0 +1,276 @@
+// Package pcap implements an input reading connections from pcap and
+// pcapng capture files, for hosts where egress-auditor can not run.
+// Processes are not known and reported as "unknown".
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/internal/packets"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the block type of the section header starting pcapng
+// files (the same in both byte orders).
+const pcapngMagic = 0x0A0D0D0A
+
+// Input reads connections from capture files
+type Input struct {
+	files         []string
+	local         []*net.IPNet
+	allowLoopback bool
+	quiet         bool
+	dns           bool
+	gateway       bool
+	flowIdle      time.Duration
+}
+
+// Description returns a description for the module, including the available
+// options
+func (in *Input) Description() string {
+	return `
+	pcap file reader
+	Reads TCP SYNs and new UDP flows from pcap or pcapng files (Ethernet,
+	Linux cooked or raw IP captures). Processes can not be known and are
+	reported as "unknown".
+
+	Without local addresses, every connection is reported as egress. With
+	local addresses, connections from a local address are egress,
+	connections to a local address are ingress, and others are ignored,
+	unless gateway is set.
+
+	Options:
+		- "pcap:file:<path>": capture file to read; may be specified
+		    multiple times, files are read in order
+		- "pcap:local:<CIDR|IP>": address (or network) of the captured host;
+		    may be specified multiple times
+		- "pcap:dns:<false|true>": annotate connections with the name their
+		    destination was resolved from, using DNS answers in the capture
+		- "pcap:gateway:<false|true>": the capture was taken on a gateway;
+		    connections that are neither from nor to a local address (all
+		    of them, without local addresses) are reported as forwarded,
+		    attributed to their source address and MAC address
+		- "pcap:allow-loopback:<false|true>": include loopback traffic
+		- "pcap:quiet:<false|true>": suppress per-connection messages on stderr
+		- "pcap:udp-idle-timeout:<duration>": idle time, in capture time,
+		    after which a UDP flow ends (default 30s), see "UDP flows" in the
+		    README
+
+	Example:
+		egress-auditor -i pcap -I pcap:file:appliance.pcapng \
+		    -I pcap:local:192.0.2.10 -o iptables
+	`
+}
+
+// Process reads the capture files and sends connections found to c
+func (in *Input) Process(ctx context.Context, c chan<- entry.Connection) {
+	parser := packets.NewParser(in.flowIdle, in.dns)
+	for _, name := range in.files {
+		if ctx.Err() != nil {
+			return
+		}
+		n, err := in.read(ctx, name, parser, c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[pcap] error reading %s: %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "[pcap] %s: %d connections\n", name, n)
+	}
+}
+
+// packetReader is implemented by pcapgo.Reader and pcapgo.NgReader.
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// read reads connections from capture file name and returns how many were
+// sent to c.
+func (in *Input) read(ctx context.Context, name string, parser *packets.Parser, c chan<- entry.Connection) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return 0, fmt.Errorf("not a capture file")
+	}
+
+	var (
+		r        packetReader
+		linkType func(gopacket.CaptureInfo) layers.LinkType
+	)
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return 0, err
+		}
+		r = ng
+		// pcapng files may mix interfaces of different types.
+		linkType = func(ci gopacket.CaptureInfo) layers.LinkType {
+			if ifc, err := ng.Interface(ci.InterfaceIndex); err == nil {
+				return ifc.LinkType
+			}
+			return ng.LinkType()
+		}
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		r = pr
+		linkType = func(gopacket.CaptureInfo) layers.LinkType { return pr.LinkType() }
+	}
+
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count, nil
+		}
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		p := gopacket.NewPacket(data, linkType(ci), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		conn, ok := parser.Parse(p, ci.Timestamp)
+		if !ok {
+			continue
+		}
+		if conn.DstIP.IsLoopback() && !in.allowLoopback {
+			continue
+		}
+
+		direction, ok := in.direction(conn)
+		if !ok {
+			continue
+		}
+
+		ent := conn.Entry("pcap", direction)
+		ent.Proc = procdetail.Unknown()
+		ent.Time = ci.Timestamp
+		if direction != entry.Ingress {
+			ent.DestHost = parser.Host(conn, ci.Timestamp)
+		}
+		if direction == entry.Forward {
+			ent.SrcHost = &entry.Host{IP: conn.SrcIP.String()}
+			if eth, ok := p.LinkLayer().(*layers.Ethernet); ok {
+				ent.SrcHost.MAC = eth.SrcMAC.String()
+			}
+		}
+
+		if !in.quiet {
+			fmt.Fprintf(os.Stderr, "[pcap] %s %s %s connection %s:%d -> %s:%d\n",
+				ci.Timestamp.Format(time.RFC3339), direction, conn.Protocol, conn.SrcIP, conn.SrcPort, conn.DstIP, conn.DstPort)
+		}
+
+		select {
+		case c <- ent:
+			count++
+		case <-ctx.Done():
+			return count, nil
+		}
+	}
+}
+
+// direction classifies conn using the local addresses. It returns false
+// for connections between two remote hosts, unless in gateway mode.
+func (in *Input) direction(conn packets.Conn) (string, bool) {
+	switch {
+	case in.isLocal(conn.SrcIP):
+		return entry.Egress, true
+	case in.isLocal(conn.DstIP):
+		return entry.Ingress, true
+	case in.gateway:
+		return entry.Forward, true
+	case len(in.local) == 0:
+		return entry.Egress, true
+	}
+	return "", false
+}
+
+func (in *Input) isLocal(ip net.IP) bool {
+	for _, n := range in.local {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (in *Input) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (in *Input) SetOption(k, v string) error {
+	switch k {
+	case "file":
+		in.files = append(in.files, v)
+	case "local":
+		n, err := packets.ParseNet(v)
+		if err != nil {
+			return err
+		}
+		in.local = append(in.local, n)
+	case "dns":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.dns = b
+	case "gateway":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.gateway = b
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		in.quiet = b
+	case "udp-idle-timeout":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("udp-idle-timeout must be positive")
+		}
+		in.flowIdle = d
+	default:
+		return fmt.Errorf("option %q unknown for pcap input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("pcap", &Input{})
+}
@@ -0,0 +1,86 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+// testdata/dns.pcap holds, seen from 192.0.2.10: a DNS query for
+// www.example.com and its answer, a TCP handshake with the address in the
+// answer, and 40s later a query from another port answered twice.
+func TestRead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts [][2]string
+		want []string
+	}{
+		{
+			name: "no local address",
+			want: []string{
+				"egress udp 192.0.2.10:53001 -> 198.51.100.53:53",
+				"egress tcp 192.0.2.10:41000 -> 203.0.113.80:443",
+				"egress udp 192.0.2.10:53002 -> 198.51.100.53:53",
+			},
+		},
+		{
+			name: "local address",
+			opts: [][2]string{{"local", "192.0.2.10"}},
+			want: []string{
+				"egress udp 192.0.2.10:53001 -> 198.51.100.53:53",
+				"egress tcp 192.0.2.10:41000 -> 203.0.113.80:443",
+				"egress udp 192.0.2.10:53002 -> 198.51.100.53:53",
+			},
+		},
+		{
+			name: "remote local address",
+			opts: [][2]string{{"local", "198.51.100.0/24"}},
+			want: []string{
+				"ingress udp 192.0.2.10:53001 -> 198.51.100.53:53",
+				"ingress udp 192.0.2.10:53002 -> 198.51.100.53:53",
+			},
+		},
+		{
+			// Answers are consumed to name destinations.
+			name: "dns",
+			opts: [][2]string{{"dns", "true"}},
+			want: []string{
+				"egress udp 192.0.2.10:53001 -> 198.51.100.53:53",
+				"egress tcp 192.0.2.10:41000 -> 203.0.113.80:443 (www.example.com)",
+				"egress udp 192.0.2.10:53002 -> 198.51.100.53:53",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			in := &Input{}
+			opts := append([][2]string{{"file", "testdata/dns.pcap"}, {"quiet", "true"}}, tc.opts...)
+			for _, o := range opts {
+				if err := in.SetOption(o[0], o[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := make(chan entry.Connection, 10)
+			in.Process(context.Background(), c)
+			close(c)
+
+			var got []string
+			for ent := range c {
+				s := fmt.Sprintf("%s %s %s:%d -> %s:%d", ent.Direction, ent.Protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort)
+				if ent.DestHost != "" {
+					s += " (" + ent.DestHost + ")"
+				}
+				got = append(got, s)
+				if ent.Protocol == "udp" && (ent.Flow == nil || ent.Flow.Packets != 1) {
+					t.Errorf("%s: got flow %+v, want its first packet", s, ent.Flow)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
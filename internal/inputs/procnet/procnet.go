@@ -0,0 +1,281 @@
+// Package procnet implements an input polling the socket tables in
+// /proc/net, for environments where netlink, eBPF and iptables are all
+// unavailable (unprivileged containers, locked-down hosts).
+package procnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cakturk/go-netstat/netstat"
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/inputs"
+	"github.com/devops-works/egress-auditor/pkg/procdetail"
+)
+
+// ProcNet polls /proc/net/{tcp,udp}{,6} for new sockets
+type ProcNet struct {
+	interval      time.Duration
+	initial       bool
+	ingress       bool
+	allowLoopback bool
+	quiet         bool
+
+	// seen holds the keys of the sockets of the previous poll.
+	seen map[string]bool
+}
+
+// table is a socket table and the protocol it holds.
+type table struct {
+	protocol string
+	socks    func(netstat.AcceptFn) ([]netstat.SockTabEntry, error)
+}
+
+var tables = []table{
+	{"tcp", netstat.TCPSocks},
+	{"tcp", netstat.TCP6Socks},
+	{"udp", netstat.UDPSocks},
+	{"udp", netstat.UDP6Socks},
+}
+
+// Description returns a description for the module, including the available
+// options
+func (p *ProcNet) Description() string {
+	return `
+	/proc/net poller
+	Polls /proc/net/tcp, tcp6, udp and udp6 and reports sockets that
+	appeared since the previous poll: TCP connections initiated by this
+	host (connecting or established from a port nobody listens on) and
+	connected UDP sockets. Owners are found by matching socket inodes in
+	/proc/<pid>/fd, or reported by uid when the process can not be read.
+	Needs no privilege, netlink, eBPF nor iptables.
+
+	This is sampling: connections opened and closed between two polls are
+	missed, and so is UDP sent without connect(2) (sendto on an unconnected
+	socket, as many DNS clients do).
+
+	Options:
+		- "procnet:interval:<duration>": time between polls (default 1s);
+		    every poll reads all /proc/<pid>/fd links
+		- "procnet:initial:<true|false>": report connections already open
+		    at startup (default true)
+		- "procnet:ingress:<false|true>": also report TCP connections
+		    accepted on listening sockets
+		- "procnet:allow-loopback:<false|true>": include loopback traffic
+		- "procnet:quiet:<false|true>": suppress per-connection messages on stderr
+
+	Example:
+		egress-auditor -i procnet -I procnet:interval:500ms -o logfmt
+	`
+}
+
+// Process polls the socket tables until ctx is cancelled
+func (p *ProcNet) Process(ctx context.Context, c chan<- entry.Connection) {
+	if p.interval == 0 {
+		p.interval = time.Second
+	}
+
+	report := p.initial
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		conns, err := p.poll()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[procnet] error reading socket tables: %v\n", err)
+		}
+		if report {
+			for _, conn := range conns {
+				select {
+				case c <- conn:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		report = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// poll reads the socket tables and returns the connections that were not
+// there on the previous poll.
+func (p *ProcNet) poll() ([]entry.Connection, error) {
+	type sock struct {
+		protocol string
+		netstat.SockTabEntry
+	}
+
+	var (
+		fresh   []sock
+		current = make(map[string]bool)
+		// Listening sockets, by address and port, and by port for
+		// sockets bound to the wildcard address.
+		listenAddr = make(map[string]bool)
+		listenAny  = make(map[uint16]bool)
+	)
+	for _, tab := range tables {
+		// Owners are only resolved for accepted entries, so only accept
+		// new ones.
+		entries, err := tab.socks(func(s *netstat.SockTabEntry) bool {
+			if s.State == netstat.Listen {
+				listenAddr[s.LocalAddr.String()] = true
+				if s.LocalAddr.IP.IsUnspecified() {
+					listenAny[s.LocalAddr.Port] = true
+				}
+				return false
+			}
+			if !interesting(tab.protocol, s) {
+				return false
+			}
+			k := key(tab.protocol, s)
+			current[k] = true
+			return !p.seen[k]
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			fresh = append(fresh, sock{tab.protocol, e})
+		}
+	}
+	p.seen = current
+
+	var conns []entry.Connection
+	for _, s := range fresh {
+		direction := entry.Egress
+		if s.protocol == "tcp" && s.State != netstat.SynSent &&
+			(listenAddr[s.LocalAddr.String()] || listenAny[s.LocalAddr.Port]) {
+			direction = entry.Ingress
+		}
+		if direction == entry.Ingress && !p.ingress {
+			continue
+		}
+		if conn, ok := p.entry(s.protocol, direction, s.SockTabEntry); ok {
+			conns = append(conns, conn)
+		}
+	}
+	return conns, nil
+}
+
+// interesting returns true for sockets that may be connections: TCP
+// sockets connecting or established, connected UDP sockets.
+func interesting(protocol string, s *netstat.SockTabEntry) bool {
+	if protocol == "udp" {
+		return s.RemoteAddr.Port != 0
+	}
+	return s.State == netstat.Established || s.State == netstat.SynSent
+}
+
+// key identifies a socket across polls.
+func key(protocol string, s *netstat.SockTabEntry) string {
+	return protocol + " " + s.LocalAddr.String() + " " + s.RemoteAddr.String()
+}
+
+// entry returns the connection for socket s, or false if it is filtered
+// out.
+func (p *ProcNet) entry(protocol, direction string, s netstat.SockTabEntry) (entry.Connection, bool) {
+	local, remote := unmap(s.LocalAddr.IP), unmap(s.RemoteAddr.IP)
+	if remote.IsLoopback() && !p.allowLoopback {
+		return entry.Connection{}, false
+	}
+
+	ent := entry.Connection{
+		Hook:      "procnet",
+		Direction: direction,
+		Protocol:  protocol,
+		SrcIP:     local.String(),
+		SrcPort:   s.LocalAddr.Port,
+		DestIP:    remote.String(),
+		DestPort:  s.RemoteAddr.Port,
+		IPv:       6,
+	}
+	if direction == entry.Ingress {
+		ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort = ent.DestIP, ent.DestPort, ent.SrcIP, ent.SrcPort
+	}
+	if remote.To4() != nil {
+		ent.IPv = 4
+	}
+
+	// /proc/<pid>/fd of other users can not be read without privileges;
+	// the table still tells the socket owner uid.
+	ent.Proc = procdetail.ForUser(s.UID)
+	if s.Process != nil {
+		if proc, err := procdetail.New(int32(s.Process.Pid)); err == nil {
+			ent.Proc = proc
+		}
+	}
+
+	if !p.quiet {
+		fmt.Fprintf(os.Stderr, "[procnet] new %s %s connection %s:%d -> %s:%d by %s (%s)\n",
+			direction, protocol, ent.SrcIP, ent.SrcPort, ent.DestIP, ent.DestPort, ent.Proc.Name, ent.Proc.User)
+	}
+	return ent, true
+}
+
+// unmap returns IPv4-mapped IPv6 addresses as IPv4.
+func unmap(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Cleanup any stuff that needs to be sorted out before exiting
+func (p *ProcNet) Cleanup() {
+}
+
+// SetOption let caller set specific module suboptions
+func (p *ProcNet) SetOption(k, v string) error {
+	switch k {
+	case "interval":
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("interval must be positive")
+		}
+		p.interval = d
+	case "initial":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		p.initial = b
+	case "ingress":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		p.ingress = b
+	case "allow-loopback":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		p.allowLoopback = b
+	case "quiet":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		p.quiet = b
+	default:
+		return fmt.Errorf("option %q unknown for procnet input", k)
+	}
+	return nil
+}
+
+func init() {
+	// register in inputs
+	inputs.Add("procnet", &ProcNet{initial: true})
+}
@@ -19,6 +19,8 @@ type IPTHandler struct {
 	tpl       *template.Template
 	entries   map[string]entry.Connection
 	verbosity int
+	bySource  bool
+	byCgroup  bool
 }
 
 func (e *IPTHandler) prepare() error {
@@ -26,23 +28,84 @@ func (e *IPTHandler) prepare() error {
 
 	e.entries = make(map[string]entry.Connection)
 
+	rule := `{{ define "cmd" }}ip{{ if eq .IPv 6 }}6{{ end }}tables {{ if .IsForward }}-A FORWARD -s {{ .SrcIP }} -d {{ .DestIP }}{{ else if .IsIngress }}-A INPUT{{ if source }} -s {{ .SrcIP }}{{ end }}{{ else }}-I OUTPUT{{ with cgroup . }} -m cgroup --path "{{ . }}"{{ end }} -d {{ .DestIP }}{{ end }}{{ match . }} -j ACCEPT -m comment --comment "{{ if .IsForward }}{{ .SrcHost.Label }}{{ else }}{{ .Proc.Name }}{{ end }}"{{ end }}`
+
+	// Forwarded connections are attributed to their source host rather
+	// than to a process.
+	who := `{{ define "who" }}{{ if .IsForward }}host {{ with .SrcHost }}{{ if .Name }}{{ .Name }} ({{ .IP }}){{ else }}{{ .IP }}{{ end }}{{ if .MAC }} [{{ .MAC }}{{ if .Interface }} on {{ .Interface }}{{ end }}]{{ end }}{{ end }}{{ else }}{{ .Proc.Name }} running as {{ .Proc.User }}{{ with .Proc.Cgroup }}{{ if .ContainerID }} in {{ with .Runtime }}{{ . }} {{ end }}container {{ with $.Container }}{{ .Name }} ({{ .Image }}){{ else }}{{ .ShortID }}{{ end }}{{ with .PodUID }}{{ if not $.Pod }} of pod {{ . }}{{ end }}{{ end }}{{ else if .Unit }} in {{ .Unit }}{{ end }}{{ end }}{{ end }}{{ with .Pod }} in pod {{ . }}{{ with .Owner }} ({{ . }}){{ end }}{{ end }}{{ end }}`
+
+	host := `{{ if .IsIngress }}
+# [{{ .Hook }}] Inbound connection to port {{ .DestPort }} accepted from {{ .SrcIP }}{{ if not source }} (and maybe others){{ end }}{{ else }}{{ if .DestHost }}
+# [{{ .Hook }}] Destination {{ .DestIP }} was resolved from {{ .DestHost }}{{ end }}{{ with .DestService }}
+# [{{ $.Hook }}] Destination {{ $.DestIP }} is service {{ . }}{{ else }}{{ with .DestPod }}
+# [{{ $.Hook }}] Destination {{ $.DestIP }} is pod {{ . }}{{ end }}{{ end }}{{ end }}`
+
 	templates := []string{
-		`ip{{ if eq .IPv 6 }}6{{ end }}tables -I OUTPUT -d {{ .DestIP }} -p {{ .Protocol }} -m {{ .Protocol }} --dport {{ .DestPort }} -j ACCEPT -m comment --comment "{{ .Proc.Name }}"`,
-		`# [{{ .Hook }}] Line generated for {{ .Proc.Name }} running as {{ .Proc.User }}"
-ip{{ if eq .IPv 6 }}6{{ end }}tables -I OUTPUT -d {{ .DestIP }} -p {{ .Protocol }} -m {{ .Protocol }} --dport {{ .DestPort }} -j ACCEPT -m comment --comment "{{ .Proc.Name }}"`,
-		`# [{{ .Hook }}] Line generated for {{ .Proc.Name }} running as {{ .Proc.User }} with command "{{ .Proc.CmdLine }}"
-# [{{ .Hook }}] Parent of this process was {{ .Proc.Parent.Name }} running as {{ .Proc.Parent.User }}{{ if .Proc.Parent.Parent }}
-# [{{ .Hook }}] Grandparent of this process was {{ .Proc.Parent.Parent.Name }} running as {{ .Proc.Parent.Parent.User }}{{ end }}
-ip{{ if eq .IPv 6 }}6{{ end }}tables -I OUTPUT -d {{ .DestIP }} -p {{ .Protocol }} -m {{ .Protocol }} --dport {{ .DestPort }} -j ACCEPT -m comment --comment "{{ .Proc.Name }}"`,
+		`{{ template "cmd" . }}`,
+		`# [{{ .Hook }}] Line generated for {{ template "who" . }}` + host + `
+{{ template "cmd" . }}`,
+		`# [{{ .Hook }}] Line generated for {{ template "who" . }}{{ if not .IsForward }} with command "{{ .Proc.CmdLine }}"{{ range $i, $p := .Proc.Ancestry }}
+# [{{ $.Hook }}] {{ ancestor $i }} of this process was {{ $p.Name }} running as {{ $p.User }}{{ end }}{{ end }}` + host + `
+{{ template "cmd" . }}`,
 	}
 
-	e.tpl, err = template.New("rule").Parse(templates[e.verbosity])
+	e.tpl, err = template.New("rule").Funcs(template.FuncMap{
+		"match":    match,
+		"source":   func() bool { return e.bySource },
+		"ancestor": ancestor,
+		"cgroup":   e.cgroup,
+	}).Parse(rule + who + templates[e.verbosity])
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// cgroup returns the cgroup path egress rules for c match on with the
+// cgroup option, or "". The cgroup match only knows cgroup v2 paths.
+func (e *IPTHandler) cgroup(c entry.Connection) string {
+	if !e.byCgroup || c.Proc == nil || c.Proc.Cgroup == nil || !c.Proc.Cgroup.Unified || c.Proc.Cgroup.Path == "/" {
+		return ""
+	}
+	return c.Proc.Cgroup.Path
+}
+
+// ancestor names the ancestor of a process at index i of its ancestry.
+func ancestor(i int) string {
+	switch i {
+	case 0:
+		return "Parent"
+	case 1:
+		return "Grandparent"
+	}
+	return fmt.Sprintf("Ancestor %d", i+1)
+}
+
+// match returns the protocol and port match part of a rule for c.
+func match(c entry.Connection) string {
+	var proto string
+	switch c.Protocol {
+	case "raw", "ip":
+		// Protocol is chosen by the sender, or not known; only the
+		// destination can be matched.
+		return ""
+	case "icmp":
+		if c.IPv == 6 {
+			return " -p ipv6-icmp"
+		}
+		return " -p icmp"
+	case "icmpv6":
+		return " -p ipv6-icmp"
+	default:
+		proto = c.Protocol
+	}
+
+	if c.DestPort == 0 {
+		return " -p " + proto
+	}
+	return fmt.Sprintf(" -p %s -m %s --dport %d", proto, proto, c.DestPort)
+}
+
 // Description returns a description for the module, including the available
 // options
 func (e *IPTHandler) Description() string {
@@ -55,8 +118,23 @@ func (e *IPTHandler) Description() string {
 	Options:
 		- "iptables:verbose:<LVL>": sets verbosity for generated rules (0, 1 or 2)
 		     0: no comments, only the iptable command
-		     1: comments including process name and process user that triggered the connection
-		     2: like above but with parent process information
+		     1: comments including process name and process user that triggered the connection,
+		        its container, Kubernetes pod or systemd unit,
+		        the name the destination was resolved from when the input captured DNS,
+		        and the Kubernetes service or pod it belongs to
+		     2: like above but with the command line and the ancestors of the
+		        process (see --ancestry-depth)
+		- "iptables:ingress-by-source:<false|true>": inbound connections
+		     (direction=ingress) generate "-A INPUT" rules for the local port
+		     they were accepted on; with this option, one rule per remote
+		     source address is generated instead of one for any source
+		- "iptables:cgroup:<false|true>": outbound connections generate rules
+		     matching the cgroup (v2) of their process with
+		     "-m cgroup --path", one per cgroup: a container, pod or
+		     systemd service
+
+	Forwarded connections (direction=forward, gateway mode) generate
+	"-A FORWARD" rules for their source and destination addresses.
 
 	Example:
 		egress-auditor -i ... -o iptables -O iptables:verbose:1
@@ -75,8 +153,11 @@ func (e *IPTHandler) Process(ctx context.Context, c <-chan entry.Connection) {
 		case <-ctx.Done():
 			fmt.Println("terminating capture")
 			return
-		case ent := <-c:
-			key := fmt.Sprintf("%s:%d", ent.DestIP, ent.DestPort)
+		case ent, ok := <-c:
+			if !ok {
+				return
+			}
+			key := e.key(ent)
 			if _, ok := e.entries[key]; !ok {
 				e.Lock()
 				e.entries[key] = ent
@@ -86,6 +167,24 @@ func (e *IPTHandler) Process(ctx context.Context, c <-chan entry.Connection) {
 	}
 }
 
+// key returns the deduplication key of c: one rule is generated per key.
+// Inbound connections come from many peers, so unless bySource is set they
+// are grouped on the local port only. Forwarded connections are keyed on
+// their source too, and outbound ones on their cgroup with the cgroup
+// option.
+func (e *IPTHandler) key(c entry.Connection) string {
+	if c.IsForward() {
+		return fmt.Sprintf("fwd:%s:%s:%s:%d", c.Protocol, c.SrcIP, c.DestIP, c.DestPort)
+	}
+	if c.IsIngress() {
+		if e.bySource {
+			return fmt.Sprintf("in:%s:%s:%d", c.Protocol, c.SrcIP, c.DestPort)
+		}
+		return fmt.Sprintf("in:%s:%d:%d", c.Protocol, c.IPv, c.DestPort)
+	}
+	return fmt.Sprintf("%s:%s:%d:%s", c.Protocol, c.DestIP, c.DestPort, e.cgroup(c))
+}
+
 // generate iptable rules
 func (e *IPTHandler) generate() [][]byte {
 	e.Lock()
@@ -125,6 +224,18 @@ func (e *IPTHandler) SetOption(k, v string) error {
 			return fmt.Errorf("wrong verbosity %d; verbosity must be between 0 and 2 included", g)
 		}
 		e.verbosity = g
+	case "ingress-by-source":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		e.bySource = b
+	case "cgroup":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		e.byCgroup = b
 	default:
 		return fmt.Errorf("option %q unknow for iptables output", k)
 	}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,6 +34,8 @@ func (o *Output) Description() string {
 	Prints connections in logfmt format (one line per connection).
 	Output goes to stdout by default, or to a file if specified.
 	When writing to a file, SIGHUP causes the file to be reopened (for logrotate compatibility).
+	The ancestry field holds all the ancestors of the process, parent first
+	(see --ancestry-depth).
 
 	Options:
 		- "logfmt:file:<path>": write output to file instead of stdout
@@ -65,7 +69,10 @@ func (o *Output) Process(ctx context.Context, c <-chan entry.Connection) {
 			} else {
 				fmt.Fprintf(os.Stderr, "[logfmt] file reopened after SIGHUP\n")
 			}
-		case ent := <-c:
+		case ent, ok := <-c:
+			if !ok {
+				return
+			}
 			o.print(ent)
 		}
 	}
@@ -81,30 +88,103 @@ func quoteIfNeeded(s string) string {
 func (o *Output) print(e entry.Connection) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	grandparent := e.Proc.Parent.Parent
-	if grandparent == nil {
-		grandparent = &procdetail.ProcessDetail{Name: "unknown", User: "unknown"}
+	ancestry := e.Proc.Ancestry()
+	for len(ancestry) < 2 {
+		ancestry = append(ancestry, &procdetail.ProcessDetail{Name: "unknown", User: "unknown"})
+	}
+	parent, grandparent := ancestry[0], ancestry[1]
+	direction := e.Direction
+	if direction == "" {
+		direction = entry.Egress
+	}
+	var cgroup, containerID, runtime, podUID, unit string
+	if cg := e.Proc.Cgroup; cg != nil {
+		cgroup, containerID, runtime, podUID, unit = cg.Path, cg.ContainerID, cg.Runtime, cg.PodUID, cg.Unit
+	}
+	var containerName, image, imageDigest string
+	if e.Container != nil {
+		containerName, image, imageDigest = e.Container.Name, e.Container.Image, e.Container.ImageDigest
+	}
+	var pod, podOwner, serviceAccount, destService, destPod string
+	if e.Pod != nil {
+		pod, podOwner, serviceAccount = e.Pod.String(), e.Pod.Owner, e.Pod.ServiceAccount
+	}
+	if e.DestService != nil {
+		destService = e.DestService.String()
+	}
+	if e.DestPod != nil {
+		destPod = e.DestPod.String()
 	}
-	fmt.Fprintf(o.w, "ts=%s hook=%s protocol=%s dest_ip=%s dest_port=%d ip_version=%d proc_name=%s proc_pid=%d proc_user=%s proc_cmdline=%s parent_name=%s parent_pid=%d parent_user=%s grandparent_name=%s grandparent_pid=%d grandparent_user=%s\n",
-		time.Now().UTC().Format(time.RFC3339),
+	var srcMAC, srcIface, srcName string
+	if e.SrcHost != nil {
+		srcMAC, srcIface, srcName = e.SrcHost.MAC, e.SrcHost.Interface, e.SrcHost.Name
+	}
+	var natSrc, natDest string
+	if e.NAT != nil {
+		natSrc = net.JoinHostPort(e.NAT.SrcIP, strconv.Itoa(int(e.NAT.SrcPort)))
+		natDest = net.JoinHostPort(e.NAT.DestIP, strconv.Itoa(int(e.NAT.DestPort)))
+	}
+	fmt.Fprintf(o.w, "ts=%s hook=%s direction=%s protocol=%s src_ip=%s src_port=%d dest_ip=%s dest_host=%s dest_port=%d ip_version=%d proc_name=%s proc_pid=%d proc_user=%s proc_login_user=%s proc_cmdline=%s parent_name=%s parent_pid=%d parent_user=%s grandparent_name=%s grandparent_pid=%d grandparent_user=%s ancestry=%s cgroup=%s container_id=%s container_runtime=%s pod_uid=%s unit=%s container_name=%s container_image=%s image_digest=%s pod=%s pod_owner=%s service_account=%s dest_service=%s dest_pod=%s verdict=%s nat_src=%s nat_dest=%s mark=%d rule=%s chain=%s src_mac=%s src_iface=%s src_name=%s\n",
+		e.Timestamp().UTC().Format(time.RFC3339),
 		e.Hook,
+		direction,
 		e.Protocol,
+		e.SrcIP,
+		e.SrcPort,
 		e.DestIP,
+		quoteIfNeeded(e.DestHost),
 		e.DestPort,
 		e.IPv,
 		quoteIfNeeded(e.Proc.Name),
 		e.Proc.Pid,
 		quoteIfNeeded(e.Proc.User),
+		quoteIfNeeded(e.Proc.LoginUser),
 		quoteIfNeeded(e.Proc.CmdLine),
-		quoteIfNeeded(e.Proc.Parent.Name),
-		e.Proc.Parent.Pid,
-		quoteIfNeeded(e.Proc.Parent.User),
+		quoteIfNeeded(parent.Name),
+		parent.Pid,
+		quoteIfNeeded(parent.User),
 		quoteIfNeeded(grandparent.Name),
 		grandparent.Pid,
 		quoteIfNeeded(grandparent.User),
+		quoteIfNeeded(formatAncestry(e.Proc)),
+		quoteIfNeeded(cgroup),
+		containerID,
+		runtime,
+		podUID,
+		quoteIfNeeded(unit),
+		quoteIfNeeded(containerName),
+		quoteIfNeeded(image),
+		imageDigest,
+		pod,
+		podOwner,
+		serviceAccount,
+		destService,
+		destPod,
+		e.Verdict,
+		natSrc,
+		natDest,
+		e.Mark,
+		quoteIfNeeded(e.Rule),
+		e.Chain,
+		srcMAC,
+		quoteIfNeeded(srcIface),
+		quoteIfNeeded(srcName),
 	)
 }
 
+// formatAncestry returns the ancestors of p, parent first, as
+// "name[pid]" separated by "<", e.g. "sh[4240]<runc[4200]<systemd[1]".
+func formatAncestry(p *procdetail.ProcessDetail) string {
+	var b strings.Builder
+	for i, a := range p.Ancestry() {
+		if i > 0 {
+			b.WriteByte('<')
+		}
+		fmt.Fprintf(&b, "%s[%d]", a.Name, a.Pid)
+	}
+	return b.String()
+}
+
 func (o *Output) reopen() error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/devops-works/egress-auditor/internal/entry"
 	"github.com/devops-works/egress-auditor/internal/outputs"
@@ -22,6 +21,74 @@ type Output struct {
 	pass   string
 	xorgid string
 	labels map[string]string
+	fields []string
+}
+
+// labelFields are the connection fields that can be used as labels. They
+// must have few distinct values: every combination is a Loki stream.
+var labelFields = map[string]func(e entry.Connection) string{
+	"hook":      func(e entry.Connection) string { return e.Hook },
+	"direction": func(e entry.Connection) string { return e.Direction },
+	"protocol":  func(e entry.Connection) string { return e.Protocol },
+	"rule":      func(e entry.Connection) string { return e.Rule },
+	"chain":     func(e entry.Connection) string { return e.Chain },
+	"verdict":   func(e entry.Connection) string { return e.Verdict },
+	"process":   func(e entry.Connection) string { return e.Proc.Name },
+	"user":      func(e entry.Connection) string { return e.Proc.User },
+	"container": func(e entry.Connection) string {
+		if e.Proc.Cgroup == nil {
+			return ""
+		}
+		return e.Proc.Cgroup.ShortID()
+	},
+	"container_name": func(e entry.Connection) string {
+		if e.Container == nil {
+			return ""
+		}
+		return e.Container.Name
+	},
+	"image": func(e entry.Connection) string {
+		if e.Container == nil {
+			return ""
+		}
+		return e.Container.Image
+	},
+	"namespace": func(e entry.Connection) string {
+		if e.Pod == nil {
+			return ""
+		}
+		return e.Pod.Namespace
+	},
+	"owner": func(e entry.Connection) string {
+		if e.Pod == nil {
+			return ""
+		}
+		return e.Pod.Owner
+	},
+	"dest_service": func(e entry.Connection) string {
+		if e.DestService == nil {
+			return ""
+		}
+		return e.DestService.String()
+	},
+	"pod_uid": func(e entry.Connection) string {
+		if e.Proc.Cgroup == nil {
+			return ""
+		}
+		return e.Proc.Cgroup.PodUID
+	},
+	"unit": func(e entry.Connection) string {
+		if e.Proc.Cgroup == nil {
+			return ""
+		}
+		return e.Proc.Cgroup.Unit
+	},
+	"src_host": func(e entry.Connection) string {
+		if e.SrcHost == nil {
+			return ""
+		}
+		return e.SrcHost.Name
+	},
 }
 
 // Description returns a description for the module, including the available
@@ -38,6 +105,12 @@ func (l *Output) Description() string {
 		- "loki:pass:<str>": loki password for basic auth
 		- "loki:orgid:<id>": X-Org-ID header to add to loki queries (e.g. tenant)
 		- "loki:labels:<key>=<value>[,<key>=<value>...]": additional labels for log entries
+		- "loki:label-fields:<field>[,<field>...]": connection fields added as
+		    labels to each entry: hook, direction, protocol, rule, chain,
+		    verdict, process, user, container (short id), container_name,
+		    image, namespace and owner (of the pod), dest_service, pod_uid,
+		    unit (systemd), src_host (name). Each combination of values is a stream;
+		    avoid high cardinality fields on busy hosts
 
 	Example:
 		egress-auditor -i ... -o loki -O loki:url:http://localhost:3100
@@ -51,7 +124,10 @@ func (l *Output) Process(ctx context.Context, c <-chan entry.Connection) {
 		case <-ctx.Done():
 			fmt.Println("terminating capture")
 			return
-		case ent := <-c:
+		case ent, ok := <-c:
+			if !ok {
+				return
+			}
 			l.sendLog(ent)
 		}
 	}
@@ -75,10 +151,21 @@ func (l *Output) sendLog(e entry.Connection) {
 		return
 	}
 
+	labels := make(map[string]string, len(l.labels)+len(l.fields)+1)
+	for k, v := range l.labels {
+		labels[k] = v
+	}
+	for _, f := range l.fields {
+		// Loki rejects empty label values.
+		if v := labelFields[f](e); v != "" {
+			labels[f] = v
+		}
+	}
+
 	ls := lokiStream{
-		Stream: l.labels,
+		Stream: labels,
 		Values: [][]string{
-			{fmt.Sprintf("%d", time.Now().UTC().UnixNano()), string(jsonMessage)},
+			{fmt.Sprintf("%d", e.Timestamp().UTC().UnixNano()), string(jsonMessage)},
 		},
 	}
 
@@ -159,6 +246,13 @@ func (l *Output) SetOption(k, v string) error {
 			parts := strings.SplitN(entry, "=", 2)
 			l.labels[parts[0]] = parts[1]
 		}
+	case "label-fields":
+		for _, f := range strings.Split(v, ",") {
+			if _, ok := labelFields[f]; !ok {
+				return fmt.Errorf("unknown label field %q", f)
+			}
+			l.fields = append(l.fields, f)
+		}
 	default:
 		return fmt.Errorf("option %q unknow for loki output", k)
 	}
@@ -14,7 +14,8 @@ type Output interface {
 	// Description returns a description for the module, including the
 	// available options
 	Description() string
-	// Process starts handling connections captured by upstream inputs
+	// Process handles connections captured by upstream inputs until c is
+	// closed, once every input is done, or ctx is cancelled
 	Process(context.Context, <-chan entry.Connection)
 	// Cleanup any stuff that needs to be sorted out before exiting main
 	Cleanup()
@@ -0,0 +1,61 @@
+package packets
+
+import "github.com/devops-works/egress-auditor/internal/entry"
+
+// Netfilter hooks (NF_INET_*), as reported in the hook attribute of nflog
+// and nfqueue packets.
+const (
+	HookPreRouting  = 0
+	HookLocalIn     = 1
+	HookForward     = 2
+	HookLocalOut    = 3
+	HookPostRouting = 4
+)
+
+// chains maps netfilter hooks to the built-in chain using them.
+var chains = map[uint8]string{
+	HookPreRouting:  "PREROUTING",
+	HookLocalIn:     "INPUT",
+	HookForward:     "FORWARD",
+	HookLocalOut:    "OUTPUT",
+	HookPostRouting: "POSTROUTING",
+}
+
+// Chain returns the name of the built-in chain of hook, or "" for an
+// unknown hook.
+func Chain(hook uint8) string {
+	return chains[hook]
+}
+
+// Direction returns the direction of the connection a packet seen by
+// netfilter belongs to: ingress for packets addressed to this host (INPUT
+// chain), forward for packets routed by it (FORWARD chain), and egress for
+// packets it sent (OUTPUT chain). Packets seen in PREROUTING or POSTROUTING
+// are considered forwarded when gateway is set; otherwise, as without hook,
+// the direction is guessed from the devices.
+//
+// Any argument may be nil when the attribute was not sent by the kernel.
+func Direction(hook *uint8, inDev, outDev *uint32, gateway bool) string {
+	if hook != nil {
+		switch *hook {
+		case HookLocalIn:
+			return entry.Ingress
+		case HookForward:
+			return entry.Forward
+		case HookLocalOut:
+			return entry.Egress
+		}
+		if gateway {
+			return entry.Forward
+		}
+	}
+	// Only input packets have an input device and no output device, and
+	// only forwarded ones have both.
+	switch {
+	case inDev != nil && outDev != nil:
+		return entry.Forward
+	case inDev != nil:
+		return entry.Ingress
+	}
+	return entry.Egress
+}
@@ -0,0 +1,34 @@
+package packets
+
+import (
+	"testing"
+
+	"github.com/devops-works/egress-auditor/internal/entry"
+)
+
+func TestDirection(t *testing.T) {
+	hook := func(h uint8) *uint8 { return &h }
+	dev := func(d uint32) *uint32 { return &d }
+	for _, tc := range []struct {
+		name          string
+		hook          *uint8
+		inDev, outDev *uint32
+		gateway       bool
+		want          string
+	}{
+		{name: "input", hook: hook(HookLocalIn), inDev: dev(2), want: entry.Ingress},
+		{name: "forward", hook: hook(HookForward), inDev: dev(2), outDev: dev(3), want: entry.Forward},
+		{name: "output", hook: hook(HookLocalOut), outDev: dev(2), want: entry.Egress},
+		{name: "prerouting", hook: hook(HookPreRouting), inDev: dev(2), want: entry.Ingress},
+		{name: "postrouting", hook: hook(HookPostRouting), outDev: dev(2), want: entry.Egress},
+		{name: "postrouting forwarded", hook: hook(HookPostRouting), inDev: dev(2), outDev: dev(3), want: entry.Forward},
+		{name: "prerouting gateway", hook: hook(HookPreRouting), inDev: dev(2), gateway: true, want: entry.Forward},
+		{name: "postrouting gateway", hook: hook(HookPostRouting), outDev: dev(2), gateway: true, want: entry.Forward},
+		{name: "no hook", inDev: dev(2), want: entry.Ingress},
+		{name: "nothing", want: entry.Egress},
+	} {
+		if got := Direction(tc.hook, tc.inDev, tc.outDev, tc.gateway); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package packets finds new connections in IP packets, for inputs that see
+// packets rather than sockets (nflog, nfqueue, pcap, afpacket).
+//
+// A TCP connection starts with a SYN; for UDP, packets are grouped in
+// pseudo-flows (see internal/flows) and the first packet of a flow starts
+// a connection.
+package packets
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/devops-works/egress-auditor/internal/dnscache"
+	"github.com/devops-works/egress-auditor/internal/entry"
+	"github.com/devops-works/egress-auditor/internal/flows"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Ethertypes of the IP packets handed to Decode.
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeIPv6 = 0x86DD
+)
+
+// Conn describes the connection a packet belongs to.
+type Conn struct {
+	Protocol string // "tcp" or "udp"
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	IPv      uint8
+	Flow     *flows.Flow // UDP flow statistics, set by Parser.IsNew
+
+	syn, ack bool
+}
+
+// Entry returns an entry.Connection for c. Proc is left for the caller to
+// fill in.
+func (c Conn) Entry(hook, direction string) entry.Connection {
+	return entry.Connection{
+		Hook:      hook,
+		Direction: direction,
+		Protocol:  c.Protocol,
+		SrcIP:     c.SrcIP.String(),
+		SrcPort:   c.SrcPort,
+		DestIP:    c.DstIP.String(),
+		DestPort:  c.DstPort,
+		IPv:       c.IPv,
+		Flow:      c.Flow,
+	}
+}
+
+// Decode parses data, an IP packet with the given ethertype. It returns
+// false if data is not TCP or UDP over IPv4 or IPv6.
+func Decode(etherType uint16, data []byte) (gopacket.Packet, Conn, bool) {
+	var layerType gopacket.LayerType
+	switch etherType {
+	case EtherTypeIPv4:
+		layerType = layers.LayerTypeIPv4
+	case EtherTypeIPv6:
+		layerType = layers.LayerTypeIPv6
+	default:
+		return nil, Conn{}, false
+	}
+	p := gopacket.NewPacket(data, layerType, gopacket.Default)
+	c, ok := FromPacket(p)
+	return p, c, ok
+}
+
+// FromPacket returns the connection p belongs to, or false if p is not TCP
+// or UDP over IPv4 or IPv6. p can start at any layer gopacket can decode.
+func FromPacket(p gopacket.Packet) (Conn, bool) {
+	var c Conn
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		c.SrcIP, c.DstIP, c.IPv = ip.SrcIP, ip.DstIP, 4
+	case *layers.IPv6:
+		c.SrcIP, c.DstIP, c.IPv = ip.SrcIP, ip.DstIP, 6
+	default:
+		return c, false
+	}
+
+	switch t := p.TransportLayer().(type) {
+	case *layers.TCP:
+		c.Protocol, c.SrcPort, c.DstPort = "tcp", uint16(t.SrcPort), uint16(t.DstPort)
+		c.syn, c.ack = t.SYN, t.ACK
+	case *layers.UDP:
+		c.Protocol, c.SrcPort, c.DstPort = "udp", uint16(t.SrcPort), uint16(t.DstPort)
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+// IsDNSAnswer returns true if p comes from port 53.
+func IsDNSAnswer(p gopacket.Packet) bool {
+	switch t := p.TransportLayer().(type) {
+	case *layers.UDP:
+		return t.SrcPort == 53
+	case *layers.TCP:
+		return t.SrcPort == 53
+	}
+	return false
+}
+
+// Parser tracks UDP flows, and optionally DNS answers, across packets. It
+// is safe for concurrent use.
+type Parser struct {
+	flows *flows.Table
+	dns   *dnscache.Cache
+}
+
+// NewParser returns a parser expiring UDP flows after idle (0 selects
+// flows.DefaultIdleTimeout). When dns is true, DNS answers are recorded so
+// Host can name destinations.
+func NewParser(idle time.Duration, dns bool) *Parser {
+	p := &Parser{flows: flows.New(idle, 0)}
+	if dns {
+		p.dns = dnscache.New()
+	}
+	return p
+}
+
+// Parse returns the connection p starts, if any. now is the time p was
+// seen (capture time for offline inputs). DNS answers are consumed when
+// the parser tracks DNS, and never start a connection then.
+func (ps *Parser) Parse(p gopacket.Packet, now time.Time) (Conn, bool) {
+	if ps.dns != nil && IsDNSAnswer(p) {
+		ps.dns.ObservePacket(p, now)
+		return Conn{}, false
+	}
+	c, ok := FromPacket(p)
+	if !ok || !ps.IsNew(&c, now) {
+		return Conn{}, false
+	}
+	return c, true
+}
+
+// IsNew returns true if the packet c was decoded from starts a connection:
+// a TCP SYN (without ACK), or the first UDP packet of a flow. A UDP packet
+// answering a flow in progress is a reply and counted in that flow, since
+// inputs seeing both directions (captures) would otherwise report every
+// answer as a new flow. UDP flows are updated and c.Flow set for new
+// flows, so IsNew must be called once per packet.
+func (ps *Parser) IsNew(c *Conn, now time.Time) bool {
+	if c.Protocol == "tcp" {
+		return c.syn && !c.ack
+	}
+	k := flows.HostKey(c.Protocol, c.SrcIP, c.SrcPort, c.DstIP, c.DstPort)
+	if ps.flows.Update(k.Reverse(), now) {
+		return false
+	}
+	f, isNew := ps.flows.Seen(k, now)
+	c.Flow = &f
+	return isNew
+}
+
+// Host returns the name c's destination was resolved from by its source,
+// if the parser saw the DNS answer.
+func (ps *Parser) Host(c Conn, now time.Time) string {
+	if ps.dns == nil {
+		return ""
+	}
+	return ps.dns.Lookup(c.SrcIP.String(), c.DstIP.String(), now)
+}
+
+// ParseNet parses a CIDR or a single address, as given in input options.
+func ParseNet(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address or network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,193 @@
+// Package tail reads log files line by line, optionally following them as
+// they grow and across rotations, like "tail -F".
+package tail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often a followed file is checked for new data or
+// rotation once its end has been reached.
+const pollInterval = 250 * time.Millisecond
+
+// maxLine bounds the length of lines; longer lines are truncated, and
+// reading goes on with the next line.
+const maxLine = 1 << 20
+
+// Lines calls fn for each line read from r (without the trailing newline)
+// until EOF or until ctx is cancelled.
+func Lines(ctx context.Context, r io.Reader, fn func(string)) error {
+	lr := newLineReader(r)
+	for ctx.Err() == nil {
+		line, err := lr.next()
+		if err == io.EOF {
+			if rest := lr.rest(); rest != "" {
+				fn(rest)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(line)
+	}
+	return nil
+}
+
+// Follow calls fn for each line appended to the file at path until ctx is
+// cancelled. Reading starts at the end of the file, or at its start if
+// fromStart is true. When the file is rotated (path now names another
+// file) the rest of the old file is read, then the new one from its start;
+// when it is truncated, reading restarts from its start. A missing file is
+// waited for.
+func Follow(ctx context.Context, path string, fromStart bool, fn func(string)) error {
+	var (
+		f  *os.File
+		lr *lineReader
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if f == nil {
+			var err error
+			f, err = os.Open(path)
+			if errors.Is(err, os.ErrNotExist) {
+				sleep(ctx)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !fromStart {
+				if _, err := f.Seek(0, io.SeekEnd); err != nil {
+					return err
+				}
+			}
+			// Files appearing after the first one are read entirely.
+			fromStart = true
+			lr = newLineReader(f)
+		}
+
+		line, err := lr.next()
+		if err == nil {
+			fn(line)
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+
+		// At the end of the file: wait for more data, or for a rotation.
+		rotated, truncated, err := changed(f, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case rotated:
+			// The writer may have appended to the old file before
+			// switching to the new one.
+			for {
+				line, err := lr.next()
+				if err != nil {
+					break
+				}
+				fn(line)
+			}
+			if rest := lr.rest(); rest != "" {
+				fn(rest)
+			}
+			f.Close()
+			f = nil
+		case truncated:
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			lr.reset(f)
+		default:
+			sleep(ctx)
+		}
+	}
+	return nil
+}
+
+// lineReader reads lines in chunks, so that lines longer than maxLine are
+// truncated without being held in memory.
+type lineReader struct {
+	r   *bufio.Reader
+	buf []byte // current line, up to maxLine bytes
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next line, without its line terminator. At the end of
+// the input, it returns io.EOF and keeps the partial line read so far:
+// the next call completes it if more data was appended.
+func (lr *lineReader) next() (string, error) {
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		if n := maxLine - len(lr.buf); n > 0 {
+			lr.buf = append(lr.buf, chunk[:min(n, len(chunk))]...)
+		}
+		switch err {
+		case nil:
+			line := strings.TrimRight(string(lr.buf), "\r\n")
+			lr.buf = lr.buf[:0]
+			return line, nil
+		case bufio.ErrBufferFull:
+			// The rest of the line is in the next chunks.
+		default:
+			return "", err
+		}
+	}
+}
+
+// rest returns the partial line left at the end of the input, and forgets
+// it.
+func (lr *lineReader) rest() string {
+	line := strings.TrimRight(string(lr.buf), "\r\n")
+	lr.buf = lr.buf[:0]
+	return line
+}
+
+// reset discards buffered data and reads from r from now on.
+func (lr *lineReader) reset(r io.Reader) {
+	lr.r.Reset(r)
+	lr.buf = lr.buf[:0]
+}
+
+// changed tells whether path no longer names f, or whether f is now
+// shorter than what has been read from it.
+func changed(f *os.File, path string) (rotated, truncated bool, err error) {
+	cur, err := f.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	st, err := os.Stat(path)
+	if err == nil && !os.SameFile(cur, st) {
+		return true, false, nil
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, false, err
+	}
+	return false, cur.Size() < pos, nil
+}
+
+func sleep(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(pollInterval):
+	}
+}
@@ -0,0 +1,36 @@
+package tail
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	long := strings.Repeat("x", maxLine+10)
+	for _, tc := range []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"lines", "a\nb\r\n\nc\n", []string{"a", "b", "", "c"}},
+		{"no trailing newline", "a\nb", []string{"a", "b"}},
+		{"truncated", "a\n" + long + "\nb\n", []string{"a", long[:maxLine], "b"}},
+		{"truncated last line", long, []string{long[:maxLine]}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			err := Lines(context.Background(), strings.NewReader(tc.in), func(l string) {
+				got = append(got, l)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %d lines %.40q, want %d lines %.40q", len(got), got, len(tc.want), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package procdetail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Container runtimes recognized in cgroup paths.
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+	RuntimeCRIO       = "cri-o"
+	RuntimePodman     = "podman"
+)
+
+// Cgroup describes the control group of a process, and the workload it
+// tells: container, Kubernetes pod, systemd unit.
+type Cgroup struct {
+	// Path is the cgroup of the process, from the cgroup v2 (unified)
+	// hierarchy when Unified is set, else from the v1 systemd (or first)
+	// hierarchy.
+	Path    string
+	Unified bool
+
+	// Runtime is the container runtime when the path tells it (it does
+	// not for Kubernetes with the cgroupfs driver), ContainerID the full
+	// (64 hex digits) container id.
+	Runtime     string
+	ContainerID string
+	// PodUID is the UID of the Kubernetes pod of the container.
+	PodUID string
+	// Slice and Unit are the innermost systemd slice and unit (service or
+	// scope) of the process.
+	Slice string
+	Unit  string
+}
+
+// ShortID returns the container id in its usual 12 digits form, or "".
+func (c *Cgroup) ShortID() string {
+	if len(c.ContainerID) < 12 {
+		return c.ContainerID
+	}
+	return c.ContainerID[:12]
+}
+
+// containerPrefixes map the prefixes of container cgroup (or systemd scope)
+// names to their runtime. The conmon scopes of cri-o and podman
+// (crio-conmon-<id>, libpod-conmon-<id>) are not containers and do not
+// match, their remainder not being an id.
+var containerPrefixes = []struct {
+	prefix  string
+	runtime string
+}{
+	{"docker-", RuntimeDocker},
+	{"cri-containerd-", RuntimeContainerd},
+	{"containerd-", RuntimeContainerd},
+	{"nerdctl-", RuntimeContainerd},
+	{"crio-", RuntimeCRIO},
+	{"libpod-", RuntimePodman},
+}
+
+// containerParents map cgroupfs parent directory names to the runtime of
+// the containers in them (/docker/<id>, /libpod_parent/libpod-<id>).
+var containerParents = map[string]string{
+	"docker":        RuntimeDocker,
+	"libpod_parent": RuntimePodman,
+}
+
+// readCgroup returns the cgroup of pid, or nil if it can not be read.
+func readCgroup(pid int32) *Cgroup {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	cg, err := parseCgroupFile(f)
+	if err != nil {
+		return nil
+	}
+	return cg
+}
+
+// parseCgroupFile parses /proc/<pid>/cgroup: one "id:controllers:path"
+// line per hierarchy, "0::path" being the unified (v2) one. The first path
+// that is not the root is used, from the unified hierarchy, the v1 systemd
+// one, then the other v1 ones: on hybrid setups processes may only be
+// placed in v1 hierarchies.
+func parseCgroupFile(r io.Reader) (*Cgroup, error) {
+	var unified, systemd, first string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			unified = parts[2]
+		case parts[1] == "name=systemd":
+			systemd = parts[2]
+		case first == "" && parts[2] != "/":
+			first = parts[2]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case unified != "" && unified != "/":
+		return parseCgroupPath(unified, true), nil
+	case systemd != "" && systemd != "/":
+		return parseCgroupPath(systemd, false), nil
+	case first != "":
+		return parseCgroupPath(first, false), nil
+	case unified != "":
+		return parseCgroupPath(unified, true), nil
+	case systemd != "":
+		return parseCgroupPath(systemd, false), nil
+	}
+	return nil, fmt.Errorf("no cgroup found")
+}
+
+// parseCgroupPath returns the workload cgroup path p tells, e.g.:
+//
+//	/system.slice/docker-<id>.scope
+//	/docker/<id>
+//	/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope
+//	/kubepods/besteffort/pod<uid>/<id>
+//	/user.slice/user-1000.slice/user@1000.service/user.slice/libpod-<id>.scope
+//
+// With nested containers, the innermost one is used.
+func parseCgroupPath(p string, unified bool) *Cgroup {
+	cg := &Cgroup{Path: p, Unified: unified}
+
+	parent := ""
+	for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+		name := seg
+		switch {
+		case strings.HasSuffix(seg, ".slice"):
+			name = strings.TrimSuffix(seg, ".slice")
+			cg.Slice = seg
+		case strings.HasSuffix(seg, ".scope"):
+			name = strings.TrimSuffix(seg, ".scope")
+			cg.Unit = seg
+		case strings.HasSuffix(seg, ".service"):
+			cg.Unit = seg
+		}
+
+		if uid, ok := podUID(name); ok {
+			cg.PodUID = uid
+		}
+		if id, runtime, ok := containerID(name, parent); ok {
+			cg.ContainerID, cg.Runtime = id, runtime
+		}
+		parent = seg
+	}
+	return cg
+}
+
+// podUID returns the pod UID in a cgroup name: "pod<uid>" (cgroupfs
+// driver) or "kubepods-<qos>-pod<uid>" with dashes replaced by
+// underscores (systemd driver).
+func podUID(name string) (string, bool) {
+	i := strings.LastIndex(name, "pod")
+	if i < 0 || (i > 0 && name[i-1] != '-') {
+		return "", false
+	}
+	uid := strings.ReplaceAll(name[i+len("pod"):], "_", "-")
+	// 8-4-4-4-12 hex digits
+	if len(uid) != 36 || strings.Count(uid, "-") != 4 || !isHex(strings.ReplaceAll(uid, "-", "")) {
+		return "", false
+	}
+	return uid, true
+}
+
+// containerID returns the container id and runtime in a cgroup name, given
+// the name of its parent.
+func containerID(name, parent string) (string, string, bool) {
+	for _, cp := range containerPrefixes {
+		if id, ok := strings.CutPrefix(name, cp.prefix); ok && isContainerID(id) {
+			return id, cp.runtime, true
+		}
+	}
+	if !isContainerID(name) {
+		return "", "", false
+	}
+	// A bare id: /docker/<id>, or a Kubernetes container with the cgroupfs
+	// driver, whose runtime is not known.
+	return name, containerParents[parent], true
+}
+
+// isContainerID returns true if s looks like a container id.
+func isContainerID(s string) bool {
+	return len(s) == 64 && isHex(s)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
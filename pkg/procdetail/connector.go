@@ -0,0 +1,127 @@
+package procdetail
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink proc connector constants (linux/connector.h, linux/cn_proc.h).
+const (
+	cnIdxProc = 0x1
+	cnValProc = 0x1
+
+	procCnMcastListen = 1
+	procCnMcastIgnore = 2
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	cnMsgLen        = 20 // struct cn_msg without payload
+	procEventHdrLen = 16 // what, cpu, timestamp_ns
+)
+
+// ListenConnector feeds the tracker from the netlink proc connector until
+// ctx is cancelled. This is the fallback when eBPF tracepoints are not
+// available; it requires CAP_NET_ADMIN.
+func (t *Tracker) ListenConnector(ctx context.Context) error {
+	conn, err := netlink.Dial(unix.NETLINK_CONNECTOR, &netlink.Config{Groups: cnIdxProc})
+	if err != nil {
+		return fmt.Errorf("unable to open proc connector: %w", err)
+	}
+	defer conn.Close()
+
+	if err := sendConnectorOp(conn, procCnMcastListen); err != nil {
+		return fmt.Errorf("unable to subscribe to proc connector: %w", err)
+	}
+	defer sendConnectorOp(conn, procCnMcastIgnore)
+
+	go func() {
+		<-ctx.Done()
+		// Unblock Receive.
+		conn.SetReadDeadline(time.Now().Add(-time.Second))
+	}()
+
+	for {
+		msgs, err := conn.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// ENOBUFS means we lost events; keep going, lookups will fall
+			// back to /proc for what we missed.
+			if oe, ok := err.(*netlink.OpError); ok && oe.Err == unix.ENOBUFS {
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			t.handleConnector(m.Data)
+		}
+	}
+}
+
+func (t *Tracker) handleConnector(b []byte) {
+	if len(b) < cnMsgLen+procEventHdrLen {
+		return
+	}
+	ev := b[cnMsgLen:]
+	what := binary.NativeEndian.Uint32(ev[0:4])
+	ts := binary.NativeEndian.Uint64(ev[8:16])
+	data := ev[procEventHdrLen:]
+
+	switch what {
+	case procEventFork:
+		if len(data) < 16 {
+			return
+		}
+		ptgid := int32(binary.NativeEndian.Uint32(data[4:8]))
+		pid := int32(binary.NativeEndian.Uint32(data[8:12]))
+		tgid := int32(binary.NativeEndian.Uint32(data[12:16]))
+		if pid != tgid {
+			// new thread
+			return
+		}
+		if tp, err := readTracked(pid); err == nil {
+			t.add(tp)
+			return
+		}
+		t.Fork(pid, ptgid, StartTicks(ts))
+	case procEventExec:
+		if len(data) < 8 {
+			return
+		}
+		tgid := int32(binary.NativeEndian.Uint32(data[4:8]))
+		if tp, err := readTracked(tgid); err == nil {
+			t.add(tp)
+		}
+	case procEventExit:
+		if len(data) < 8 {
+			return
+		}
+		pid := int32(binary.NativeEndian.Uint32(data[0:4]))
+		tgid := int32(binary.NativeEndian.Uint32(data[4:8]))
+		if pid == tgid {
+			t.Exit(tgid, 0)
+		}
+	}
+}
+
+func sendConnectorOp(conn *netlink.Conn, op uint32) error {
+	b := make([]byte, cnMsgLen+4)
+	binary.NativeEndian.PutUint32(b[0:4], cnIdxProc)
+	binary.NativeEndian.PutUint32(b[4:8], cnValProc)
+	binary.NativeEndian.PutUint16(b[16:18], 4)
+	binary.NativeEndian.PutUint32(b[cnMsgLen:], op)
+
+	_, err := conn.Send(netlink.Message{
+		Header: netlink.Header{Type: netlink.Done},
+		Data:   b,
+	})
+	return err
+}
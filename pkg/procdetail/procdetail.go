@@ -1,8 +1,15 @@
 package procdetail
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cakturk/go-netstat/netstat"
 	"github.com/shirou/gopsutil/process"
@@ -11,30 +18,75 @@ import (
 // ProcessDetail contains information about processes that started connections
 type ProcessDetail struct {
 	Pid     int32
+	Tid     int32
 	Name    string
 	CmdLine string
+	Exe     string
 	User    string
+	UID     uint32
+	GID     uint32
+	EUID    uint32
 	Parent  *ProcessDetail
+
+	// Cgroup is the control group of the process, with the container,
+	// pod or systemd unit it tells, when known.
+	Cgroup *Cgroup
+
+	// LoginUser is the user that logged in and started the session the
+	// process belongs to (audit login uid), when known (auditd input).
+	LoginUser string
+
+	// Identity captured by inputs that see the task in kernel context
+	// (e.g. ebpf). Zero when unknown. Start is the start time of the
+	// process in clock ticks since boot (see StartTicks): with Pid, it
+	// tells the process apart from later ones reusing its pid.
+	Start    uint64
+	ExeInode uint64
+	CgroupID uint64
+	MntNS    uint32
+	NetNS    uint32
+}
+
+// maxAncestors bounds the ancestry of processes when it is not limited by
+// SetAncestryDepth; process trees are much shallower.
+const maxAncestors = 64
+
+// ancestors is the number of ancestors resolved for each process.
+var ancestors = 2
+
+// SetAncestryDepth sets the number of ancestors New, Complete and the
+// tracker resolve for each process: 2, the default, gives the parent and
+// grandparent. With 0, ancestors are resolved up to init (pid 1). It must
+// be called before processes are looked up.
+func SetAncestryDepth(n int) {
+	if n <= 0 {
+		n = maxAncestors
+	}
+	ancestors = n
+}
+
+// Ancestry returns the ancestors of p that were resolved, parent first.
+func (p *ProcessDetail) Ancestry() []*ProcessDetail {
+	var a []*ProcessDetail
+	for q := p.Parent; q != nil; q = q.Parent {
+		a = append(a, q)
+	}
+	return a
 }
 
+// errPidReused is returned by Complete when /proc/<pid> no longer belongs to
+// the process that was seen by the kernel.
+var errPidReused = errors.New("pid was reused by another process")
+
+// userCache maps uids to user names; lookups hit /etc/passwd (or NSS) and
+// are done for every event.
+var userCache sync.Map
+
 // GetOwnerOfConnection returns information about the process that initiated
 // the connection described by the quadruplet. Protocol should be "tcp" or "udp".
-func GetOwnerOfConnection(protocol string, sip net.IP, spp uint16, dip net.IP, dpp uint16) (*ProcessDetail, error) {
-	voidproc := &ProcessDetail{
-		Name:    "unknown",
-		CmdLine: "unknown",
-		User:    "unknown",
-		Parent: &ProcessDetail{
-			Name:    "unknown",
-			CmdLine: "unknown",
-			User:    "unknown",
-			Parent: &ProcessDetail{
-				Name:    "unknown",
-				CmdLine: "unknown",
-				User:    "unknown",
-			},
-		},
-	}
+// at is when the connection was seen (see NewAt).
+func GetOwnerOfConnection(protocol string, sip net.IP, spp uint16, dip net.IP, dpp uint16, at time.Time) (*ProcessDetail, error) {
+	voidproc := unknown(3)
 
 	var (
 		tabs []netstat.SockTabEntry
@@ -79,7 +131,7 @@ func GetOwnerOfConnection(protocol string, sip net.IP, spp uint16, dip net.IP, d
 		return voidproc, nil
 	}
 
-	procentry, err := New(int32(e.Process.Pid))
+	procentry, err := NewAt(int32(e.Process.Pid), at)
 	if err != nil {
 		return voidproc, err
 	}
@@ -87,40 +139,384 @@ func GetOwnerOfConnection(protocol string, sip net.IP, spp uint16, dip net.IP, d
 	return procentry, nil
 }
 
+// GetOwnerOfListener returns information about the process owning the
+// socket that receives inbound connections (or datagrams, for "udp") to
+// ip:port: a listening TCP socket, or a bound UDP socket. Sockets bound to
+// the wildcard address match too, including IPv6 sockets accepting IPv4
+// connections. at is when the connection was seen (see NewAt).
+func GetOwnerOfListener(protocol string, ip net.IP, port uint16, at time.Time) (*ProcessDetail, error) {
+	voidproc := unknown(3)
+
+	filter := func(s *netstat.SockTabEntry) bool {
+		if s.LocalAddr.Port != port {
+			return false
+		}
+		if !s.LocalAddr.IP.Equal(ip) && !s.LocalAddr.IP.IsUnspecified() {
+			return false
+		}
+		if protocol == "udp" {
+			// Connected UDP sockets only get datagrams from their peer;
+			// they are not the ones receiving new flows.
+			return s.RemoteAddr.Port == 0
+		}
+		return s.State == netstat.Listen
+	}
+
+	var lookups []func(netstat.AcceptFn) ([]netstat.SockTabEntry, error)
+	switch {
+	case protocol == "udp" && ip.To4() == nil:
+		lookups = append(lookups, netstat.UDP6Socks)
+	case protocol == "udp":
+		lookups = append(lookups, netstat.UDPSocks, netstat.UDP6Socks)
+	case ip.To4() == nil:
+		lookups = append(lookups, netstat.TCP6Socks)
+	default:
+		lookups = append(lookups, netstat.TCPSocks, netstat.TCP6Socks)
+	}
+
+	var tabs []netstat.SockTabEntry
+	for _, lookup := range lookups {
+		t, err := lookup(filter)
+		if err != nil {
+			return voidproc, err
+		}
+		tabs = append(tabs, t...)
+	}
+
+	// Several sockets can share a port (SO_REUSEPORT, or a specific address
+	// next to the wildcard); they usually belong to the same program, so
+	// pick the first one with a known owner.
+	for _, e := range tabs {
+		if e.Process == nil {
+			continue
+		}
+		procentry, err := NewAt(int32(e.Process.Pid), at)
+		if err != nil {
+			return voidproc, err
+		}
+		return procentry, nil
+	}
+
+	return voidproc, nil
+}
+
 // func getDetail(pid int, checkparent bool) (*Process, error) {
 
 // }
 
-// New finds information about a process and returns a ProcessDetail
+// New finds information about a process and returns a ProcessDetail with
+// its ancestors (see SetAncestryDepth). The process tracker (see
+// UseTracker) is consulted first, then /proc.
 func New(pid int32) (*ProcessDetail, error) {
-	p := &ProcessDetail{}
+	return newDetail(pid, ancestors, 0)
+}
 
-	err := p.getDetailsFor(pid)
-	if err != nil {
-		return nil, err
+// NewAt is New for the process pid that was running at t, e.g. when the
+// packet it sent was seen: the tracker still knows it when it exited and
+// its pid was reused since, and /proc is not used when it holds a process
+// started after t.
+func NewAt(pid int32, t time.Time) (*ProcessDetail, error) {
+	return newDetail(pid, ancestors, TicksAt(t))
+}
+
+// newDetail is New with up to n ancestors, for the process running at
+// clock tick at (0 for the latest one).
+func newDetail(pid int32, n int, at uint64) (*ProcessDetail, error) {
+	if tracker != nil {
+		if p, ok := tracker.lookup(pid, n, at); ok {
+			return p, nil
+		}
+	}
+	if at != 0 {
+		if _, _, start, err := readStat(pid); err == nil && start > at {
+			return nil, errPidReused
+		}
 	}
 
-	err = p.Parent.getDetailsFor(p.Parent.Pid)
+	p := &ProcessDetail{}
+
+	err := p.getDetailsFor(pid)
 	if err != nil {
 		return nil, err
 	}
 
-	// Grandparent — stop if parent is init (pid 1) or kernel (pid 0).
-	if p.Parent.Parent != nil && p.Parent.Parent.Pid > 1 {
-		err = p.Parent.Parent.getDetailsFor(p.Parent.Parent.Pid)
+	// The parent must be found; further ancestors may have exited. The
+	// walk stops at init (pid 1), whose parent is the kernel.
+	child := p
+	for level := 1; level <= n && child.Pid > 1; level++ {
+		parent := child.Parent
+		err = parent.getDetailsFor(parent.Pid)
 		if err != nil {
-			// Non-fatal: grandparent may have exited.
-			p.Parent.Parent = &ProcessDetail{
-				Name:    "unknown",
-				CmdLine: "unknown",
-				User:    "unknown",
+			if level == 1 {
+				return nil, err
 			}
+			child.Parent = unknown(1)
+			child.Parent.Pid = parent.Pid
+			return p, nil
 		}
+		child = parent
+	}
+	// getDetailsFor left a placeholder parent, only kept for p itself
+	// (outputs expect one).
+	if child != p || n == 0 {
+		child.Parent = nil
 	}
 
 	return p, nil
 }
 
+// Complete fills in the fields of p that were not captured by the kernel
+// (command line, executable path, user name, ancestors), from the process
+// tracker when it knows the process (see UseTracker; p.Start must be set),
+// else from /proc. p.Pid must be set; UID, Parent.Pid, Start and ExeInode
+// are trusted when present. If Start or ExeInode is set and does not match
+// /proc/<pid>, the pid has been reused and /proc is not consulted for p
+// itself.
+//
+// Fields that can not be resolved are set to "unknown", so p is always
+// usable by outputs, even when an error is returned.
+func (p *ProcessDetail) Complete() error {
+	var procErr error
+
+	var tracked *ProcessDetail
+	if tracker != nil && p.Start != 0 {
+		tracked, _ = tracker.lookup(p.Pid, ancestors, p.Start)
+	}
+	if tracked != nil {
+		p.completeFrom(tracked)
+	} else {
+		procErr = p.completeFromProc()
+	}
+
+	if p.Name == "" {
+		p.Name = "unknown"
+	}
+	if p.CmdLine == "" {
+		p.CmdLine = p.Name
+	}
+	if p.User == "" {
+		p.User = lookupUser(p.UID)
+	}
+
+	switch {
+	case p.Parent == nil || p.Parent.Pid == 0:
+		p.Parent = unknown(2)
+	case p.Parent.Name == "":
+		// The parent was running when p started.
+		ppid := p.Parent.Pid
+		if parent, err := newDetail(ppid, ancestors-1, p.Start); err == nil {
+			p.Parent = parent
+		} else {
+			p.Parent = unknown(2)
+			p.Parent.Pid = ppid
+		}
+	}
+
+	return procErr
+}
+
+// CompleteAt is Complete for a process seen at t by an input that records
+// its name and executable (e.g. auditd): only the fields of p that are not
+// set are filled in, and nothing is taken from the process holding p.Pid
+// when it started after t or runs another executable than p.Exe, as the pid
+// has been reused (or the process exec'd) since. Parent.Pid is trusted when
+// present.
+func (p *ProcessDetail) CompleteAt(t time.Time) error {
+	at := TicksAt(t)
+	q, err := newDetail(p.Pid, ancestors, at)
+	if err == nil && p.Exe != "" && q.Exe != "" && q.Exe != p.Exe {
+		q, err = nil, errPidReused
+	}
+	if q != nil {
+		if p.Name == "" {
+			p.Name = q.Name
+		}
+		if p.CmdLine == "" {
+			p.CmdLine = q.CmdLine
+		}
+		if p.Exe == "" {
+			p.Exe = q.Exe
+		}
+		if p.Cgroup == nil {
+			p.Cgroup = q.Cgroup
+		}
+		if q.Parent != nil && (p.Parent == nil || p.Parent.Pid == 0 || p.Parent.Pid == q.Parent.Pid) {
+			p.Parent = q.Parent
+		}
+	}
+
+	if p.Name == "" {
+		p.Name = "unknown"
+	}
+	if p.CmdLine == "" {
+		p.CmdLine = p.Name
+	}
+	if p.User == "" {
+		p.User = lookupUser(p.UID)
+	}
+
+	switch {
+	case p.Parent == nil || p.Parent.Pid == 0:
+		p.Parent = unknown(2)
+	case p.Parent.Name == "":
+		ppid := p.Parent.Pid
+		if parent, err := newDetail(ppid, ancestors-1, at); err == nil {
+			p.Parent = parent
+		} else {
+			p.Parent = unknown(2)
+			p.Parent.Pid = ppid
+		}
+	}
+
+	return err
+}
+
+// CompleteOffline fills in the fields of p that were not captured by the
+// kernel with placeholders, as Complete does for what it can not resolve,
+// without looking anything up on this host: the pid and uid of a process
+// recorded on another host (e.g. a replayed dump) mean nothing here. The
+// user is the numeric uid.
+func (p *ProcessDetail) CompleteOffline() {
+	if p.Name == "" {
+		p.Name = "unknown"
+	}
+	if p.CmdLine == "" {
+		p.CmdLine = p.Name
+	}
+	if p.User == "" {
+		p.User = strconv.FormatUint(uint64(p.UID), 10)
+	}
+	if p.Parent == nil || p.Parent.Name == "" {
+		parent := unknown(2)
+		if p.Parent != nil {
+			parent.Pid = p.Parent.Pid
+		}
+		p.Parent = parent
+	}
+}
+
+// completeFrom fills in the fields of p that are not set from q, the same
+// process as known by the tracker.
+func (p *ProcessDetail) completeFrom(q *ProcessDetail) {
+	// As with /proc, prefer the process name to the comm of the thread.
+	if q.Name != "" {
+		p.Name = q.Name
+	}
+	if p.CmdLine == "" {
+		p.CmdLine = q.CmdLine
+	}
+	if p.Exe == "" {
+		p.Exe = q.Exe
+	}
+	if p.Cgroup == nil {
+		p.Cgroup = q.Cgroup
+	}
+	// The kernel parent differs when p was reparented after its exec.
+	if p.Parent == nil || p.Parent.Pid == 0 || p.Parent.Pid == q.Parent.Pid {
+		p.Parent = q.Parent
+	}
+}
+
+// completeFromProc fills in the fields of p that are not set from
+// /proc/<pid>, unless it belongs to another process now.
+func (p *ProcessDetail) completeFromProc() error {
+	proc, err := process.NewProcess(p.Pid)
+	if err != nil {
+		return err
+	}
+	if p.Start != 0 {
+		if _, _, start, err := readStat(p.Pid); err == nil && start != p.Start {
+			return errPidReused
+		}
+	}
+	if p.ExeInode != 0 {
+		if ino, err := exeInode(p.Pid); err == nil && ino != p.ExeInode {
+			return errPidReused
+		}
+	}
+
+	// The kernel only gives us the comm of the calling thread, which
+	// multi-threaded daemons rename with prctl(PR_SET_NAME); prefer the
+	// process name.
+	if name, err := proc.Name(); err == nil && name != "" {
+		p.Name = name
+	}
+	if p.CmdLine == "" {
+		p.CmdLine, _ = proc.Cmdline()
+	}
+	if p.Exe == "" {
+		p.Exe, _ = proc.Exe()
+	}
+	if p.Cgroup == nil {
+		p.Cgroup = readCgroup(p.Pid)
+	}
+	if p.Parent == nil || p.Parent.Pid == 0 {
+		if ppid, err := proc.Ppid(); err == nil {
+			p.Parent = &ProcessDetail{Pid: ppid}
+		}
+	}
+	return nil
+}
+
+// Unknown returns a process, with parent and grandparent, whose fields are
+// all "unknown". Inputs that can not attribute connections to processes
+// use it so outputs always get a complete chain.
+func Unknown() *ProcessDetail {
+	return unknown(3)
+}
+
+// ForUser returns an unknown process (see Unknown) run by uid, for inputs
+// that only know which user initiated a connection.
+func ForUser(uid uint32) *ProcessDetail {
+	p := unknown(3)
+	p.UID = uid
+	p.EUID = uid
+	p.User = lookupUser(uid)
+	return p
+}
+
+// unknown returns a placeholder chain of depth levels of "unknown"
+// processes.
+func unknown(depth int) *ProcessDetail {
+	var p *ProcessDetail
+	for i := 0; i < depth; i++ {
+		p = &ProcessDetail{
+			Name:    "unknown",
+			CmdLine: "unknown",
+			User:    "unknown",
+			Parent:  p,
+		}
+	}
+	return p
+}
+
+// exeInode returns the inode number of /proc/<pid>/exe target.
+func exeInode(pid int32) (uint64, error) {
+	fi, err := os.Stat(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unexpected stat type %T", fi.Sys())
+	}
+	return st.Ino, nil
+}
+
+// lookupUser returns the user name for uid, or the numeric uid if it can
+// not be resolved.
+func lookupUser(uid uint32) string {
+	if name, ok := userCache.Load(uid); ok {
+		return name.(string)
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	userCache.Store(uid, name)
+	return name
+}
+
 func (p *ProcessDetail) getDetailsFor(pid int32) error {
 	proc, err := process.NewProcess(pid)
 	if err != nil {
@@ -154,5 +550,16 @@ func (p *ProcessDetail) getDetailsFor(pid int32) error {
 		return err
 	}
 
+	if uids, err := proc.Uids(); err == nil && len(uids) > 1 {
+		p.UID = uint32(uids[0])
+		p.EUID = uint32(uids[1])
+	}
+	if gids, err := proc.Gids(); err == nil && len(gids) > 0 {
+		p.GID = uint32(gids[0])
+	}
+	// Reading exe requires ptrace access to the target; not fatal.
+	p.Exe, _ = proc.Exe()
+	p.Cgroup = readCgroup(pid)
+
 	return nil
 }
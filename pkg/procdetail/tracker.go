@@ -0,0 +1,378 @@
+package procdetail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// clockTicksPerSec is USER_HZ, the unit of process start times in
+// /proc/<pid>/stat. It is 100 on every Linux ABI.
+const clockTicksPerSec = 100
+
+// Tracker maintains an in-memory process tree fed by exec/exit/fork
+// notifications (eBPF tracepoints or the netlink proc connector).
+//
+// Processes are identified by pid and start time, so a recycled pid never
+// inherits the ancestry of the process that previously held it, and exited
+// processes are kept for a while so connections from short-lived programs
+// (and their exited parents) can still be attributed.
+type Tracker struct {
+	mu        sync.RWMutex
+	procs     map[int32][]*trackedProc // incarnations of a pid, oldest first
+	retention time.Duration
+}
+
+type trackedProc struct {
+	pid     int32
+	ppid    int32
+	start   uint64 // clock ticks since boot
+	name    string
+	exe     string
+	cmdline string
+	uid     uint32
+	user    string
+	cgroup  *Cgroup
+	exited  time.Time
+}
+
+// tracker is consulted by New before /proc when set.
+var tracker *Tracker
+
+// UseTracker makes New (and thus GetOwnerOfConnection and Complete) look up
+// processes in t before falling back to /proc.
+func UseTracker(t *Tracker) {
+	tracker = t
+}
+
+// NewTracker returns an empty tracker that keeps exited processes for
+// retention.
+func NewTracker(retention time.Duration) *Tracker {
+	return &Tracker{
+		procs:     make(map[int32][]*trackedProc),
+		retention: retention,
+	}
+}
+
+// StartTicks converts a task start time in nanoseconds since boot (as found
+// in task_struct or proc connector events) to the clock ticks used by the
+// tracker.
+func StartTicks(ns uint64) uint64 {
+	return ns / (uint64(time.Second) / clockTicksPerSec)
+}
+
+// TicksAt converts wall clock time t, such as the time a packet was seen,
+// to clock ticks since boot. It rounds up, so a process started in the same
+// tick as an event at t is running then. It returns 0 for the zero time.
+func TicksAt(t time.Time) uint64 {
+	var ts unix.Timespec
+	if t.IsZero() || unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts) != nil {
+		return 0
+	}
+	sinceBoot := time.Duration(ts.Nano()) - time.Since(t)
+	if sinceBoot <= 0 {
+		return 0
+	}
+	tick := time.Second / clockTicksPerSec
+	return uint64((sinceBoot + tick - 1) / tick)
+}
+
+// Scan seeds the tracker with the processes currently in /proc.
+func (t *Tracker) Scan() error {
+	ents, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		tp, err := readTracked(int32(pid))
+		if err != nil {
+			continue
+		}
+		t.add(tp)
+	}
+	return nil
+}
+
+// Exec records that pid (started at start clock ticks, child of ppid) has
+// executed a new program. name and exe are taken from the event; the
+// command line and user are read from /proc right away, while the process
+// is still alive.
+func (t *Tracker) Exec(pid, ppid int32, start uint64, uid uint32, name, exe string) {
+	tp := &trackedProc{
+		pid:   pid,
+		ppid:  ppid,
+		start: start,
+		name:  name,
+		exe:   exe,
+		uid:   uid,
+		user:  lookupUser(uid),
+	}
+	if tp.cmdline = readCmdline(pid); tp.cmdline == "" {
+		tp.cmdline = exe
+	}
+	tp.cgroup = readCgroup(pid)
+	t.add(tp)
+}
+
+// Fork records a new process pid as a copy of its parent ppid. When the
+// parent is unknown, /proc is used.
+func (t *Tracker) Fork(pid, ppid int32, start uint64) {
+	t.mu.RLock()
+	parent := t.incarnation(ppid, start)
+	t.mu.RUnlock()
+
+	if parent == nil {
+		if tp, err := readTracked(pid); err == nil {
+			t.add(tp)
+		}
+		return
+	}
+
+	tp := *parent
+	tp.pid = pid
+	tp.ppid = ppid
+	tp.start = start
+	tp.exited = time.Time{}
+	t.add(&tp)
+}
+
+// Exit records that pid has exited. start may be 0 when the caller does not
+// know it, in which case the latest incarnation of pid is used.
+func (t *Tracker) Exit(pid int32, start uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps := t.procs[pid]
+	if len(ps) == 0 {
+		return
+	}
+	tp := ps[len(ps)-1]
+	if start != 0 {
+		if tp = t.incarnation(pid, start); tp == nil {
+			return
+		}
+	}
+	if tp.exited.IsZero() {
+		tp.exited = time.Now()
+	}
+}
+
+// Lookup returns the details of the latest incarnation of pid, along with
+// its ancestors (see SetAncestryDepth), or false when pid is not tracked.
+// It is meant for processes known to be alive; use LookupAt for processes
+// seen in events.
+func (t *Tracker) Lookup(pid int32) (*ProcessDetail, bool) {
+	return t.lookup(pid, ancestors, 0)
+}
+
+// LookupAt is Lookup for the incarnation of pid that was running at clock
+// tick at: given the start time of the process (see StartTicks), that
+// process; given the time of an event (see TicksAt), the process that was
+// running then, even if it exited and its pid was reused since.
+func (t *Tracker) LookupAt(pid int32, at uint64) (*ProcessDetail, bool) {
+	return t.lookup(pid, ancestors, at)
+}
+
+// lookup is LookupAt with up to n ancestors; at 0 selects the latest
+// incarnation.
+func (t *Tracker) lookup(pid int32, n int, at uint64) (*ProcessDetail, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var tp *trackedProc
+	if at == 0 {
+		if ps := t.procs[pid]; len(ps) > 0 {
+			tp = ps[len(ps)-1]
+		}
+	} else {
+		tp = t.incarnation(pid, at)
+	}
+	if tp == nil {
+		return nil, false
+	}
+	p := t.detail(tp, n)
+	if p.Parent == nil && n > 0 {
+		// init: outputs expect a parent.
+		p.Parent = unknown(1)
+	}
+	return p, true
+}
+
+// Run evicts exited processes once they are older than the retention
+// period, until ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context) {
+	tick := time.NewTicker(t.retention / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			t.evict(now)
+		}
+	}
+}
+
+func (t *Tracker) evict(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pid, ps := range t.procs {
+		kept := ps[:0]
+		for _, tp := range ps {
+			if tp.exited.IsZero() || now.Sub(tp.exited) < t.retention {
+				kept = append(kept, tp)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.procs, pid)
+			continue
+		}
+		t.procs[pid] = kept
+	}
+}
+
+// add inserts or replaces (same pid and start time) a tracked process.
+func (t *Tracker) add(tp *trackedProc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps := t.procs[tp.pid]
+	for i, old := range ps {
+		if old.start == tp.start {
+			ps[i] = tp
+			return
+		}
+	}
+	ps = append(ps, tp)
+	sort.Slice(ps, func(i, j int) bool { return ps[i].start < ps[j].start })
+	t.procs[tp.pid] = ps
+}
+
+// incarnation returns the incarnation of pid that was running at clock
+// tick at, i.e. the latest one started no later than at, unless it had
+// already exited then (the next one was missed). Must be called with t.mu
+// held.
+func (t *Tracker) incarnation(pid int32, at uint64) *trackedProc {
+	ps := t.procs[pid]
+	for i := len(ps) - 1; i >= 0; i-- {
+		if ps[i].start > at {
+			continue
+		}
+		if !ps[i].exited.IsZero() && TicksAt(ps[i].exited) < at {
+			return nil
+		}
+		return ps[i]
+	}
+	return nil
+}
+
+// detail converts tp and up to n of its ancestors to a ProcessDetail chain,
+// which ends at init (pid 1). Parents are resolved to the incarnation that
+// existed when the child was started. Must be called with t.mu held.
+func (t *Tracker) detail(tp *trackedProc, n int) *ProcessDetail {
+	p := &ProcessDetail{
+		Pid:     tp.pid,
+		Name:    tp.name,
+		CmdLine: tp.cmdline,
+		Exe:     tp.exe,
+		User:    tp.user,
+		UID:     tp.uid,
+		Cgroup:  tp.cgroup,
+	}
+	if n <= 0 || tp.pid == 1 {
+		return p
+	}
+	if tp.ppid == 0 {
+		p.Parent = unknown(1)
+		return p
+	}
+	parent := t.incarnation(tp.ppid, tp.start)
+	if parent == nil {
+		p.Parent = unknown(1)
+		p.Parent.Pid = tp.ppid
+		return p
+	}
+	p.Parent = t.detail(parent, n-1)
+	return p
+}
+
+// readTracked builds a tracked process from /proc/<pid>.
+func readTracked(pid int32) (*trackedProc, error) {
+	name, ppid, start, err := readStat(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := &trackedProc{
+		pid:   pid,
+		ppid:  ppid,
+		start: start,
+		name:  name,
+	}
+	if tp.cmdline = readCmdline(pid); tp.cmdline == "" {
+		tp.cmdline = tp.name
+	}
+	tp.exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	// /proc/<pid> is owned by the effective uid of the process.
+	if fi, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			tp.uid = st.Uid
+		}
+	}
+	tp.user = lookupUser(tp.uid)
+	tp.cgroup = readCgroup(pid)
+	return tp, nil
+}
+
+// readStat returns the name, parent pid and start time (clock ticks since
+// boot) of pid from /proc/<pid>/stat.
+func readStat(pid int32) (string, int32, uint64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	// comm is enclosed in parentheses and may itself contain spaces and
+	// parentheses; fields after the last ')' are well-behaved.
+	open := bytes.IndexByte(stat, '(')
+	closing := bytes.LastIndexByte(stat, ')')
+	if open < 0 || closing < open {
+		return "", 0, 0, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(stat[closing+1:]))
+	// fields[0] is state (field 3); ppid is field 4, starttime field 22.
+	if len(fields) < 20 {
+		return "", 0, 0, fmt.Errorf("short stat for pid %d", pid)
+	}
+	ppid, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return string(stat[open+1 : closing]), int32(ppid), start, nil
+}
+
+// readCmdline returns the command line of pid with arguments separated by
+// spaces, or "" if it can not be read.
+func readCmdline(pid int32) string {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.ReplaceAll(b, []byte{0}, []byte{' '})))
+}